@@ -0,0 +1,272 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"github.com/shahradelahi/wiresocks/log"
+	"github.com/shahradelahi/wiresocks/proxy/statute"
+)
+
+// BalanceStrategy selects how new connections are spread over tunnels.
+type BalanceStrategy string
+
+const (
+	// BalanceRoundRobin hands out tunnels in turn.
+	BalanceRoundRobin BalanceStrategy = "round-robin"
+	// BalanceLeastConn picks the tunnel with the fewest open connections.
+	BalanceLeastConn BalanceStrategy = "least-conn"
+	// BalanceLatency picks the tunnel with the lowest probe round-trip time.
+	BalanceLatency BalanceStrategy = "latency"
+)
+
+// stickyTimeout is how long a destination host stays mapped to the tunnel it
+// was last dialed through after its last connection.
+const stickyTimeout = 10 * time.Minute
+
+// ParseBalanceStrategy parses the name of a BalanceStrategy.
+func ParseBalanceStrategy(name string) (BalanceStrategy, error) {
+	switch strategy := BalanceStrategy(name); strategy {
+	case BalanceRoundRobin, BalanceLeastConn, BalanceLatency:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown balance strategy %q", name)
+	}
+}
+
+// balancedTunnel is a tunnel along with the state the balancer keeps on it.
+type balancedTunnel struct {
+	*tunnel
+	index   int
+	healthy atomic.Bool
+	rtt     atomic.Duration
+}
+
+type stickyEntry struct {
+	t        *balancedTunnel
+	lastUsed time.Time
+}
+
+// balancer runs several tunnels side by side and spreads new connections
+// over the healthy ones. Connections to the same destination host stick to
+// one tunnel so that sessions don't hop between exits.
+type balancer struct {
+	strategy BalanceStrategy
+	testURL  string
+	tunnels  []*balancedTunnel
+	next     atomic.Uint64
+
+	mu     sync.Mutex
+	sticky map[string]*stickyEntry
+}
+
+// newBalancer brings up every configuration in confs. Configurations that
+// fail to come up are left out, as long as at least one succeeds.
+func newBalancer(ctx context.Context, strategy BalanceStrategy, confs []*Configuration, dnsServer, testURL string) (*balancer, error) {
+	b := &balancer{
+		strategy: strategy,
+		testURL:  testURL,
+		sticky:   make(map[string]*stickyEntry),
+	}
+
+	var errs []error
+	for i, conf := range confs {
+		log.Infof("Bringing up WireGuard configuration %d of %d.", i+1, len(confs))
+		t, err := startTunnel(ctx, conf, dnsServer, testURL)
+		if err != nil {
+			log.Warnf("WireGuard configuration %d failed, leaving it out of the balancer: %v", i+1, err)
+			errs = append(errs, fmt.Errorf("configuration %d: %w", i+1, err))
+			continue
+		}
+
+		bt := &balancedTunnel{tunnel: t, index: i}
+		bt.healthy.Store(true)
+		b.tunnels = append(b.tunnels, bt)
+	}
+
+	if len(b.tunnels) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	log.Infof("Balancing connections over %d tunnel(s) using %s.", len(b.tunnels), strategy)
+	if b.strategy == BalanceLatency {
+		b.probeAll(ctx)
+	}
+	return b, nil
+}
+
+func (b *balancer) pick(req *statute.ProxyRequest) *tunnel {
+	host := req.DestHost
+	if host == "" {
+		host, _, _ = net.SplitHostPort(req.Destination)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := b.sticky[host]; ok && entry.t.healthy.Load() && now.Sub(entry.lastUsed) < stickyTimeout {
+		entry.lastUsed = now
+		entry.t.acquire()
+		return entry.t.tunnel
+	}
+
+	t := b.choose()
+	b.sticky[host] = &stickyEntry{t: t, lastUsed: now}
+	t.acquire()
+	return t.tunnel
+}
+
+// choose selects a tunnel according to the strategy. Unhealthy tunnels are
+// only used when no healthy one is left.
+func (b *balancer) choose() *balancedTunnel {
+	candidates := make([]*balancedTunnel, 0, len(b.tunnels))
+	for _, t := range b.tunnels {
+		if t.healthy.Load() {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = b.tunnels
+	}
+
+	switch b.strategy {
+	case BalanceLeastConn:
+		best := candidates[0]
+		for _, t := range candidates[1:] {
+			if t.active.Load() < best.active.Load() {
+				best = t
+			}
+		}
+		return best
+	case BalanceLatency:
+		best := candidates[0]
+		for _, t := range candidates[1:] {
+			if rtt := t.rtt.Load(); rtt > 0 && (best.rtt.Load() == 0 || rtt < best.rtt.Load()) {
+				best = t
+			}
+		}
+		return best
+	default:
+		n := b.next.Inc() - 1
+		return candidates[n%uint64(len(candidates))]
+	}
+}
+
+// healthy reports whether any tunnel is in rotation and still handshaking.
+func (b *balancer) healthy() bool {
+	for _, t := range b.tunnels {
+		if t.healthy.Load() && t.alive() {
+			return true
+		}
+	}
+	return false
+}
+
+// monitor probes every tunnel until ctx is done. Tunnels failing their probe
+// are taken out of rotation until they pass again.
+func (b *balancer) monitor(ctx context.Context) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		b.probeAll(ctx)
+		b.expireSticky()
+	}
+}
+
+func (b *balancer) probeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range b.tunnels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.probe(ctx, t)
+		}()
+	}
+	wg.Wait()
+}
+
+// probe measures the round-trip time of a TCP handshake to the test URL host
+// through t. The RTT is smoothed so a single slow probe doesn't flip the
+// preferred tunnel.
+func (b *balancer) probe(ctx context.Context, t *balancedTunnel) {
+	target, err := probeAddress(b.testURL)
+	if err != nil {
+		log.Debugf("Cannot probe tunnel %d: %v", t.index+1, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := t.tnet.DialContext(ctx, "tcp", target)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return
+		}
+		if t.healthy.Swap(false) {
+			log.Warnf("Tunnel %d failed its probe, taking it out of rotation: %v", t.index+1, err)
+		}
+		return
+	}
+	rtt := time.Since(start)
+	_ = conn.Close()
+
+	if prev := t.rtt.Load(); prev > 0 {
+		rtt = (prev*7 + rtt) / 8
+	}
+	t.rtt.Store(rtt)
+	if !t.healthy.Swap(true) {
+		log.Infof("Tunnel %d passed its probe again, putting it back into rotation.", t.index+1)
+	}
+	log.Debugf("Tunnel %d probe RTT: %v", t.index+1, rtt)
+}
+
+func (b *balancer) expireSticky() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for host, entry := range b.sticky {
+		if now.Sub(entry.lastUsed) >= stickyTimeout {
+			delete(b.sticky, host)
+		}
+	}
+}
+
+func (b *balancer) Close() {
+	for _, t := range b.tunnels {
+		t.Close()
+	}
+}
+
+// probeAddress returns the host:port dialed to probe a tunnel.
+func probeAddress(testURL string) (string, error) {
+	u, err := url.Parse(testURL)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
@@ -0,0 +1,71 @@
+package wiresocks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shahradelahi/wiresocks/proxy/statute"
+)
+
+func newTestBalancer(strategy BalanceStrategy, n int) *balancer {
+	b := &balancer{
+		strategy: strategy,
+		sticky:   make(map[string]*stickyEntry),
+	}
+	for i := 0; i < n; i++ {
+		bt := &balancedTunnel{tunnel: &tunnel{idle: make(chan struct{}, 1)}, index: i}
+		bt.healthy.Store(true)
+		b.tunnels = append(b.tunnels, bt)
+	}
+	return b
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := newTestBalancer(BalanceRoundRobin, 3)
+
+	seen := make(map[*tunnel]bool)
+	for _, host := range []string{"a.example", "b.example", "c.example"} {
+		seen[b.pick(&statute.ProxyRequest{DestHost: host})] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected three distinct tunnels, got %d", len(seen))
+	}
+}
+
+func TestBalancerStickyByHost(t *testing.T) {
+	b := newTestBalancer(BalanceRoundRobin, 3)
+
+	first := b.pick(&statute.ProxyRequest{Destination: "example.com:443"})
+	for i := 0; i < 5; i++ {
+		if got := b.pick(&statute.ProxyRequest{Destination: "example.com:80"}); got != first {
+			t.Fatalf("connection %d to the same host used a different tunnel", i)
+		}
+	}
+
+	// An unhealthy tunnel drops its sticky mappings.
+	for _, bt := range b.tunnels {
+		if bt.tunnel == first {
+			bt.healthy.Store(false)
+		} else {
+			bt.healthy.Store(true)
+		}
+	}
+	if got := b.pick(&statute.ProxyRequest{Destination: "example.com:443"}); got == first {
+		t.Fatal("sticky mapping kept pointing at an unhealthy tunnel")
+	}
+}
+
+func TestBalancerLeastConnAndLatency(t *testing.T) {
+	b := newTestBalancer(BalanceLeastConn, 2)
+	b.tunnels[0].acquire()
+	if got := b.pick(&statute.ProxyRequest{DestHost: "a.example"}); got != b.tunnels[1].tunnel {
+		t.Fatal("least-conn did not pick the idle tunnel")
+	}
+
+	b = newTestBalancer(BalanceLatency, 2)
+	b.tunnels[0].rtt.Store(80 * time.Millisecond)
+	b.tunnels[1].rtt.Store(20 * time.Millisecond)
+	if got := b.pick(&statute.ProxyRequest{DestHost: "a.example"}); got != b.tunnels[1].tunnel {
+		t.Fatal("latency did not pick the fastest tunnel")
+	}
+}
@@ -0,0 +1,248 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/amnezia-vpn/amneziawg-go/conn"
+)
+
+// newBind returns the bind of the WireGuard socket of conf, whose peer
+// endpoints are IP addresses: a streamBind for a stream transport, a
+// socksBind when the interface or some peers go through a SOCKS5 proxy, or
+// else the direct bind of newDirectBind.
+func newBind(conf *Configuration) conn.Bind {
+	iface := conf.Interface
+	if iface.Transport != nil && iface.Transport.isStream() {
+		return newStreamBind(iface.Transport, iface.BindAddress)
+	}
+
+	peers := make(map[netip.AddrPort]*Transport)
+	proxied := false
+	for _, peer := range conf.Peers {
+		if peer.Transport == nil {
+			continue
+		}
+		// A peer whose endpoint is not resolved yet is added once it is.
+		proxied = true
+		if addr, err := netip.ParseAddrPort(peer.Endpoint); err == nil {
+			peers[netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())] = peer.Transport
+		}
+	}
+	if iface.Transport != nil {
+		return newSOCKSBind(iface.Transport, peers, nil, iface.BindAddress, iface.BindInterface)
+	}
+	if proxied {
+		return newSOCKSBind(nil, peers, newDirectBind(iface), iface.BindAddress, iface.BindInterface)
+	}
+	return newDirectBind(iface)
+}
+
+// newDirectBind returns the bind of a WireGuard UDP socket: the default
+// dual-stack bind, or a localBind when the socket is restricted to a local
+// address or interface.
+func newDirectBind(iface *InterfaceConfig) conn.Bind {
+	if !iface.BindAddress.IsValid() && iface.BindInterface == "" {
+		return conn.NewDefaultBind()
+	}
+	return &localBind{addr: iface.BindAddress, ifname: iface.BindInterface}
+}
+
+// localBind is a conn.Bind on a single UDP socket bound to addr, or to the
+// network interface ifname. Unlike the default bind it only speaks the
+// address family of addr, and reads and writes one packet at a time.
+type localBind struct {
+	addr   netip.Addr
+	ifname string
+
+	mu   sync.Mutex
+	conn *net.UDPConn
+	mark uint32
+}
+
+// localEndpoint is the conn.Endpoint of the binds of this package.
+type localEndpoint struct {
+	dst netip.AddrPort
+}
+
+func (e *localEndpoint) ClearSrc()           {}
+func (e *localEndpoint) SrcToString() string { return "" }
+func (e *localEndpoint) DstToString() string { return e.dst.String() }
+func (e *localEndpoint) DstIP() netip.Addr   { return e.dst.Addr() }
+func (e *localEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
+
+func (e *localEndpoint) DstToBytes() []byte {
+	b, _ := e.dst.MarshalBinary()
+	return b
+}
+
+func (b *localBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	addr := b.addr
+	if !addr.IsValid() {
+		var err error
+		if addr, err = interfaceAddr(b.ifname); err != nil {
+			return nil, 0, err
+		}
+	}
+	network := "udp4"
+	if addr.Is6() && !addr.Is4In6() {
+		network = "udp6"
+	}
+
+	lc := net.ListenConfig{Control: func(_, _ string, rc syscall.RawConn) error {
+		var err error
+		if cerr := rc.Control(func(fd uintptr) {
+			if b.ifname != "" {
+				if err = bindToDevice(fd, b.ifname); err != nil {
+					return
+				}
+			}
+			if b.mark != 0 {
+				err = setMark(fd, b.mark)
+			}
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	pc, err := lc.ListenPacket(context.Background(), network, net.JoinHostPort(addr.Unmap().String(), strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, 0, err
+	}
+	udp := pc.(*net.UDPConn)
+	b.conn = udp
+
+	receive := func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		n, src, err := udp.ReadFromUDPAddrPort(packets[0])
+		if err != nil {
+			return 0, err
+		}
+		sizes[0] = n
+		eps[0] = &localEndpoint{dst: netip.AddrPortFrom(src.Addr().Unmap(), src.Port())}
+		return 1, nil
+	}
+	return []conn.ReceiveFunc{receive}, uint16(udp.LocalAddr().(*net.UDPAddr).Port), nil
+}
+
+func (b *localBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.Close()
+	b.conn = nil
+	return err
+}
+
+// SetMark sets the fwmark of the socket, now if it is open and else when it
+// is opened.
+func (b *localBind) SetMark(mark uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mark = mark
+	if b.conn == nil || mark == 0 {
+		return nil
+	}
+	rc, err := b.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if cerr := rc.Control(func(fd uintptr) { err = setMark(fd, mark) }); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (b *localBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	e, ok := ep.(*localEndpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+	b.mu.Lock()
+	udp := b.conn
+	b.mu.Unlock()
+	if udp == nil {
+		return net.ErrClosed
+	}
+
+	for _, buf := range bufs {
+		if _, err := udp.WriteToUDPAddrPort(buf, e.dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *localBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &localEndpoint{dst: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())}, nil
+}
+
+func (b *localBind) BatchSize() int {
+	return 1
+}
+
+// deviceControl returns the Control function of sockets restricted to the
+// network interface ifname, or nil when ifname is empty.
+func deviceControl(ifname string) func(network, address string, rc syscall.RawConn) error {
+	if ifname == "" {
+		return nil
+	}
+	return func(_, _ string, rc syscall.RawConn) error {
+		var err error
+		if cerr := rc.Control(func(fd uintptr) {
+			err = bindToDevice(fd, ifname)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// interfaceAddr returns the first IPv4 address of the network interface
+// name, or its first global IPv6 address if it has no IPv4 one.
+func interfaceAddr(name string) (netip.Addr, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid BindInterface: %w", err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to list the addresses of %s: %w", name, err)
+	}
+
+	var v6 netip.Addr
+	for _, a := range addrs {
+		prefix, err := netip.ParsePrefix(a.String())
+		if err != nil {
+			continue
+		}
+		addr := prefix.Addr()
+		if addr.Is4() {
+			return addr, nil
+		}
+		if !v6.IsValid() && addr.IsGlobalUnicast() {
+			v6 = addr
+		}
+	}
+	if v6.IsValid() {
+		return v6, nil
+	}
+	return netip.Addr{}, errors.New("interface " + name + " has no usable IP address")
+}
@@ -0,0 +1,13 @@
+package wiresocks
+
+import "syscall"
+
+// bindToDevice restricts the socket fd to the network interface name, so
+// that its traffic leaves through it whatever the routing table says.
+func bindToDevice(fd uintptr, name string) error {
+	return syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+}
+
+func setMark(fd uintptr, mark uint32) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+}
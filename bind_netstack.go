@@ -0,0 +1,152 @@
+package wiresocks
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/amnezia-vpn/amneziawg-go/conn"
+	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
+)
+
+// wireguardOverhead is the size of the headers WireGuard adds to a packet:
+// the outer IPv6 and UDP headers, and its own header and tag.
+const wireguardOverhead = 80
+
+// netstackBind is a conn.Bind whose UDP sockets live on the netstack of an
+// entry tunnel, so that the tunnel using it is nested in the entry tunnel
+// and its peers only see the entry server.
+type netstackBind struct {
+	tnet   *netstack.Net
+	v4, v6 bool
+
+	mu    sync.Mutex
+	conns []netstackConn
+}
+
+// netstackConn is a UDP socket of a netstackBind.
+type netstackConn struct {
+	net.PacketConn
+	is4 bool
+}
+
+// newNetstackBind returns a bind sending datagrams through tnet, the
+// netstack of the tunnel of entry.
+func newNetstackBind(tnet *netstack.Net, entry *Configuration) *netstackBind {
+	b := &netstackBind{tnet: tnet}
+	for _, prefix := range entry.Interface.Addresses {
+		if prefix.Addr().Is4() {
+			b.v4 = true
+		} else {
+			b.v6 = true
+		}
+	}
+	return b
+}
+
+func (b *netstackBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conns != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	var addrs []netip.Addr
+	if b.v4 {
+		addrs = append(addrs, netip.IPv4Unspecified())
+	}
+	if b.v6 {
+		addrs = append(addrs, netip.IPv6Unspecified())
+	}
+
+	var fns []conn.ReceiveFunc
+	for _, addr := range addrs {
+		pc, err := b.tnet.ListenUDPAddrPort(netip.AddrPortFrom(addr, port))
+		if err != nil {
+			for _, c := range b.conns {
+				_ = c.Close()
+			}
+			b.conns = nil
+			return nil, 0, err
+		}
+		if port == 0 {
+			// Use the same port for both address families.
+			port = uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+		}
+		b.conns = append(b.conns, netstackConn{PacketConn: pc, is4: addr.Is4()})
+		fns = append(fns, func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+			n, from, err := pc.ReadFrom(packets[0])
+			if err != nil {
+				return 0, err
+			}
+			addr := from.(*net.UDPAddr).AddrPort()
+			sizes[0] = n
+			eps[0] = &localEndpoint{dst: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())}
+			return 1, nil
+		})
+	}
+	return fns, port, nil
+}
+
+func (b *netstackBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	for _, c := range b.conns {
+		if cerr := c.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	b.conns = nil
+	return err
+}
+
+func (b *netstackBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	e, ok := ep.(*localEndpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+
+	b.mu.Lock()
+	open := b.conns != nil
+	var pc net.PacketConn
+	for _, c := range b.conns {
+		if c.is4 == e.dst.Addr().Is4() {
+			pc = c.PacketConn
+			break
+		}
+	}
+	b.mu.Unlock()
+	if !open {
+		return net.ErrClosed
+	}
+	if pc == nil {
+		return fmt.Errorf("the entry tunnel has no address to reach %s", e.dst)
+	}
+
+	addr := net.UDPAddrFromAddrPort(e.dst)
+	for _, buf := range bufs {
+		if _, err := pc.WriteTo(buf, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetMark is a no-op, the sockets don't belong to the host.
+func (b *netstackBind) SetMark(uint32) error {
+	return nil
+}
+
+func (b *netstackBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &localEndpoint{dst: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())}, nil
+}
+
+func (b *netstackBind) BatchSize() int {
+	return 1
+}
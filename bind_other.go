@@ -0,0 +1,14 @@
+//go:build !linux
+
+package wiresocks
+
+// bindToDevice is a no-op where SO_BINDTODEVICE is missing: the socket is
+// only bound to the address of the interface.
+func bindToDevice(fd uintptr, name string) error {
+	return nil
+}
+
+// setMark is a no-op, fwmarks only exist on Linux.
+func setMark(fd uintptr, mark uint32) error {
+	return nil
+}
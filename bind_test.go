@@ -0,0 +1,64 @@
+package wiresocks
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/conn"
+)
+
+func TestLocalBind(t *testing.T) {
+	b := newDirectBind(&InterfaceConfig{BindAddress: netip.MustParseAddr("127.0.0.1")})
+	fns, port, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if port == 0 || len(fns) != 1 {
+		t.Fatalf("unexpected open result: port %d, %d receive functions", port, len(fns))
+	}
+
+	ep, err := b.ParseEndpoint(netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send([][]byte{[]byte("ping")}, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := [][]byte{make([]byte, 64)}
+	sizes := make([]int, 1)
+	eps := make([]conn.Endpoint, 1)
+	n, err := fns[0](packets, sizes, eps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || string(packets[0][:sizes[0]]) != "ping" || eps[0].DstToString() != ep.DstToString() {
+		t.Fatalf("unexpected packet %q from %v", packets[0][:sizes[0]], eps[0])
+	}
+}
+
+func TestParseInterfaceListenPort(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = dGhpcyBpcyBhIHRlc3QgcHJpdmF0ZSBleS4uLi4uLi4=
+Address = 10.10.0.1/32
+ListenPort = 51820
+BindAddress = 192.168.1.10
+
+[Peer]
+PublicKey = dGhpcyBpcyBhIHRlc3QgcHVibGljIGtleS4uLi4uLi4=
+AllowedIPs = 0.0.0.0/0
+Endpoint = 1.2.3.4:51820`
+	conf, err := ParseConfigData([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Interface.ListenPort != 51820 || conf.Interface.BindAddress != netip.MustParseAddr("192.168.1.10") {
+		t.Fatalf("unexpected interface: %+v", conf.Interface)
+	}
+	if s := mustString(t, conf); !strings.Contains(s, "ListenPort = 51820\n") || !strings.Contains(s, "BindAddress = 192.168.1.10\n") {
+		t.Fatalf("ListenPort and BindAddress are not exported:\n%s", s)
+	}
+}
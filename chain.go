@@ -0,0 +1,130 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/shahradelahi/wiresocks/proxy/http"
+	"github.com/shahradelahi/wiresocks/proxy/socks/socks5"
+)
+
+// Upstream proxy schemes.
+const (
+	UpstreamSOCKS5 = "socks5"
+	UpstreamHTTP   = "http"
+)
+
+// UpstreamProxy is a proxy reached through the tunnel, such as a corporate
+// proxy behind the peer, that connections are handed to with a SOCKS5 or
+// HTTP CONNECT handshake.
+type UpstreamProxy struct {
+	Scheme string
+	// Address is the host:port of the proxy.
+	Address string
+	// Username and Password authenticate with the proxy when Username is
+	// set.
+	Username string
+	Password string
+}
+
+// ParseUpstreamProxy parses a proxy URL: socks5://[user:pass@]host[:port] or
+// http://[user:pass@]host[:port].
+func ParseUpstreamProxy(s string) (*UpstreamProxy, error) {
+	s = strings.TrimSpace(s)
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", s, err)
+	}
+
+	p := &UpstreamProxy{Scheme: strings.ToLower(u.Scheme), Address: u.Host}
+	defaultPort := ""
+	switch p.Scheme {
+	case UpstreamSOCKS5:
+		defaultPort = "1080"
+	case UpstreamHTTP:
+		defaultPort = "8080"
+	default:
+		return nil, fmt.Errorf("unknown proxy %q, expected socks5:// or http://", s)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("invalid proxy %q: proxies have no path", s)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy %q: missing host", s)
+	}
+	if u.Port() == "" {
+		p.Address = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	if u.User != nil {
+		p.Username = u.User.Username()
+		p.Password, _ = u.User.Password()
+	}
+	return p, nil
+}
+
+func (p *UpstreamProxy) String() string {
+	s := p.Scheme + "://"
+	if p.Username != "" {
+		s += url.UserPassword(p.Username, p.Password).String() + "@"
+	}
+	return s + p.Address
+}
+
+// connect asks the proxy on conn to connect to address and returns the
+// connection to address.
+func (p *UpstreamProxy) connect(conn net.Conn, address string) (net.Conn, error) {
+	if p.Scheme == UpstreamHTTP {
+		return http.Connect(conn, address, p.Username, p.Password)
+	}
+	if err := socks5.Connect(conn, address, p.Username, p.Password); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Chain is a named list of upstream proxies. A connection routed through a
+// chain is dialed to the first proxy through the tunnel, and each proxy is
+// asked to connect to the next one, the last to the destination.
+type Chain struct {
+	Name    string
+	Proxies []*UpstreamProxy
+}
+
+// dial connects to address, a TCP host:port, through the proxies of c, the
+// first of which is dialed with dial.
+func (c *Chain) dial(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), address string) (net.Conn, error) {
+	first := c.Proxies[0]
+	conn, err := dial(ctx, "tcp", first.Address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	// Stop the handshakes when ctx is done.
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	for i, p := range c.Proxies {
+		next := address
+		if i+1 < len(c.Proxies) {
+			next = c.Proxies[i+1].Address
+		}
+		tunneled, err := p.connect(conn, next)
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("chain %s: %s: %w", c.Name, p.Address, err)
+		}
+		conn = tunneled
+	}
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
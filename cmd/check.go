@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/shahradelahi/wiresocks"
+	"github.com/shahradelahi/wiresocks/log"
+)
+
+// Exit codes of the check subcommand.
+const (
+	checkInvalid   = 1 // a configuration has errors, or warnings with -strict
+	checkHandshake = 2 // the configuration is valid but no handshake completed
+	checkUsage     = 3 // bad arguments or an unreadable file
+)
+
+// exitError makes a subcommand exit with a specific code. A nil err exits
+// without printing anything, for failures already reported.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// runCheck validates configuration files and prints a diagnostic per problem,
+// with the file and line it refers to. With -handshake it also brings each
+// tunnel up and waits for a handshake with its peers.
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	handshake := fs.Bool("handshake", false, "Also try a handshake with the peers of each configuration.")
+	timeout := fs.Duration("timeout", 5*time.Second, "How long to wait for the handshake.")
+	strict := fs.Bool("strict", false, "Fail on warnings too.")
+	verbose := fs.Bool("v", false, "Log the handshake attempt.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: wiresocks check [-handshake] [-timeout 5s] [-strict] config.conf...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return &exitError{code: checkUsage, err: err}
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return &exitError{code: checkUsage, err: flag.ErrHelp}
+	}
+
+	// Failures are reported as diagnostics, the log only adds noise.
+	logLevel := log.SilentLevel
+	if *verbose {
+		logLevel = log.DebugLevel
+	}
+	logger, err := log.NewLeveled(logLevel)
+	if err != nil {
+		return &exitError{code: checkUsage, err: err}
+	}
+	log.SetLogger(logger)
+
+	code := 0
+	fail := func(c int) {
+		// The highest code wins.
+		if c > code {
+			code = c
+		}
+	}
+
+	for _, path := range fs.Args() {
+		diags, err := wiresocks.CheckConfig(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			fail(checkUsage)
+			continue
+		}
+
+		var errs, warnings int
+		for _, d := range diags {
+			fmt.Println(d)
+			if d.Severity == wiresocks.SeverityError {
+				errs++
+			} else {
+				warnings++
+			}
+		}
+		if errs > 0 || (*strict && warnings > 0) {
+			fmt.Printf("%s: %d error(s), %d warning(s)\n", path, errs, warnings)
+			fail(checkInvalid)
+			continue
+		}
+
+		if !*handshake {
+			fmt.Printf("%s: OK (%d warning(s))\n", path, warnings)
+			continue
+		}
+
+		conf, err := wiresocks.ParseConfig(path)
+		if err != nil {
+			// CheckConfig should have caught this; report it all the same.
+			fmt.Printf("%s: %v\n", path, err)
+			fail(checkInvalid)
+			continue
+		}
+		err = wiresocks.CheckHandshake(context.Background(), conf, "1.1.1.1", *timeout)
+		if err != nil {
+			fmt.Printf("%s: handshake failed: %v\n", path, err)
+			fail(checkHandshake)
+			continue
+		}
+		fmt.Printf("%s: OK, handshake completed (%d warning(s))\n", path, warnings)
+	}
+
+	if code != 0 {
+		return &exitError{code: code}
+	}
+	return nil
+}
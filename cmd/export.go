@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/shahradelahi/wiresocks"
+	"github.com/shahradelahi/wiresocks/log"
+)
+
+// runExport prints the configuration wiresocks would run with for a file,
+// in wg-quick INI, JSON or YAML.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "ini", "Output format: ini, json or yaml.")
+	redact := fs.Bool("redact", false, "Replace the private key, preshared keys and proxy passwords with a placeholder.")
+	raw := fs.Bool("raw", false, "Print the file as parsed, without -s, -h and the settings wiresocks forces at run time.")
+	resolve := fs.Bool("resolve", false, "Write secrets given as env:NAME or file:/path references as their values.")
+	output := fs.String("o", "", "Write to this file instead of stdout.")
+	var socksAddrs, httpAddrs stringList
+	fs.Var(&socksAddrs, "s", "SOCKS proxy listener, as for the main command.")
+	fs.Var(&httpAddrs, "h", "HTTP proxy listener, as for the main command.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: wiresocks export [-format ini|json|yaml] [-redact] [-resolve] [-raw] [-s addr] [-h addr] config.conf")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	f, err := wiresocks.ParseExportFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	// Only warnings and errors, the export goes to stdout.
+	logger, err := log.NewLeveled(log.WarnLevel)
+	if err != nil {
+		return err
+	}
+	log.SetLogger(logger)
+
+	conf, err := wiresocks.ParseConfig(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if !*raw {
+		if conf.Proxy, err = proxyOptions(conf, socksAddrs, httpAddrs); err != nil {
+			return err
+		}
+		conf = conf.Effective()
+	}
+
+	if *resolve {
+		conf = conf.Resolved()
+	}
+
+	out, err := conf.Export(f, *redact)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	// Unredacted exports hold the private key.
+	mode := os.FileMode(0o600)
+	if *redact {
+		mode = 0o644
+	}
+	return os.WriteFile(*output, out, mode)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+
+	"github.com/shahradelahi/wiresocks"
+)
+
+// runImport converts a configuration link, or a QR code image holding a
+// link or a wg-quick configuration, into a validated configuration file.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	output := fs.String("o", "", "Write the configuration to this file instead of stdout.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: wiresocks import [-o config.conf] <qr.png | wireguard://... | vpn://... | ->")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	text, err := readImport(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// QR codes may also hold a plain wg-quick configuration.
+	conf, err := wiresocks.ParseConfigData([]byte(text))
+	if err != nil {
+		return err
+	}
+
+	out, err := conf.String()
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		fmt.Print(out)
+		return nil
+	}
+	if err := os.WriteFile(*output, []byte(out), 0o600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s.\n", *output)
+	return nil
+}
+
+// readImport returns the text to import from src: a link given directly, or
+// the content of a file or of stdin for "-". Images are decoded as QR codes.
+func readImport(src string) (string, error) {
+	if wiresocks.IsConfigURI(src) {
+		return src, nil
+	}
+
+	var data []byte
+	var err error
+	if src == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(src)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		// Not an image, take the content as text.
+		return strings.TrimSpace(string(data)), nil
+	}
+	return decodeQRCode(img)
+}
+
+func decodeQRCode(img image.Image) (string, error) {
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return "", err
+	}
+	result, err := qrcode.NewQRCodeReader().Decode(bmp, map[gozxing.DecodeHintType]interface{}{
+		gozxing.DecodeHintType_TRY_HARDER: true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("no QR code found in the image: %w", err)
+	}
+	return strings.TrimSpace(result.GetText()), nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/shahradelahi/wiresocks"
+)
+
+// runGenkey prints a new base64 private key, like `wg genkey`.
+func runGenkey(args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: wiresocks genkey")
+	}
+	key, err := wiresocks.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	return printKey(key)
+}
+
+// runGenpsk prints a new base64 preshared key, like `wg genpsk`.
+func runGenpsk(args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: wiresocks genpsk")
+	}
+	key, err := wiresocks.GeneratePresharedKey()
+	if err != nil {
+		return err
+	}
+	return printKey(key)
+}
+
+// runPubkey reads a base64 private key from stdin and prints its public key,
+// like `wg pubkey`.
+func runPubkey(args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: wiresocks pubkey < private.key")
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	private, err := wiresocks.EncodeBase64ToHex(strings.TrimSpace(line))
+	if err != nil {
+		return fmt.Errorf("invalid private key: %w", err)
+	}
+	public, err := wiresocks.PublicKey(private)
+	if err != nil {
+		return err
+	}
+	return printKey(public)
+}
+
+func printKey(hexKey string) error {
+	key, err := wiresocks.EncodeHexToBase64(hexKey)
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+// runGenconf writes a skeleton configuration with a new private key.
+func runGenconf(args []string) error {
+	fs := flag.NewFlagSet("genconf", flag.ContinueOnError)
+	output := fs.String("o", "", "Write the configuration to this file instead of stdout.")
+	address := fs.String("address", "10.0.0.2/32", "Address of the interface.")
+	dns := fs.String("dns", "1.1.1.1", "DNS server of the interface.")
+	peerKey := fs.String("peer", "", "Base64 public key of the peer.")
+	endpoint := fs.String("endpoint", "", "Endpoint of the peer, host:port.")
+	allowedIPs := fs.String("allowed-ips", "0.0.0.0/0, ::/0", "Networks routed through the peer.")
+	psk := fs.Bool("psk", false, "Generate a preshared key for the peer.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if _, err := netip.ParsePrefix(*address); err != nil {
+		return fmt.Errorf("invalid -address: %w", err)
+	}
+	if *peerKey != "" {
+		if _, err := wiresocks.EncodeBase64ToHex(*peerKey); err != nil {
+			return fmt.Errorf("invalid -peer: %w", err)
+		}
+	}
+
+	private, err := wiresocks.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	public, err := wiresocks.PublicKey(private)
+	if err != nil {
+		return err
+	}
+	privateB64, _ := wiresocks.EncodeHexToBase64(private)
+	publicB64, _ := wiresocks.EncodeHexToBase64(public)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Public key of this interface, to add to the peer: %s\n", publicB64)
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", privateB64)
+	fmt.Fprintf(&b, "Address = %s\n", *address)
+	if *dns != "" {
+		fmt.Fprintf(&b, "DNS = %s\n", *dns)
+	}
+
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", placeholder(*peerKey, "<peer public key>"))
+	var pskB64 string
+	if *psk {
+		key, err := wiresocks.GeneratePresharedKey()
+		if err != nil {
+			return err
+		}
+		pskB64, _ = wiresocks.EncodeHexToBase64(key)
+		fmt.Fprintf(&b, "PresharedKey = %s\n", pskB64)
+	}
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", *allowedIPs)
+	fmt.Fprintf(&b, "Endpoint = %s\n", placeholder(*endpoint, "<peer host>:<port>"))
+	b.WriteString("PersistentKeepalive = 25\n")
+
+	if *output == "" {
+		fmt.Print(b.String())
+		return nil
+	}
+	if err := os.WriteFile(*output, []byte(b.String()), 0o600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s. Public key: %s\n", *output, publicB64)
+	if pskB64 != "" {
+		fmt.Fprintf(os.Stderr, "Preshared key: %s\n", pskB64)
+	}
+	return nil
+}
+
+func placeholder(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
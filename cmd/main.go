@@ -1,28 +1,144 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"net/netip"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/shahradelahi/wiresocks"
+	"github.com/shahradelahi/wiresocks/internal/systemd"
 	"github.com/shahradelahi/wiresocks/internal/version"
 	"github.com/shahradelahi/wiresocks/log"
 )
 
+// stringList is a flag.Value that collects every occurrence of a flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 var (
-	configFile = flag.String("c", "./config.conf", "Path to the configuration file.")
-	socksAddr  = flag.String("s", "127.0.0.1:1080", "SOCKS5 proxy bind address. Use an empty string to disable.")
-	httpAddr   = flag.String("h", "", "HTTP proxy bind address. Use an empty string to disable.")
-	verbose    = flag.Bool("v", false, "Enable verbose logging.")
-	ver        = flag.Bool("version", false, "Show version information and exit.")
+	configFiles stringList
+	configDir   = flag.String("d", "", "Directory of configuration files, one tunnel per *.conf file with its own [Socks5]/[HTTP] listeners.")
+	balance     = flag.String("balance", "", "Run all configurations given with -c at once and balance connections over them: round-robin, least-conn or latency.")
+	socksAddrs  stringList
+	httpAddrs   stringList
+	readyFile   = flag.String("ready-file", "", "Write the process ID to this file once the tunnels and proxies are up.")
+	grace       = flag.Duration("grace", wiresocks.DefaultShutdownGrace, "How long to let open connections finish on shutdown before closing them.")
+	verbose     = flag.Bool("v", false, "Enable verbose logging.")
+	ver         = flag.Bool("version", false, "Show version information and exit.")
 )
 
+func init() {
+	flag.Var(&configFiles, "c", "Path to the configuration file, in the wg-quick, YAML or JSON format, or a wireguard:// or vpn:// link. Repeat to list failover configurations in order. (default \"./config.conf\")")
+	flag.Var(&socksAddrs, "s", "SOCKS5 proxy bind address, or unix:/path for a Unix socket, optionally followed by ?user=&pass=&allow=. Repeat to listen on several addresses. Use an empty string to disable. Replaces the [Socks5] and [HTTP] sections of the configuration. (default \"127.0.0.1:1080\")")
+	flag.Var(&httpAddrs, "h", "HTTP proxy bind address, or unix:/path for a Unix socket, optionally followed by ?user=&pass=&allow=. Repeat to listen on several addresses. Replaces the [Socks5] and [HTTP] sections of the configuration.")
+}
+
+// envPrefix prefixes the environment variables that set flags, e.g.
+// WIRESOCKS_READY_FILE for -ready-file.
+const envPrefix = "WIRESOCKS_"
+
+// envNames names the environment variables of the single-letter flags.
+var envNames = map[string]string{
+	"c": "CONFIG",
+	"d": "CONFIG_DIR",
+	"s": "SOCKS",
+	"h": "HTTP",
+	"v": "VERBOSE",
+}
+
+// envName returns the environment variable of the flag name.
+func envName(name string) string {
+	if env, ok := envNames[name]; ok {
+		return envPrefix + env
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets every flag of fs not given on the command line from its
+// environment variable, if set. Repeatable flags take a whitespace-separated
+// list, and an empty variable sets them to a single empty value, e.g. to
+// disable the default SOCKS listener. Values are never logged since they may
+// hold credentials.
+func applyEnv(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if err != nil || set[f.Name] || !ok {
+			return
+		}
+		if _, repeat := f.Value.(*stringList); repeat {
+			values := strings.Fields(value)
+			if len(values) == 0 {
+				values = []string{""}
+			}
+			for _, v := range values {
+				if err = f.Value.Set(v); err != nil {
+					break
+				}
+			}
+		} else {
+			err = f.Value.Set(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid value of %s: %w", envName(f.Name), err)
+		}
+	})
+	return err
+}
+
+// subcommands run instead of the proxy when named as the first argument.
+var subcommands = map[string]func(args []string) error{
+	"genkey":  runGenkey,
+	"genpsk":  runGenpsk,
+	"pubkey":  runPubkey,
+	"genconf": runGenconf,
+	"check":   runCheck,
+	"export":  runExport,
+	"import":  runImport,
+	"relay":   runRelay,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				var exit *exitError
+				code := 1
+				if errors.As(err, &exit) {
+					code = exit.code
+					err = exit.err
+				}
+				if err != nil && !errors.Is(err, flag.ErrHelp) {
+					fmt.Fprintf(os.Stderr, "wiresocks %s: %v\n", os.Args[1], err)
+				}
+				os.Exit(code)
+			}
+			return
+		}
+	}
+
 	flag.Parse()
+	if err := applyEnv(flag.CommandLine); err != nil {
+		fmt.Fprintf(os.Stderr, "wiresocks: %v\n", err)
+		os.Exit(2)
+	}
 
 	if *ver {
 		fmt.Println(version.String())
@@ -43,46 +159,89 @@ func main() {
 	log.SetLogger(logger)
 	log.Debugf("Logger initialized with level: %s", logLevel.String())
 
-	if *configFile == "" {
-		log.Fatalf("Path to a configuration file is required.")
+	if len(configFiles) == 0 && *configDir == "" {
+		configFiles = stringList{"./config.conf"}
 	}
-	log.Debugf("Using configuration file: %s", *configFile)
 
-	conf, err := wiresocks.ParseConfig(*configFile)
-	if err != nil {
-		log.Fatalf("Failed to parse config file: %v", err)
+	var confs []*wiresocks.Configuration
+	for _, configFile := range configFiles {
+		if configFile == "" {
+			log.Fatalf("Path to a configuration file is required.")
+		}
+		log.Debugf("Using configuration file: %s", configFile)
+
+		conf, err := wiresocks.ParseConfig(configFile)
+		if err != nil {
+			log.Fatalf("Failed to parse config file %s: %v", configFile, err)
+		}
+		log.Debugf("Configuration parsed successfully: %d peer(s).", len(conf.Peers))
+		confs = append(confs, conf)
+	}
+
+	// The tunnels of -d listen where their own files say.
+	if len(confs) == 0 && strings.Join(socksAddrs, "")+strings.Join(httpAddrs, "") != "" {
+		log.Fatalf("-s and -h set the listeners of the -c configuration; with -d alone, set them in the [Socks5] and [HTTP] sections of each file.")
+	}
+
+	var tunnels map[string]*wiresocks.Configuration
+	if *configDir != "" {
+		log.Debugf("Using configuration directory: %s", *configDir)
+		tunnels, err = wiresocks.ParseConfigDir(*configDir)
+		if err != nil {
+			log.Fatalf("Failed to parse config directory: %v", err)
+		}
 	}
-	log.Debugf("Configuration parsed successfully: %+v", conf)
 
 	ws, err := wiresocks.NewWireSocks()
 	if err != nil {
 		log.Fatalf("Failed to create a new WireSocks instance: %v", err)
 	}
 	log.Debugf("WireSocks instance created.")
+	ws.WithShutdownGrace(*grace)
+	if *readyFile != "" {
+		ws.WithReadyFile(*readyFile)
+	}
+	ws.WithReadyFunc(func() {
+		notify(systemd.Ready, systemd.Status("Tunnels and proxy listeners are up."))
+		go watchdog(ws)
+	})
 
-	ws.WithConfig(conf)
-	//ws.WithTestURL("https://google.com/")
-
-	if *socksAddr != "" {
-		addr, err := netip.ParseAddrPort(*socksAddr)
-		if err != nil {
-			log.Fatalf("Failed to parse SOCKS address: %v", err)
+	names := make([]string, 0, len(tunnels))
+	for name := range tunnels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		conf := tunnels[name]
+		if conf.Proxy == nil {
+			log.Fatalf("Tunnel %q has no [Socks5] or [HTTP] section.", name)
 		}
-		ws.WithSocksBindAddr(&addr)
-		log.Debugf("SOCKS5 proxy enabled on: %s", addr.String())
-	} else {
-		log.Debugf("SOCKS5 proxy disabled.")
+		ws.WithTunnel(name, conf, nil)
 	}
 
-	if *httpAddr != "" {
-		addr, err := netip.ParseAddrPort(*httpAddr)
+	if len(confs) > 0 {
+		ws.WithConfig(confs[0])
+		for _, conf := range confs[1:] {
+			ws.WithFailoverConfig(conf)
+		}
+		if *balance != "" {
+			strategy, err := wiresocks.ParseBalanceStrategy(*balance)
+			if err != nil {
+				log.Fatalf("Invalid -balance value: %v", err)
+			}
+			ws.WithBalancer(strategy)
+		}
+		//ws.WithTestURL("https://google.com/")
+
+		opts, err := proxyOptions(confs[0], socksAddrs, httpAddrs)
 		if err != nil {
-			log.Fatalf("Failed to parse HTTP address: %v", err)
+			log.Fatalf("%v", err)
 		}
-		ws.WithHTTPBindAddr(&addr)
-		log.Debugf("HTTP proxy enabled on: %s", addr.String())
-	} else {
-		log.Debugf("HTTP proxy disabled.")
+		ws.WithProxyOptions(opts)
+	}
+
+	if err := ws.WithSocketActivation(); err != nil {
+		log.Fatalf("Failed to adopt systemd sockets: %v", err)
 	}
 
 	sigChan := make(chan os.Signal, 1)
@@ -91,7 +250,11 @@ func main() {
 	go func() {
 		<-sigChan
 		log.Debugf("Signal received, shutting down...")
+		notify(systemd.Stopping, systemd.Status("Draining connections."))
 		ws.Stop()
+
+		<-sigChan
+		log.Fatalf("Second signal received, exiting without waiting for connections.")
 	}()
 
 	log.Debugf("wiresocks is starting up (version: %s, build: %s)", version.String(), version.BuildString())
@@ -102,3 +265,91 @@ func main() {
 
 	log.Debugf("wiresocks has been shut down.")
 }
+
+// proxyOptions returns the proxy settings of conf with the listeners given
+// by the -s and -h flags. The flags replace the listeners of the [Socks5] and
+// [HTTP] sections, and SOCKS listens on 127.0.0.1:1080 when neither -s nor
+// those sections name a listener. The [Proxy] and [Forward] settings always
+// come from the file.
+func proxyOptions(conf *wiresocks.Configuration, socksAddrs, httpAddrs stringList) (*wiresocks.ProxyOptions, error) {
+	opts := &wiresocks.ProxyOptions{}
+	if conf.Proxy != nil {
+		*opts = *conf.Proxy
+	}
+	if socksAddrs != nil || httpAddrs != nil {
+		opts.Socks, opts.HTTP = nil, nil
+	}
+	if socksAddrs == nil && len(opts.Socks) == 0 && len(opts.HTTP) == 0 {
+		socksAddrs = stringList{"127.0.0.1:1080"}
+	}
+
+	for _, addr := range socksAddrs {
+		if addr == "" {
+			continue
+		}
+		listener, err := wiresocks.ParseListenerOptions(addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SOCKS address: %w", err)
+		}
+		opts.Socks = append(opts.Socks, listener)
+		log.Debugf("SOCKS5 proxy enabled on: %s", listener.String())
+	}
+
+	for _, addr := range httpAddrs {
+		if addr == "" {
+			continue
+		}
+		listener, err := wiresocks.ParseListenerOptions(addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse HTTP address: %w", err)
+		}
+		opts.HTTP = append(opts.HTTP, listener)
+		log.Debugf("HTTP proxy enabled on: %s", listener.String())
+	}
+	return opts, nil
+}
+
+// notify sends states to the service manager, if wiresocks runs under one.
+func notify(states ...string) {
+	sent, err := systemd.Notify(strings.Join(states, "\n"))
+	if err != nil {
+		log.Warnf("Failed to notify service manager: %v", err)
+	} else if sent {
+		log.Debugf("Notified service manager: %s", strings.Join(states, ", "))
+	}
+}
+
+// watchdog pings the service manager watchdog for as long as the tunnels are
+// healthy, so that a tunnel which stopped handshaking gets the service
+// restarted.
+func watchdog(ws *wiresocks.WireSocks) {
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		log.Warnf("Invalid watchdog settings: %v", err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+	log.Debugf("Service manager watchdog enabled with a %v timeout.", interval)
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	healthy := true
+	for range ticker.C {
+		if ws.Healthy() {
+			if !healthy {
+				notify(systemd.Status("Tunnels and proxy listeners are up."))
+			}
+			healthy = true
+			notify(systemd.Watchdog)
+			continue
+		}
+		if healthy {
+			log.Warnf("Tunnel is unhealthy, holding back watchdog pings.")
+			notify(systemd.Status("Tunnel is unhealthy."))
+		}
+		healthy = false
+	}
+}
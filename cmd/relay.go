@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/shahradelahi/wiresocks"
+	"github.com/shahradelahi/wiresocks/log"
+)
+
+// runRelay accepts the TCP or WebSocket transport of wiresocks clients and
+// forwards their WireGuard datagrams to a server over UDP.
+func runRelay(args []string) error {
+	fs := flag.NewFlagSet("relay", flag.ContinueOnError)
+	listen := fs.String("l", "", "Transport to accept: tcp://addr:port, ws://addr:port/path or wss://addr:port/path.")
+	target := fs.String("t", "", "WireGuard server to forward the datagrams to, as host:port.")
+	certFile := fs.String("cert", "", "TLS certificate file of a wss relay.")
+	keyFile := fs.String("key", "", "TLS private key file of a wss relay.")
+	verbose := fs.Bool("v", false, "Enable verbose logging.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: wiresocks relay -l tcp://0.0.0.0:8443 -t wg.example.com:51820 [-cert cert.pem -key key.pem]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *listen == "" || *target == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	level := log.InfoLevel
+	if *verbose {
+		level = log.DebugLevel
+	}
+	logger, err := log.NewLeveled(level)
+	if err != nil {
+		return err
+	}
+	log.SetLogger(logger)
+
+	transport, err := wiresocks.ParseTransport(*listen)
+	if err != nil {
+		return err
+	}
+	if transport == nil || transport.Scheme == wiresocks.TransportSOCKS5 {
+		return errors.New("a relay listens on a tcp://, ws:// or wss:// transport")
+	}
+	opts := wiresocks.RelayOptions{Listen: transport, Target: *target}
+	if transport.Scheme == wiresocks.TransportWSS {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load the TLS certificate: %w", err)
+		}
+		opts.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return wiresocks.ServeRelay(ctx, opts)
+}
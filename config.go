@@ -1,99 +1,134 @@
 package wiresocks
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-ini/ini"
+
+	"github.com/shahradelahi/wiresocks/log"
 )
 
 type PeerConfig struct {
 	PublicKey    string
 	PreSharedKey string
-	Endpoint     string
-	KeepAlive    int
-	AllowedIPs   []netip.Prefix
+	// PreSharedKeyRef is the env:NAME or file:/path reference PreSharedKey
+	// was read from, if any.
+	PreSharedKeyRef string
+	Endpoint        string
+	KeepAlive       int
+	AllowedIPs      []netip.Prefix
+	// Transport, when set, is a SOCKS5 proxy the datagrams to this peer are
+	// sent through.
+	Transport *Transport
 }
 
 type InterfaceConfig struct {
 	PrivateKey string
-	Addresses  []netip.Prefix
-	DNS        []netip.Addr
-	MTU        int
-	FwMark     uint32
+	// PrivateKeyRef is the env:NAME or file:/path reference PrivateKey was
+	// read from, if any.
+	PrivateKeyRef string
+	Addresses     []netip.Prefix
+	DNS           []netip.Addr
+	MTU           int
+	FwMark        uint32
+	// ListenPort is the local UDP port of the WireGuard socket. Zero picks a
+	// random port on every start.
+	ListenPort uint16
+	// BindAddress and BindInterface restrict the WireGuard socket to a local
+	// IP address or network interface. By default it listens on every
+	// address.
+	BindAddress   netip.Addr
+	BindInterface string
+	// Jc, Jmin and Jmax set the number and size range of the junk packets
+	// AmneziaWG sends before a handshake, S1 and S2 the junk prepended to
+	// handshake packets, and H1 to H4 the message type headers. They must
+	// match those of the server. Zero uses the default: 10 junk packets of
+	// 50 to 1000 bytes, no handshake junk and the headers 1 to 4.
+	Jc, Jmin, Jmax int
+	S1, S2         int
+	H1, H2, H3, H4 uint32
+	// Transport, when set, carries the WireGuard datagrams to a relay over
+	// TCP or a WebSocket instead of sending them to the peers over UDP.
+	Transport *Transport
+	// Via names the configuration of an entry tunnel, as a path relative to
+	// this file or a link, and Entry holds it once loaded. The WireGuard
+	// datagrams of this tunnel then travel inside the entry tunnel.
+	Via   string
+	Entry *Configuration
+}
+
+// amneziaInts returns the AmneziaWG junk settings of iface by key name.
+func (iface *InterfaceConfig) amneziaInts() map[string]*int {
+	return map[string]*int{"Jc": &iface.Jc, "Jmin": &iface.Jmin, "Jmax": &iface.Jmax, "S1": &iface.S1, "S2": &iface.S2}
+}
+
+// amneziaHeaders returns the AmneziaWG message type headers of iface by key
+// name.
+func (iface *InterfaceConfig) amneziaHeaders() map[string]*uint32 {
+	return map[string]*uint32{"H1": &iface.H1, "H2": &iface.H2, "H3": &iface.H3, "H4": &iface.H4}
 }
 
 type Configuration struct {
 	Interface *InterfaceConfig
 	Peers     []PeerConfig
+	// Proxy holds the listeners from the [Socks5] and [HTTP] sections, or
+	// nil when the file has none.
+	Proxy *ProxyOptions
 }
 
+// String renders c in the wg-quick format read by ParseConfig, including the
+// [Socks5] and [HTTP] sections of c.Proxy.
 func (c *Configuration) String() (string, error) {
-	var b strings.Builder
+	e, err := c.export(false)
+	if err != nil {
+		return "", err
+	}
+	return e.ini(), nil
+}
 
-	// [Interface] section
-	b.WriteString("[Interface]\n")
-	if c.Interface.PrivateKey != "" {
-		privKeyB64, err := EncodeHexToBase64(c.Interface.PrivateKey)
-		if err != nil {
-			return "", err
-		}
-		b.WriteString(fmt.Sprintf("PrivateKey = %s\n", privKeyB64))
+// validate checks that c holds everything needed to bring up a tunnel. The
+// returned error matches ErrInvalidConfig.
+func (c *Configuration) validate() error {
+	if c.Interface == nil {
+		return invalidConfigf("missing [Interface]")
 	}
-	if len(c.Interface.Addresses) > 0 {
-		var addrs []string
-		for _, addr := range c.Interface.Addresses {
-			addrs = append(addrs, addr.String())
-		}
-		b.WriteString(fmt.Sprintf("Address = %s\n", strings.Join(addrs, ", ")))
+	if !isHexKey(c.Interface.PrivateKey) {
+		return invalidConfigf("PrivateKey is missing or not a valid key")
 	}
-	if len(c.Interface.DNS) > 0 {
-		var dns []string
-		for _, d := range c.Interface.DNS {
-			dns = append(dns, d.String())
+	if len(c.Peers) == 0 {
+		return invalidConfigf("at least one [Peer] is expected")
+	}
+	for i, peer := range c.Peers {
+		if !isHexKey(peer.PublicKey) {
+			return invalidConfigf("peer %d: PublicKey is missing or not a valid key", i+1)
 		}
-		b.WriteString(fmt.Sprintf("DNS = %s\n", strings.Join(dns, ", ")))
 	}
-	if c.Interface.MTU != 0 {
-		b.WriteString(fmt.Sprintf("MTU = %d\n", c.Interface.MTU))
+	if c.Interface.Via != "" && c.Interface.Entry == nil {
+		return invalidConfigf("entry configuration %s is not loaded", c.Interface.Via)
 	}
-
-	// [Peer] sections
-	for _, peer := range c.Peers {
-		b.WriteString("\n[Peer]\n")
-		if peer.PublicKey != "" {
-
-			pubKeyB64, err := EncodeHexToBase64(peer.PublicKey)
-			if err != nil {
-				return "", err
-			}
-			b.WriteString(fmt.Sprintf("PublicKey = %s\n", pubKeyB64))
-		}
-		if peer.PreSharedKey != "" && peer.PreSharedKey != "0000000000000000000000000000000000000000000000000000000000000000" {
-			pskB64, err := EncodeHexToBase64(peer.PreSharedKey)
-			if err != nil {
-				return "", err
-			}
-			b.WriteString(fmt.Sprintf("PresharedKey = %s\n", pskB64))
-		}
-		if len(peer.AllowedIPs) > 0 {
-			var ips []string
-			for _, ip := range peer.AllowedIPs {
-				ips = append(ips, ip.String())
-			}
-			b.WriteString(fmt.Sprintf("AllowedIPs = %s\n", strings.Join(ips, ", ")))
+	if c.Interface.Entry != nil {
+		if c.Interface.Transport != nil {
+			return invalidConfigf("Via and Transport cannot be used together")
 		}
-		if peer.Endpoint != "" {
-			b.WriteString(fmt.Sprintf("Endpoint = %s\n", peer.Endpoint))
-		}
-		if peer.KeepAlive != 0 {
-			b.WriteString(fmt.Sprintf("PersistentKeepalive = %d\n", peer.KeepAlive))
+		if err := c.Interface.Entry.validate(); err != nil {
+			return fmt.Errorf("entry %s: %w", c.Interface.Via, err)
 		}
 	}
+	return nil
+}
 
-	return b.String(), nil
+// isHexKey reports whether key is a hex-encoded 32-byte WireGuard key.
+func isHexKey(key string) bool {
+	b, err := hex.DecodeString(key)
+	return err == nil && len(b) == 32
 }
 
 // ParseInterface parses the [Interface] section
@@ -105,9 +140,9 @@ func ParseInterface(cfg *ini.File) (InterfaceConfig, error) {
 	}
 	iface := interfaces[0]
 
-	key := iface.Key("Address")
-	if key == nil {
-		return InterfaceConfig{}, nil
+	key, err := iface.GetKey("Address")
+	if err != nil {
+		return InterfaceConfig{}, errors.New("Address should not be empty")
 	}
 
 	var addresses []netip.Prefix
@@ -129,24 +164,26 @@ func ParseInterface(cfg *ini.File) (InterfaceConfig, error) {
 	}
 	device.Addresses = addresses
 
-	key = iface.Key("PrivateKey")
-	if key == nil {
+	key, err = iface.GetKey("PrivateKey")
+	if err != nil {
 		return InterfaceConfig{}, errors.New("PrivateKey should not be empty")
 	}
 
-	privateKeyHex, err := EncodeBase64ToHex(key.String())
+	privateKeyHex, err := resolveKey(key.String())
 	if err != nil {
-		return InterfaceConfig{}, err
+		return InterfaceConfig{}, fmt.Errorf("invalid PrivateKey: %w", err)
 	}
 	device.PrivateKey = privateKeyHex
+	device.PrivateKeyRef = secretRef(key.String())
 
 	if sectionKey, err := iface.GetKey("DNS"); err == nil {
 		addrs := sectionKey.StringsWithShadows(",")
 		device.DNS = make([]netip.Addr, len(addrs))
 		for i, addr := range addrs {
+			addr = strings.TrimSpace(addr)
 			ip, err := netip.ParseAddr(addr)
 			if err != nil {
-				return InterfaceConfig{}, err
+				return InterfaceConfig{}, fmt.Errorf("DNS %q is not a valid IP address: %w", addr, err)
 			}
 			device.DNS[i] = ip
 		}
@@ -155,7 +192,7 @@ func ParseInterface(cfg *ini.File) (InterfaceConfig, error) {
 	if sectionKey, err := iface.GetKey("MTU"); err == nil {
 		value, err := sectionKey.Int()
 		if err != nil {
-			return InterfaceConfig{}, err
+			return InterfaceConfig{}, fmt.Errorf("invalid MTU: %w", err)
 		}
 		device.MTU = value
 	}
@@ -163,11 +200,58 @@ func ParseInterface(cfg *ini.File) (InterfaceConfig, error) {
 	if sectionKey, err := iface.GetKey("FwMark"); err == nil {
 		value, err := sectionKey.Int()
 		if err != nil {
-			return InterfaceConfig{}, err
+			return InterfaceConfig{}, fmt.Errorf("invalid FwMark: %w", err)
 		}
 		device.FwMark = uint32(value)
 	}
 
+	if sectionKey, err := iface.GetKey("ListenPort"); err == nil {
+		value, err := strconv.ParseUint(strings.TrimSpace(sectionKey.String()), 10, 16)
+		if err != nil {
+			return InterfaceConfig{}, fmt.Errorf("invalid ListenPort: %w", err)
+		}
+		device.ListenPort = uint16(value)
+	}
+
+	if sectionKey, err := iface.GetKey("BindAddress"); err == nil {
+		addr, err := netip.ParseAddr(strings.TrimSpace(sectionKey.String()))
+		if err != nil {
+			return InterfaceConfig{}, fmt.Errorf("invalid BindAddress: %w", err)
+		}
+		device.BindAddress = addr
+	}
+
+	if sectionKey, err := iface.GetKey("BindInterface"); err == nil {
+		device.BindInterface = strings.TrimSpace(sectionKey.String())
+	}
+
+	for name, value := range device.amneziaInts() {
+		if sectionKey, err := iface.GetKey(name); err == nil {
+			if *value, err = strconv.Atoi(strings.TrimSpace(sectionKey.String())); err != nil || *value < 0 {
+				return InterfaceConfig{}, fmt.Errorf("invalid %s: %q", name, sectionKey.String())
+			}
+		}
+	}
+	for name, value := range device.amneziaHeaders() {
+		if sectionKey, err := iface.GetKey(name); err == nil {
+			h, err := strconv.ParseUint(strings.TrimSpace(sectionKey.String()), 10, 32)
+			if err != nil {
+				return InterfaceConfig{}, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*value = uint32(h)
+		}
+	}
+
+	if sectionKey, err := iface.GetKey("Transport"); err == nil {
+		if device.Transport, err = ParseTransport(sectionKey.String()); err != nil {
+			return InterfaceConfig{}, err
+		}
+	}
+
+	if sectionKey, err := iface.GetKey("Via"); err == nil {
+		device.Via = strings.TrimSpace(sectionKey.String())
+	}
+
 	return device, nil
 }
 
@@ -181,30 +265,39 @@ func ParsePeers(cfg *ini.File) ([]PeerConfig, error) {
 	peers := make([]PeerConfig, len(sections))
 	for i, section := range sections {
 		peer := PeerConfig{
-			PreSharedKey: "0000000000000000000000000000000000000000000000000000000000000000",
+			PreSharedKey: zeroKey,
 			KeepAlive:    0,
 		}
 
-		if sectionKey, err := section.GetKey("PublicKey"); err == nil {
-			value, err := EncodeBase64ToHex(sectionKey.String())
-			if err != nil {
-				return nil, err
-			}
-			peer.PublicKey = value
+		sectionKey, err := section.GetKey("PublicKey")
+		if err != nil {
+			return nil, fmt.Errorf("peer %d: PublicKey should not be empty", i+1)
+		}
+		value, err := EncodeBase64ToHex(strings.TrimSpace(sectionKey.String()))
+		if err != nil {
+			return nil, fmt.Errorf("peer %d: invalid PublicKey: %w", i+1, err)
 		}
+		peer.PublicKey = value
 
 		if sectionKey, err := section.GetKey("PreSharedKey"); err == nil {
-			value, err := EncodeBase64ToHex(sectionKey.String())
+			value, err := resolveKey(sectionKey.String())
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("peer %d: invalid PresharedKey: %w", i+1, err)
 			}
 			peer.PreSharedKey = value
+			peer.PreSharedKeyRef = secretRef(sectionKey.String())
+		}
+
+		if sectionKey, err := section.GetKey("Transport"); err == nil {
+			if peer.Transport, err = parsePeerTransport(sectionKey.String()); err != nil {
+				return nil, fmt.Errorf("peer %d: %w", i+1, err)
+			}
 		}
 
 		if sectionKey, err := section.GetKey("PersistentKeepalive"); err == nil {
 			value, err := sectionKey.Int()
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("peer %d: invalid PersistentKeepalive: %w", i+1, err)
 			}
 			peer.KeepAlive = value
 		}
@@ -212,9 +305,10 @@ func ParsePeers(cfg *ini.File) ([]PeerConfig, error) {
 		if sectionKey, err := section.GetKey("AllowedIPs"); err == nil {
 			var ips []netip.Prefix
 			for _, str := range sectionKey.StringsWithShadows(",") {
+				str = strings.TrimSpace(str)
 				prefix, err := netip.ParsePrefix(str)
 				if err != nil {
-					return nil, err
+					return nil, fmt.Errorf("peer %d: AllowedIPs %q is not a valid CIDR prefix: %w", i+1, str, err)
 				}
 				ips = append(ips, prefix)
 			}
@@ -231,28 +325,394 @@ func ParsePeers(cfg *ini.File) ([]PeerConfig, error) {
 	return peers, nil
 }
 
-// ParseConfig takes the path of a configuration file and parses it into Configuration
+// ParseProxyOptions parses the optional [Proxy], [Socks5], [HTTP], [Forward]
+// and [Chain] sections. These sections are specific to wiresocks and ignored
+// by wg-quick. [Socks5] and [HTTP] name the proxy listeners of the tunnel
+// described by the rest of the file; each may be repeated, and each describes
+// listeners on one or more BindAddress values sharing the optional Username,
+// Password and Allow settings. Each [Forward] forwards Listen to Target, each
+// [Chain] lists the upstream proxies of a chain called Name, and [Proxy]
+// holds the routing rules and the Resolver for endpoint hostnames.
+func ParseProxyOptions(cfg *ini.File) (*ProxyOptions, error) {
+	socks, err := parseListenerSections(cfg, "Socks5")
+	if err != nil {
+		return nil, err
+	}
+	httpListeners, err := parseListenerSections(cfg, "HTTP")
+	if err != nil {
+		return nil, err
+	}
+	forwards, err := parseForwardSections(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	chains, err := parseChainSections(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &ProxyOptions{Socks: socks, HTTP: httpListeners, Forward: forwards, Chains: chains}
+	sections, err := cfg.SectionsByName("Proxy")
+	if err == nil {
+		if len(sections) > 1 {
+			return nil, errors.New("only one [Proxy] is expected")
+		}
+		if err := parseProxySection(sections[0], opts); err != nil {
+			return nil, err
+		}
+	} else if socks == nil && httpListeners == nil && forwards == nil && chains == nil {
+		return nil, nil
+	}
+	if err := checkChains(opts.Chains, opts.Routes, opts.DefaultRoute); err != nil {
+		return nil, fmt.Errorf("[Chain] %w", err)
+	}
+	return opts, nil
+}
+
+// parseProxySection parses the settings of the [Proxy] section into opts.
+func parseProxySection(section *ini.Section, opts *ProxyOptions) error {
+	if k, err := section.GetKey("Resolver"); err == nil {
+		opts.Resolver = strings.TrimSpace(k.String())
+		if _, err := netip.ParseAddr(opts.Resolver); err != nil {
+			return fmt.Errorf("[Proxy] Resolver %q is not a valid IP address", opts.Resolver)
+		}
+	}
+	if k, err := section.GetKey("DefaultRoute"); err == nil {
+		action, err := ParseRouteAction(k.String())
+		if err != nil {
+			return fmt.Errorf("[Proxy] invalid DefaultRoute: %w", err)
+		}
+		opts.DefaultRoute = action
+	}
+	if k, err := section.GetKey("Route"); err == nil {
+		for _, value := range k.ValueWithShadows() {
+			rule, err := ParseRouteRule(value)
+			if err != nil {
+				return fmt.Errorf("[Proxy] invalid Route: %w", err)
+			}
+			opts.Routes = append(opts.Routes, rule)
+		}
+	}
+	for _, t := range []struct {
+		key string
+		d   *time.Duration
+	}{
+		{"HandshakeTimeout", &opts.Timeouts.Handshake},
+		{"DialTimeout", &opts.Timeouts.Dial},
+		{"IdleTimeout", &opts.Timeouts.Idle},
+		{"MaxLifetime", &opts.Timeouts.Lifetime},
+	} {
+		if k, err := section.GetKey(t.key); err == nil {
+			if *t.d, err = ParseTimeout(k.String()); err != nil {
+				return fmt.Errorf("[Proxy] %s: %w", t.key, err)
+			}
+		}
+	}
+	return parseFallback(section, opts)
+}
+
+// parseFallback parses the Fallback, FallbackAllow and FallbackDeny keys of
+// the [Proxy] section into opts. The lists need Fallback to be enabled.
+func parseFallback(section *ini.Section, opts *ProxyOptions) error {
+	var fb FallbackOptions
+	if k, err := section.GetKey("FallbackAllow"); err == nil {
+		fb.Allow = splitList(strings.Join(k.ValueWithShadows(), ","))
+	}
+	if k, err := section.GetKey("FallbackDeny"); err == nil {
+		fb.Deny = splitList(strings.Join(k.ValueWithShadows(), ","))
+	}
+
+	enabled := false
+	if k, err := section.GetKey("Fallback"); err == nil {
+		if enabled, err = strconv.ParseBool(strings.TrimSpace(k.String())); err != nil {
+			return fmt.Errorf("[Proxy] Fallback %q is not a boolean", k.String())
+		}
+	}
+	if !enabled {
+		if fb.Allow != nil || fb.Deny != nil {
+			return errors.New("[Proxy] FallbackAllow and FallbackDeny need Fallback = true")
+		}
+		return nil
+	}
+	if _, err := newFallback(&fb); err != nil {
+		return fmt.Errorf("[Proxy] invalid fallback list: %w", err)
+	}
+	opts.Fallback = &fb
+	return nil
+}
+
+// parseForwardSections parses every [Forward] section.
+func parseForwardSections(cfg *ini.File) ([]ForwardOptions, error) {
+	sections, err := cfg.SectionsByName("Forward")
+	if err != nil {
+		return nil, nil
+	}
+
+	forwards := []ForwardOptions{}
+	for _, section := range sections {
+		listen, err := section.GetKey("Listen")
+		if err != nil {
+			return nil, errors.New("[Forward] Listen should not be empty")
+		}
+		target, err := section.GetKey("Target")
+		if err != nil {
+			return nil, errors.New("[Forward] Target should not be empty")
+		}
+		fwd, err := ParseForwardOptions(listen.String(), target.String())
+		if err != nil {
+			return nil, fmt.Errorf("[Forward] %w", err)
+		}
+		forwards = append(forwards, fwd)
+	}
+	return forwards, nil
+}
+
+// parseChainSections parses every [Chain] section. Proxy lists the proxies
+// of the chain in order and may be repeated.
+func parseChainSections(cfg *ini.File) ([]Chain, error) {
+	sections, err := cfg.SectionsByName("Chain")
+	if err != nil {
+		return nil, nil
+	}
+
+	chains := []Chain{}
+	for _, section := range sections {
+		var chain Chain
+		if k, err := section.GetKey("Name"); err == nil {
+			chain.Name = strings.TrimSpace(k.String())
+		}
+		if chain.Name == "" {
+			return nil, errors.New("[Chain] Name should not be empty")
+		}
+		key, err := section.GetKey("Proxy")
+		if err != nil {
+			return nil, fmt.Errorf("[Chain] %s has no Proxy", chain.Name)
+		}
+		for _, value := range key.StringsWithShadows(",") {
+			p, err := ParseUpstreamProxy(value)
+			if err != nil {
+				return nil, fmt.Errorf("[Chain] %s: %w", chain.Name, err)
+			}
+			chain.Proxies = append(chain.Proxies, p)
+		}
+		chains = append(chains, chain)
+	}
+	return chains, nil
+}
+
+// parseListenerSections parses every section called name into listeners.
+// BindAddress is either addr:port or a unix: socket address.
+func parseListenerSections(cfg *ini.File, name string) ([]ListenerOptions, error) {
+	sections, err := cfg.SectionsByName(name)
+	if err != nil {
+		return nil, nil
+	}
+
+	listeners := []ListenerOptions{}
+	for _, section := range sections {
+		key, err := section.GetKey("BindAddress")
+		if err != nil {
+			return nil, fmt.Errorf("[%s] BindAddress should not be empty", name)
+		}
+
+		var shared ListenerOptions
+		if k, err := section.GetKey("Username"); err == nil {
+			shared.Username = k.String()
+		}
+		if k, err := section.GetKey("Password"); err == nil {
+			if shared.Password, err = resolveSecret(k.String()); err != nil {
+				return nil, fmt.Errorf("[%s] invalid Password: %w", name, err)
+			}
+			shared.PasswordRef = secretRef(k.String())
+		}
+		if (shared.Username == "") != (shared.Password == "") {
+			return nil, fmt.Errorf("[%s] Username and Password must be given together", name)
+		}
+		if k, err := section.GetKey("Allow"); err == nil {
+			for _, str := range k.StringsWithShadows(",") {
+				prefix, err := parsePrefix(strings.TrimSpace(str))
+				if err != nil {
+					return nil, fmt.Errorf("[%s] invalid Allow %q: %w", name, str, err)
+				}
+				shared.Allow = append(shared.Allow, prefix)
+			}
+		}
+
+		for _, value := range key.StringsWithShadows(",") {
+			listener := shared
+			value = strings.TrimSpace(value)
+			if IsUnixSocketAddress(value) {
+				listener.Unix, err = ParseUnixSocket(value)
+				if err != nil {
+					return nil, fmt.Errorf("[%s] invalid BindAddress: %w", name, err)
+				}
+			} else {
+				addr, err := netip.ParseAddrPort(value)
+				if err != nil {
+					return nil, fmt.Errorf("[%s] invalid BindAddress: %w", name, err)
+				}
+				listener.Address = &addr
+			}
+			listeners = append(listeners, listener)
+		}
+	}
+	return listeners, nil
+}
+
+// ParseConfig takes the path of a configuration file and parses it into
+// Configuration. Besides wg-quick INI files, the file may hold a single
+// configuration link understood by ParseURI, and path may be such a link
+// itself.
 func ParseConfig(path string) (*Configuration, error) {
+	return parseConfigFile(path, 0)
+}
+
+// maxHops bounds the chain of entry tunnels named by Via, which also stops
+// configurations that name each other.
+const maxHops = 4
+
+// parseConfigFile parses the configuration at path, hops entry tunnels deep,
+// and loads its entry tunnel.
+func parseConfigFile(path string, hops int) (*Configuration, error) {
+	if IsConfigURI(path) {
+		return ParseURI(path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := parseConfigData(path, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.loadEntry(filepath.Dir(path), hops); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// loadEntry loads the entry tunnel named by Via, relative to dir.
+func (c *Configuration) loadEntry(dir string, hops int) error {
+	via := c.Interface.Via
+	if via == "" {
+		return nil
+	}
+	if hops >= maxHops {
+		return invalidConfigf("more than %d nested tunnels, Via may loop", maxHops)
+	}
+	path := via
+	if !IsConfigURI(path) && !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	entry, err := parseConfigFile(path, hops+1)
+	if err != nil {
+		return fmt.Errorf("entry %s: %w", via, err)
+	}
+	c.Interface.Entry = entry
+	return nil
+}
+
+// ParseConfigData parses a configuration held in memory: in the wg-quick INI
+// format, as YAML or JSON, or as a single link understood by ParseURI. An
+// entry tunnel named by Via is looked up relative to the working directory.
+func ParseConfigData(data []byte) (*Configuration, error) {
+	conf, err := parseConfigData("", data)
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.loadEntry(".", 0); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func parseConfigData(path string, data []byte) (*Configuration, error) {
+	if uri := strings.TrimSpace(string(data)); IsConfigURI(uri) {
+		return ParseURI(uri)
+	}
+	if format := configFormat(path, data); format != "ini" {
+		return parseStructured(format, data)
+	}
+	return parseINI(data)
+}
+
+func parseINI(data []byte) (*Configuration, error) {
 	iniOpt := ini.LoadOptions{
 		Insensitive:            true,
 		AllowShadows:           true,
 		AllowNonUniqueSections: true,
 	}
 
-	cfg, err := ini.LoadSources(iniOpt, path)
+	cfg, err := ini.LoadSources(iniOpt, data)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
 	}
 
 	iface, err := ParseInterface(cfg)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
 	}
 
 	peers, err := ParsePeers(cfg)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	proxy, err := ParseProxyOptions(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	return &Configuration{Interface: &iface, Peers: peers, Proxy: proxy}, nil
+}
+
+// ParseConfigDir parses every *.conf, *.yaml, *.yml and *.json file in dir.
+// Each file describes one tunnel, named after the file without its extension.
+// Files that another file names with Via and that have no [Socks5] or [HTTP]
+// section are only entry tunnels, and are left out.
+func ParseConfigDir(dir string) (map[string]*Configuration, error) {
+	var paths []string
+	for _, pattern := range []string{"*.conf", "*.yaml", "*.yml", "*.json"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
 	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no *.conf, *.yaml or *.json files found in %s", dir)
+	}
+
+	confs := make(map[string]*Configuration, len(paths))
+	names := make(map[string]string, len(paths)) // by cleaned path
+	entries := make(map[string]bool)
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		if _, ok := confs[name]; ok {
+			return nil, fmt.Errorf("%s: tunnel %q is defined by more than one file", path, name)
+		}
+		conf, err := ParseConfig(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		confs[name] = conf
+		names[filepath.Clean(path)] = name
 
-	return &Configuration{Interface: &iface, Peers: peers}, nil
+		if via := conf.Interface.Via; via != "" && !IsConfigURI(via) {
+			if !filepath.IsAbs(via) {
+				via = filepath.Join(filepath.Dir(path), via)
+			}
+			entries[filepath.Clean(via)] = true
+		}
+	}
+
+	for path := range entries {
+		if name, ok := names[path]; ok && confs[name].Proxy == nil {
+			log.Debugf("Skipping %s, it is the entry tunnel of another configuration.", path)
+			delete(confs, name)
+		}
+	}
+	return confs, nil
 }
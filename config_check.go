@@ -0,0 +1,667 @@
+package wiresocks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
+)
+
+// Severity tells how serious a Diagnostic is.
+type Severity int
+
+const (
+	// SeverityWarning marks a value that is valid but likely a mistake.
+	SeverityWarning Severity = iota
+	// SeverityError marks a value wiresocks cannot run with.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Diagnostic is a problem found in a configuration file by CheckConfig.
+type Diagnostic struct {
+	File     string
+	Line     int // 0 when the problem is not tied to a line
+	Severity Severity
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	if d.Line == 0 {
+		return fmt.Sprintf("%s: %s: %s", d.File, d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", d.File, d.Line, d.Severity, d.Message)
+}
+
+// HasErrors reports whether any of diags is an error.
+func HasErrors(diags []Diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+type checkKey struct {
+	raw   string // as written in the file
+	name  string // lower case
+	value string
+	line  int
+}
+
+type checkSection struct {
+	raw  string // as written in the file
+	name string // lower case
+	line int
+	keys []checkKey
+}
+
+func (s *checkSection) get(name string) (checkKey, bool) {
+	for _, k := range s.keys {
+		if k.name == name {
+			return k, true
+		}
+	}
+	return checkKey{}, false
+}
+
+var lineRe = regexp.MustCompile(`line (\d+)`)
+
+// configChecker collects the diagnostics of one file.
+type configChecker struct {
+	file  string
+	diags []Diagnostic
+}
+
+func (c *configChecker) errorf(line int, format string, args ...any) {
+	c.diags = append(c.diags, Diagnostic{File: c.file, Line: line, Severity: SeverityError, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *configChecker) warnf(line int, format string, args ...any) {
+	c.diags = append(c.diags, Diagnostic{File: c.file, Line: line, Severity: SeverityWarning, Message: fmt.Sprintf(format, args...)})
+}
+
+// CheckConfig validates every field of the configuration file at path and
+// returns the problems found, ordered by line. Unlike ParseConfig it doesn't
+// stop at the first problem, and it also warns about suspicious values. The
+// returned error is only set when the file cannot be read.
+func CheckConfig(path string) ([]Diagnostic, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &configChecker{file: path}
+	if uri := strings.TrimSpace(string(data)); IsConfigURI(uri) {
+		// Links carry no line structure, report whether they parse.
+		if _, err := ParseURI(uri); err != nil {
+			c.errorf(1, "%v", err)
+		}
+		return c.diags, nil
+	}
+	if format := configFormat(path, data); format != "ini" {
+		// The YAML and JSON decoders report the line of syntax errors.
+		if _, err := parseStructured(format, data); err != nil {
+			line := 0
+			if m := lineRe.FindStringSubmatch(err.Error()); m != nil {
+				line, _ = strconv.Atoi(m[1])
+			}
+			c.errorf(line, "%v", err)
+		}
+		return c.diags, nil
+	}
+
+	var sections []*checkSection
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if !strings.HasSuffix(line, "]") {
+				c.errorf(n, "malformed section header %q", line)
+				continue
+			}
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			sections = append(sections, &checkSection{raw: name, name: strings.ToLower(name), line: n})
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			c.errorf(n, "expected key = value, got %q", line)
+			continue
+		}
+		if len(sections) == 0 {
+			c.errorf(n, "key %q is outside of any section", strings.TrimSpace(key))
+			continue
+		}
+		section := sections[len(sections)-1]
+		key = strings.TrimSpace(key)
+		section.keys = append(section.keys, checkKey{
+			raw:   key,
+			name:  strings.ToLower(key),
+			value: iniValue(value),
+			line:  n,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	c.check(sections)
+
+	sort.SliceStable(c.diags, func(i, j int) bool { return c.diags[i].Line < c.diags[j].Line })
+	return c.diags, nil
+}
+
+// iniValue returns the value of a key from the text after its "=", read
+// like ParseConfig does: a value in backquotes or triple double quotes is
+// taken as is, others are cut at an inline comment and lose the single or
+// double quotes around them.
+func iniValue(raw string) string {
+	value := strings.TrimSpace(raw)
+	for _, quote := range []string{`"""`, "`"} {
+		if len(value) > len(quote) && strings.HasPrefix(value, quote) {
+			inner := value[len(quote):]
+			if i := strings.LastIndex(inner, quote); i >= 0 {
+				return inner[:i]
+			}
+			return inner
+		}
+	}
+
+	if i := strings.IndexAny(value, "#;"); i >= 0 {
+		value = value[:i]
+	}
+	value = strings.TrimSpace(value)
+	for _, quote := range []byte{'\'', '"'} {
+		if len(value) >= 2 && value[0] == quote && value[len(value)-1] == quote && strings.IndexByte(value[1:], quote) == len(value)-2 {
+			return value[1 : len(value)-1]
+		}
+	}
+	return value
+}
+
+func (c *configChecker) check(sections []*checkSection) {
+	var (
+		interfaces int
+		proxies    int
+		peers      []*checkSection
+	)
+	peerCount := 0
+	chains := make(map[string]bool)
+	for _, section := range sections {
+		switch section.name {
+		case "peer":
+			peerCount++
+		case "chain":
+			if name, ok := section.get("name"); ok {
+				chains[name.value] = true
+			}
+		}
+	}
+	for _, section := range sections {
+		switch section.name {
+		case "interface":
+			interfaces++
+			if interfaces > 1 {
+				c.errorf(section.line, "only one [Interface] is expected")
+				continue
+			}
+			c.checkInterface(section, peerCount)
+		case "peer":
+			peers = append(peers, section)
+			c.checkPeer(section)
+		case "socks5", "http":
+			c.checkProxy(section)
+		case "proxy":
+			proxies++
+			if proxies > 1 {
+				c.errorf(section.line, "only one [Proxy] is expected")
+				continue
+			}
+			c.checkProxySettings(section, chains)
+		case "forward":
+			c.checkForward(section)
+		case "chain":
+			c.checkChain(section)
+		default:
+			c.warnf(section.line, "unknown section [%s]", section.raw)
+		}
+	}
+
+	if interfaces == 0 {
+		c.errorf(0, "missing [Interface] section")
+	}
+	if len(peers) == 0 {
+		c.errorf(0, "at least one [Peer] section is expected")
+	}
+	c.checkAllowedIPsOverlap(peers)
+}
+
+func (c *configChecker) checkInterface(section *checkSection, peers int) {
+	c.checkDuplicates(section, "address", "dns")
+
+	if _, ok := section.get("privatekey"); !ok {
+		c.errorf(section.line, "[Interface] is missing PrivateKey")
+	}
+	if _, ok := section.get("address"); !ok {
+		c.errorf(section.line, "[Interface] is missing Address")
+	}
+
+	for _, key := range section.keys {
+		switch key.name {
+		case "privatekey":
+			c.checkKey(key, "PrivateKey")
+		case "address":
+			for _, str := range splitList(key.value) {
+				if _, err := parsePrefix(str); err != nil {
+					c.errorf(key.line, "Address %q is not a valid IP address or CIDR prefix", str)
+				}
+			}
+		case "dns":
+			for _, str := range splitList(key.value) {
+				if _, err := netip.ParseAddr(str); err != nil {
+					c.errorf(key.line, "DNS %q is not a valid IP address", str)
+				}
+			}
+		case "mtu":
+			mtu, err := strconv.Atoi(key.value)
+			if err != nil {
+				c.errorf(key.line, "MTU %q is not a number", key.value)
+			} else if mtu < 576 || mtu > 65535 {
+				c.errorf(key.line, "MTU %d is out of range", mtu)
+			} else if mtu < 1280 || mtu > 1500 {
+				c.warnf(key.line, "MTU %d is unusual, WireGuard tunnels normally use 1280 to 1420", mtu)
+			}
+		case "fwmark":
+			if _, err := strconv.ParseUint(key.value, 0, 32); err != nil {
+				c.errorf(key.line, "FwMark %q is not a valid mark", key.value)
+			}
+		case "listenport":
+			if port, err := strconv.ParseUint(key.value, 10, 16); err != nil {
+				c.errorf(key.line, "ListenPort %q is not a valid port", key.value)
+			} else if port != 0 && port < 1024 {
+				c.warnf(key.line, "ListenPort %d is privileged and may need extra permissions", port)
+			}
+		case "bindaddress":
+			if _, err := netip.ParseAddr(key.value); err != nil {
+				c.errorf(key.line, "BindAddress %q is not a valid IP address", key.value)
+			}
+		case "jc", "jmin", "jmax", "s1", "s2":
+			if n, err := strconv.Atoi(key.value); err != nil || n < 0 {
+				c.errorf(key.line, "%s %q is not a valid count", key.raw, key.value)
+			}
+		case "h1", "h2", "h3", "h4":
+			if _, err := strconv.ParseUint(key.value, 10, 32); err != nil {
+				c.errorf(key.line, "%s %q is not a valid header", key.raw, key.value)
+			}
+		case "transport":
+			if t, err := ParseTransport(key.value); err != nil {
+				c.errorf(key.line, "%v", err)
+			} else if t != nil && t.isStream() && peers > 1 {
+				c.warnf(key.line, "Transport sends the datagrams of every peer to the same relay")
+			}
+		case "bindinterface":
+			if key.value == "" {
+				c.errorf(key.line, "BindInterface should not be empty")
+			}
+		case "via":
+			if _, ok := section.get("transport"); ok {
+				c.errorf(key.line, "Via cannot be combined with Transport")
+			}
+			path := key.value
+			if IsConfigURI(path) {
+				if _, err := ParseURI(path); err != nil {
+					c.errorf(key.line, "Via: %v", err)
+				}
+			} else {
+				if !filepath.IsAbs(path) {
+					path = filepath.Join(filepath.Dir(c.file), path)
+				}
+				if _, err := os.Stat(path); err != nil {
+					c.errorf(key.line, "Via %q cannot be read: %v", key.value, err)
+				}
+			}
+		case "table", "preup", "postup", "predown", "postdown", "saveconfig":
+			c.warnf(key.line, "%s is not used by wiresocks and is ignored", key.raw)
+		default:
+			c.warnf(key.line, "unknown key %q in [Interface]", key.raw)
+		}
+	}
+}
+
+func (c *configChecker) checkPeer(section *checkSection) {
+	c.checkDuplicates(section, "allowedips")
+
+	if _, ok := section.get("publickey"); !ok {
+		c.errorf(section.line, "[Peer] is missing PublicKey")
+	}
+	if _, ok := section.get("endpoint"); !ok {
+		c.warnf(section.line, "[Peer] has no Endpoint, wiresocks cannot initiate a handshake with it")
+	}
+	if _, ok := section.get("allowedips"); !ok {
+		c.warnf(section.line, "[Peer] has no AllowedIPs, no traffic will be routed to it")
+	}
+
+	for _, key := range section.keys {
+		switch key.name {
+		case "publickey":
+			c.checkKey(key, "PublicKey")
+		case "presharedkey":
+			c.checkKey(key, "PresharedKey")
+		case "transport":
+			if _, err := parsePeerTransport(key.value); err != nil {
+				c.errorf(key.line, "%v", err)
+			}
+		case "allowedips":
+			for _, str := range splitList(key.value) {
+				if _, err := netip.ParsePrefix(str); err != nil {
+					c.errorf(key.line, "AllowedIPs %q is not a valid CIDR prefix", str)
+				}
+			}
+		case "endpoint":
+			host, port, err := net.SplitHostPort(key.value)
+			if err != nil || host == "" {
+				c.errorf(key.line, "Endpoint %q is not a valid host:port", key.value)
+				continue
+			}
+			c.checkPort(checkKey{value: port, line: key.line}, "Endpoint port")
+		case "persistentkeepalive":
+			n, err := strconv.Atoi(key.value)
+			if err != nil || n < 0 || n > 65535 {
+				c.errorf(key.line, "PersistentKeepalive %q is not a valid interval", key.value)
+			}
+		default:
+			c.warnf(key.line, "unknown key %q in [Peer]", key.raw)
+		}
+	}
+}
+
+func (c *configChecker) checkProxy(section *checkSection) {
+	if _, ok := section.get("bindaddress"); !ok {
+		c.errorf(section.line, "[%s] is missing BindAddress", section.raw)
+	}
+	_, user := section.get("username")
+	_, pass := section.get("password")
+	if user != pass {
+		c.errorf(section.line, "[%s] needs both Username and Password", section.raw)
+	}
+
+	for _, key := range section.keys {
+		switch key.name {
+		case "bindaddress":
+			for _, str := range splitList(key.value) {
+				if IsUnixSocketAddress(str) {
+					if _, err := ParseUnixSocket(str); err != nil {
+						c.errorf(key.line, "BindAddress: %v", err)
+					}
+				} else if addr, err := netip.ParseAddrPort(str); err != nil {
+					c.errorf(key.line, "BindAddress %q is not a valid address:port", str)
+				} else if addr.Addr().IsUnspecified() && !user {
+					c.warnf(key.line, "BindAddress %s accepts clients from every network without authentication", str)
+				}
+			}
+		case "allow":
+			for _, str := range splitList(key.value) {
+				if _, err := parsePrefix(str); err != nil {
+					c.errorf(key.line, "Allow %q is not a valid IP address or CIDR prefix", str)
+				}
+			}
+		case "username", "password":
+		default:
+			c.warnf(key.line, "unknown key %q in [%s]", key.raw, section.raw)
+		}
+	}
+}
+
+func (c *configChecker) checkProxySettings(section *checkSection, chains map[string]bool) {
+	c.checkDuplicates(section, "route", "fallbackallow", "fallbackdeny")
+	for _, key := range section.keys {
+		switch key.name {
+		case "resolver":
+			if _, err := netip.ParseAddr(key.value); err != nil {
+				c.errorf(key.line, "Resolver %q is not a valid IP address", key.value)
+			}
+		case "defaultroute":
+			if action, err := ParseRouteAction(key.value); err != nil {
+				c.errorf(key.line, "DefaultRoute: %v", err)
+			} else if action == RouteChain {
+				c.errorf(key.line, "DefaultRoute cannot be a chain")
+			}
+		case "route":
+			if rule, err := ParseRouteRule(key.value); err != nil {
+				c.errorf(key.line, "Route: %v", err)
+			} else if rule.Action == RouteChain && !chains[rule.Chain] {
+				c.errorf(key.line, "Route names chain %q, which no [Chain] defines", rule.Chain)
+			}
+		case "handshaketimeout", "dialtimeout", "idletimeout", "maxlifetime":
+			if _, err := ParseTimeout(key.value); err != nil {
+				c.errorf(key.line, "%s: %v", key.raw, err)
+			}
+		case "fallback":
+			if _, err := strconv.ParseBool(key.value); err != nil {
+				c.errorf(key.line, "Fallback %q is not a boolean", key.value)
+			}
+		case "fallbackallow", "fallbackdeny":
+			if _, err := newFallback(&FallbackOptions{Allow: splitList(key.value)}); err != nil {
+				c.errorf(key.line, "%s: %v", key.raw, err)
+			}
+			enabled := false
+			if k, ok := section.get("fallback"); ok {
+				enabled, _ = strconv.ParseBool(k.value)
+			}
+			if !enabled {
+				c.errorf(key.line, "%s needs Fallback = true", key.raw)
+			}
+		default:
+			c.warnf(key.line, "unknown key %q in [%s]", key.raw, section.raw)
+		}
+	}
+}
+
+func (c *configChecker) checkForward(section *checkSection) {
+	if _, ok := section.get("listen"); !ok {
+		c.errorf(section.line, "[%s] is missing Listen", section.raw)
+	}
+	if _, ok := section.get("target"); !ok {
+		c.errorf(section.line, "[%s] is missing Target", section.raw)
+	}
+	for _, key := range section.keys {
+		switch key.name {
+		case "listen":
+			if _, err := netip.ParseAddrPort(key.value); err != nil {
+				c.errorf(key.line, "Listen %q is not a valid address:port", key.value)
+			}
+		case "target":
+			if host, port, err := net.SplitHostPort(key.value); err != nil || host == "" || port == "" {
+				c.errorf(key.line, "Target %q is not a valid host:port", key.value)
+			}
+		default:
+			c.warnf(key.line, "unknown key %q in [%s]", key.raw, section.raw)
+		}
+	}
+}
+
+func (c *configChecker) checkChain(section *checkSection) {
+	c.checkDuplicates(section, "proxy")
+	if _, ok := section.get("name"); !ok {
+		c.errorf(section.line, "[%s] is missing Name", section.raw)
+	}
+	if _, ok := section.get("proxy"); !ok {
+		c.errorf(section.line, "[%s] is missing Proxy", section.raw)
+	}
+	for _, key := range section.keys {
+		switch key.name {
+		case "name":
+			if key.value == "" {
+				c.errorf(key.line, "Name should not be empty")
+			}
+		case "proxy":
+			for _, str := range splitList(key.value) {
+				if _, err := ParseUpstreamProxy(str); err != nil {
+					c.errorf(key.line, "%v", err)
+				}
+			}
+		default:
+			c.warnf(key.line, "unknown key %q in [%s]", key.raw, section.raw)
+		}
+	}
+}
+
+// checkKey checks that key holds a base64-encoded 32-byte WireGuard key.
+func (c *configChecker) checkKey(key checkKey, name string) {
+	value, err := resolveSecret(key.value)
+	if err != nil {
+		c.errorf(key.line, "%s: %v", name, err)
+		return
+	}
+	if _, err := EncodeBase64ToHex(value); err != nil {
+		c.errorf(key.line, "%s is not a valid base64-encoded 32-byte key", name)
+	}
+}
+
+func (c *configChecker) checkPort(key checkKey, name string) {
+	port, err := strconv.Atoi(key.value)
+	if err != nil || port < 0 || port > 65535 {
+		c.errorf(key.line, "%s %q is not a valid port", name, key.value)
+	}
+}
+
+// checkDuplicates warns about keys given more than once in section, except
+// for the list keys in repeatable.
+func (c *configChecker) checkDuplicates(section *checkSection, repeatable ...string) {
+	seen := make(map[string]bool)
+	for _, key := range section.keys {
+		if seen[key.name] && !contains(repeatable, key.name) {
+			c.warnf(key.line, "%s is set more than once, only the last value is used", key.raw)
+		}
+		seen[key.name] = true
+	}
+}
+
+// checkAllowedIPsOverlap warns about AllowedIPs that overlap between peers,
+// since traffic for the overlapping range only goes to one of them.
+func (c *configChecker) checkAllowedIPsOverlap(peers []*checkSection) {
+	type owned struct {
+		prefix netip.Prefix
+		peer   int
+	}
+	var seen []owned
+	for i, section := range peers {
+		for _, key := range section.keys {
+			if key.name != "allowedips" {
+				continue
+			}
+			for _, str := range splitList(key.value) {
+				prefix, err := netip.ParsePrefix(str)
+				if err != nil {
+					continue
+				}
+				prefix = prefix.Masked()
+				for _, o := range seen {
+					if o.peer != i && o.prefix.Overlaps(prefix) {
+						c.warnf(key.line, "AllowedIPs %s overlaps %s of peer %d", prefix, o.prefix, o.peer+1)
+					}
+				}
+				seen = append(seen, owned{prefix: prefix, peer: i})
+			}
+		}
+	}
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, str := range strings.Split(value, ",") {
+		if str = strings.TrimSpace(str); str != "" {
+			list = append(list, str)
+		}
+	}
+	return list
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckHandshake brings up a WireGuard device for conf and waits up to
+// timeout for a handshake with its peers, without running any proxy. The
+// device uses the settings wiresocks runs with, so a configuration without
+// PersistentKeepalive or MTU behaves as it would under run. The entry tunnel
+// of conf, if any, is brought up and checked first. The devices are closed
+// before returning.
+func CheckHandshake(ctx context.Context, conf *Configuration, dnsServer string, timeout time.Duration) error {
+	if err := conf.validate(); err != nil {
+		return err
+	}
+	_, closeFn, err := checkHandshake(ctx, conf.Effective(), dnsServer, timeout)
+	if err != nil {
+		return err
+	}
+	closeFn()
+	return nil
+}
+
+// checkHandshake is CheckHandshake for a validated conf with the run
+// defaults applied. It returns the netstack of the device, for the tunnels
+// nested in it, and a function closing the device and its entry tunnels.
+func checkHandshake(ctx context.Context, conf *Configuration, dnsServer string, timeout time.Duration) (*netstack.Net, func(), error) {
+	resolved := newEndpointResolver(dnsServer, true).resolve(ctx, conf)
+
+	bind := newBind(resolved)
+	closeEntry := func() {}
+	if conf.Interface.Entry != nil {
+		entryNet, closeFn, err := checkHandshake(ctx, conf.Interface.Entry, dnsServer, timeout)
+		if err != nil {
+			return nil, nil, fmt.Errorf("entry tunnel %s: %w", conf.Interface.Via, err)
+		}
+		bind = newNetstackBind(entryNet, conf.Interface.Entry)
+		closeEntry = closeFn
+	}
+
+	var addrs []netip.Addr
+	for _, prefix := range resolved.Interface.Addresses {
+		addrs = append(addrs, prefix.Addr())
+	}
+	tunDev, tnet, err := netstack.CreateNetTUN(addrs, resolved.Interface.DNS, resolved.Interface.MTU)
+	if err != nil {
+		closeEntry()
+		return nil, nil, err
+	}
+
+	dev, err := establishWireguard(ctx, resolved, tunDev, bind, resolved.Interface.FwMark, timeout)
+	if err != nil {
+		closeEntry()
+		return nil, nil, err
+	}
+	return tnet, func() {
+		dev.Close()
+		closeEntry()
+	}, nil
+}
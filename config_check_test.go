@@ -0,0 +1,189 @@
+package wiresocks
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/conn"
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
+)
+
+func TestCheckConfig(t *testing.T) {
+	const config = `# Test configuration
+[Interface]
+PrivateKey = dGhpcyBpcyBhIHRlc3QgcHJpdmF0ZSBleS4uLi4uLi4=
+Address = 10.10.0.1, nope
+MTU = 9000
+
+[Peer]
+PublicKey = dGhpcyBpcyBhIHRlc3QgcHVibGljIGtleS4uLi4uLi4=
+AllowedIPs = 0.0.0.0/0 ; everything
+
+[Peer]
+AllowedIPs = 10.0.0.0/8
+Endpoint = 1.2.3.4:51820
+`
+	path := filepath.Join(t.TempDir(), "wg.conf")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	diags, err := CheckConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Diagnostic{
+		{Line: 4, Severity: SeverityError},    // invalid Address
+		{Line: 5, Severity: SeverityWarning},  // unusual MTU
+		{Line: 7, Severity: SeverityWarning},  // no Endpoint
+		{Line: 11, Severity: SeverityError},   // missing PublicKey
+		{Line: 12, Severity: SeverityWarning}, // overlapping AllowedIPs
+	}
+	if len(diags) != len(want) {
+		t.Fatalf("got %d diagnostics, want %d: %v", len(diags), len(want), diags)
+	}
+	for i, d := range diags {
+		if d.File != path || d.Line != want[i].Line || d.Severity != want[i].Severity {
+			t.Errorf("diagnostic %d = %v, want line %d %v", i, d, want[i].Line, want[i].Severity)
+		}
+	}
+	if !HasErrors(diags) {
+		t.Error("HasErrors should report the errors")
+	}
+}
+
+// TestCheckExportedConfig checks that the values export quotes read back
+// whole.
+func TestCheckExportedConfig(t *testing.T) {
+	const tmpl = `[Interface]
+PrivateKey = dGhpcyBpcyBhIHRlc3QgcHJpdmF0ZSBleS4uLi4uLi4=
+Address = 10.10.0.1/32
+%s
+
+[Peer]
+PublicKey = dGhpcyBpcyBhIHRlc3QgcHVibGljIGtleS4uLi4uLi4=
+AllowedIPs = 0.0.0.0/0
+Endpoint = 1.2.3.4:51820
+`
+	dir := t.TempDir()
+	write := func(name, extra string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(tmpl, extra)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("entry#1.conf", "")
+	conf, err := ParseConfig(write("exit.conf", "Via = `entry#1.conf` ; quoted\n\n[Socks5]\nBindAddress = 127.0.0.1:1080\nUsername = user\nPassword = `p;ss`"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Proxy.Socks[0].Password != "p;ss" {
+		t.Fatalf("password read as %q", conf.Proxy.Socks[0].Password)
+	}
+
+	text, err := conf.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "exported.conf")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	diags, err := CheckConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diags) != 0 {
+		t.Fatalf("exported configuration has diagnostics %v:\n%s", diags, text)
+	}
+}
+
+// TestCheckHandshakeDefaults checks that a configuration without
+// PersistentKeepalive or MTU completes a handshake, as it does under run.
+func TestCheckHandshakeDefaults(t *testing.T) {
+	conf, _ := testClientConfig(t)
+	if err := CheckHandshake(context.Background(), conf, "1.1.1.1", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testClientConfig returns the configuration of a client of a WireGuard peer
+// listening on the loopback, with neither PersistentKeepalive nor MTU set.
+// The client is 10.10.0.1 and the peer 10.10.0.2, whose netstack is returned
+// as well.
+func testClientConfig(t *testing.T) (*Configuration, *netstack.Net) {
+	t.Helper()
+	clientKey, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPub, err := PublicKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerPub, endpoint, peerNet := wireguardPeer(t, clientPub)
+	return &Configuration{
+		Interface: &InterfaceConfig{
+			PrivateKey: clientKey,
+			Addresses:  []netip.Prefix{netip.MustParsePrefix("10.10.0.1/32")},
+		},
+		Peers: []PeerConfig{{
+			PublicKey:    peerPub,
+			PreSharedKey: zeroKey,
+			Endpoint:     endpoint,
+			AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("10.10.0.2/32")},
+		}},
+	}, peerNet
+}
+
+// wireguardPeer runs a WireGuard peer at 10.10.0.2 on the loopback that
+// accepts the client with the public key clientPub as 10.10.0.1. It returns
+// the public key and endpoint of the peer, and its netstack.
+func wireguardPeer(t *testing.T, clientPub string) (string, string, *netstack.Net) {
+	t.Helper()
+	key, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := PublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunDev, tnet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.10.0.2")}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(dev.Close)
+	config := fmt.Sprintf("private_key=%s\npublic_key=%s\nallowed_ip=10.10.0.1/32\n", key, clientPub)
+	if err := dev.IpcSet(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	get, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(get))
+	for scanner.Scan() {
+		if port, ok := strings.CutPrefix(scanner.Text(), "listen_port="); ok {
+			return pub, "127.0.0.1:" + port, tnet
+		}
+	}
+	t.Fatal("the peer has no listen port")
+	return "", "", nil
+}
@@ -0,0 +1,397 @@
+package wiresocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the wiresocks configuration schema of YAML and JSON files.
+// It holds the same settings as a wg-quick file with the [Proxy], [Socks5],
+// [HTTP], [Forward] and [Chain] sections.
+type fileConfig struct {
+	Interface fileInterface  `json:"interface" yaml:"interface"`
+	Peers     []filePeer     `json:"peers" yaml:"peers"`
+	Socks     []fileListener `json:"socks,omitempty" yaml:"socks,omitempty"`
+	HTTP      []fileListener `json:"http,omitempty" yaml:"http,omitempty"`
+	Forward   []fileForward  `json:"forward,omitempty" yaml:"forward,omitempty"`
+	Routing   *fileRouting   `json:"routing,omitempty" yaml:"routing,omitempty"`
+	Chains    []fileChain    `json:"chains,omitempty" yaml:"chains,omitempty"`
+	Fallback  *fileFallback  `json:"fallback,omitempty" yaml:"fallback,omitempty"`
+	Timeouts  *fileTimeouts  `json:"timeouts,omitempty" yaml:"timeouts,omitempty"`
+	Resolver  string         `json:"resolver,omitempty" yaml:"resolver,omitempty"`
+}
+
+type fileInterface struct {
+	PrivateKey    string   `json:"private_key,omitempty" yaml:"private_key,omitempty"`
+	Address       []string `json:"address,omitempty" yaml:"address,omitempty"`
+	DNS           []string `json:"dns,omitempty" yaml:"dns,omitempty"`
+	MTU           int      `json:"mtu,omitempty" yaml:"mtu,omitempty"`
+	FwMark        uint32   `json:"fwmark,omitempty" yaml:"fwmark,omitempty"`
+	ListenPort    uint16   `json:"listen_port,omitempty" yaml:"listen_port,omitempty"`
+	BindAddress   string   `json:"bind_address,omitempty" yaml:"bind_address,omitempty"`
+	BindInterface string   `json:"bind_interface,omitempty" yaml:"bind_interface,omitempty"`
+	Jc            int      `json:"jc,omitempty" yaml:"jc,omitempty"`
+	Jmin          int      `json:"jmin,omitempty" yaml:"jmin,omitempty"`
+	Jmax          int      `json:"jmax,omitempty" yaml:"jmax,omitempty"`
+	S1            int      `json:"s1,omitempty" yaml:"s1,omitempty"`
+	S2            int      `json:"s2,omitempty" yaml:"s2,omitempty"`
+	H1            uint32   `json:"h1,omitempty" yaml:"h1,omitempty"`
+	H2            uint32   `json:"h2,omitempty" yaml:"h2,omitempty"`
+	H3            uint32   `json:"h3,omitempty" yaml:"h3,omitempty"`
+	H4            uint32   `json:"h4,omitempty" yaml:"h4,omitempty"`
+	Transport     string   `json:"transport,omitempty" yaml:"transport,omitempty"`
+	Via           string   `json:"via,omitempty" yaml:"via,omitempty"`
+}
+
+type filePeer struct {
+	PublicKey           string   `json:"public_key" yaml:"public_key"`
+	PresharedKey        string   `json:"preshared_key,omitempty" yaml:"preshared_key,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips,omitempty" yaml:"allowed_ips,omitempty"`
+	Endpoint            string   `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty" yaml:"persistent_keepalive,omitempty"`
+	Transport           string   `json:"transport,omitempty" yaml:"transport,omitempty"`
+}
+
+type fileListener struct {
+	BindAddress string   `json:"bind_address" yaml:"bind_address"`
+	Username    string   `json:"username,omitempty" yaml:"username,omitempty"`
+	Password    string   `json:"password,omitempty" yaml:"password,omitempty"`
+	Allow       []string `json:"allow,omitempty" yaml:"allow,omitempty"`
+}
+
+type fileForward struct {
+	Listen string `json:"listen" yaml:"listen"`
+	Target string `json:"target" yaml:"target"`
+}
+
+type fileRouting struct {
+	Default string     `json:"default,omitempty" yaml:"default,omitempty"`
+	Rules   []fileRule `json:"rules,omitempty" yaml:"rules,omitempty"`
+}
+
+type fileRule struct {
+	Action string   `json:"action" yaml:"action"`
+	Chain  string   `json:"chain,omitempty" yaml:"chain,omitempty"`
+	Match  []string `json:"match" yaml:"match"`
+}
+
+// fileFallback enables the direct fallback when present.
+type fileFallback struct {
+	Allow []string `json:"allow,omitempty" yaml:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty" yaml:"deny,omitempty"`
+}
+
+// fileTimeouts holds durations such as "90s", or "off".
+type fileTimeouts struct {
+	Handshake string `json:"handshake,omitempty" yaml:"handshake,omitempty"`
+	Dial      string `json:"dial,omitempty" yaml:"dial,omitempty"`
+	Idle      string `json:"idle,omitempty" yaml:"idle,omitempty"`
+	Lifetime  string `json:"lifetime,omitempty" yaml:"lifetime,omitempty"`
+}
+
+type fileChain struct {
+	Name    string   `json:"name" yaml:"name"`
+	Proxies []string `json:"proxies" yaml:"proxies"`
+}
+
+// configFormat returns the format of a configuration file: "json" or "yaml"
+// by the extension of path, or else by the first significant line of data.
+// wg-quick files are "ini".
+func configFormat(path string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".conf", ".ini":
+		return "ini"
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		switch {
+		case line[0] == '{':
+			return "json"
+		case line[0] == '[':
+			return "ini"
+		default:
+			return "yaml"
+		}
+	}
+	return "ini"
+}
+
+// parseStructured parses a YAML or JSON configuration. Unknown fields are
+// rejected so that typos don't go unnoticed.
+func parseStructured(format string, data []byte) (*Configuration, error) {
+	var fc fileConfig
+	switch format {
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&fc); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+		}
+	default:
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&fc); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+		}
+	}
+
+	conf, err := fc.configuration()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	return conf, nil
+}
+
+// configuration converts fc, checking every value like the INI parser does.
+func (fc *fileConfig) configuration() (*Configuration, error) {
+	iface := &InterfaceConfig{
+		MTU:           fc.Interface.MTU,
+		FwMark:        fc.Interface.FwMark,
+		ListenPort:    fc.Interface.ListenPort,
+		BindInterface: strings.TrimSpace(fc.Interface.BindInterface),
+		Jc:            fc.Interface.Jc,
+		Jmin:          fc.Interface.Jmin,
+		Jmax:          fc.Interface.Jmax,
+		S1:            fc.Interface.S1,
+		S2:            fc.Interface.S2,
+		H1:            fc.Interface.H1,
+		H2:            fc.Interface.H2,
+		H3:            fc.Interface.H3,
+		H4:            fc.Interface.H4,
+		Via:           strings.TrimSpace(fc.Interface.Via),
+	}
+	for name, value := range iface.amneziaInts() {
+		if *value < 0 {
+			return nil, fmt.Errorf("invalid %s: %d", strings.ToLower(name), *value)
+		}
+	}
+	if fc.Interface.PrivateKey == "" {
+		return nil, errors.New("PrivateKey should not be empty")
+	}
+	key, err := resolveKey(fc.Interface.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PrivateKey: %w", err)
+	}
+	iface.PrivateKey = key
+	iface.PrivateKeyRef = secretRef(fc.Interface.PrivateKey)
+	if iface.Transport, err = ParseTransport(fc.Interface.Transport); err != nil {
+		return nil, err
+	}
+	if fc.Interface.BindAddress != "" {
+		if iface.BindAddress, err = netip.ParseAddr(strings.TrimSpace(fc.Interface.BindAddress)); err != nil {
+			return nil, fmt.Errorf("invalid bind_address: %w", err)
+		}
+	}
+	if len(fc.Interface.Address) == 0 {
+		return nil, errors.New("Address should not be empty")
+	}
+	for _, str := range fc.Interface.Address {
+		prefix, err := parsePrefix(strings.TrimSpace(str))
+		if err != nil {
+			return nil, fmt.Errorf("Address %q is not a valid IP address or CIDR prefix", str)
+		}
+		iface.Addresses = append(iface.Addresses, prefix)
+	}
+	for _, str := range fc.Interface.DNS {
+		addr, err := netip.ParseAddr(strings.TrimSpace(str))
+		if err != nil {
+			return nil, fmt.Errorf("DNS %q is not a valid IP address: %w", str, err)
+		}
+		iface.DNS = append(iface.DNS, addr)
+	}
+
+	if len(fc.Peers) == 0 {
+		return nil, errors.New("at least one peer is expected")
+	}
+	peers := make([]PeerConfig, 0, len(fc.Peers))
+	for i, p := range fc.Peers {
+		peer := PeerConfig{
+			PreSharedKey: zeroKey,
+			Endpoint:     strings.TrimSpace(p.Endpoint),
+			KeepAlive:    p.PersistentKeepalive,
+		}
+		if p.PublicKey == "" {
+			return nil, fmt.Errorf("peer %d: PublicKey should not be empty", i+1)
+		}
+		if peer.PublicKey, err = EncodeBase64ToHex(strings.TrimSpace(p.PublicKey)); err != nil {
+			return nil, fmt.Errorf("peer %d: invalid PublicKey", i+1)
+		}
+		if p.PresharedKey != "" {
+			if peer.PreSharedKey, err = resolveKey(p.PresharedKey); err != nil {
+				return nil, fmt.Errorf("peer %d: invalid PresharedKey: %w", i+1, err)
+			}
+			peer.PreSharedKeyRef = secretRef(p.PresharedKey)
+		}
+		if peer.Transport, err = parsePeerTransport(p.Transport); err != nil {
+			return nil, fmt.Errorf("peer %d: %w", i+1, err)
+		}
+		for _, str := range p.AllowedIPs {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(str))
+			if err != nil {
+				return nil, fmt.Errorf("peer %d: AllowedIPs %q is not a valid CIDR prefix: %w", i+1, str, err)
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, prefix)
+		}
+		peers = append(peers, peer)
+	}
+
+	proxy, err := fc.proxyOptions()
+	if err != nil {
+		return nil, err
+	}
+	return &Configuration{Interface: iface, Peers: peers, Proxy: proxy}, nil
+}
+
+func (fc *fileConfig) proxyOptions() (*ProxyOptions, error) {
+	if fc.Socks == nil && fc.HTTP == nil && fc.Forward == nil && fc.Routing == nil && fc.Chains == nil && fc.Fallback == nil && fc.Timeouts == nil && fc.Resolver == "" {
+		return nil, nil
+	}
+
+	opts := &ProxyOptions{Resolver: fc.Resolver}
+	if opts.Resolver != "" {
+		if _, err := netip.ParseAddr(opts.Resolver); err != nil {
+			return nil, fmt.Errorf("resolver %q is not a valid IP address", opts.Resolver)
+		}
+	}
+
+	var err error
+	if opts.Socks, err = parseFileListeners("socks", fc.Socks); err != nil {
+		return nil, err
+	}
+	if opts.HTTP, err = parseFileListeners("http", fc.HTTP); err != nil {
+		return nil, err
+	}
+
+	for _, f := range fc.Forward {
+		fwd, err := ParseForwardOptions(f.Listen, f.Target)
+		if err != nil {
+			return nil, fmt.Errorf("forward: %w", err)
+		}
+		opts.Forward = append(opts.Forward, fwd)
+	}
+
+	if fc.Routing != nil {
+		if fc.Routing.Default != "" {
+			if opts.DefaultRoute, err = ParseRouteAction(fc.Routing.Default); err != nil {
+				return nil, fmt.Errorf("routing: %w", err)
+			}
+		}
+		for _, r := range fc.Routing.Rules {
+			rule := RouteRule{Chain: r.Chain}
+			if rule.Action, err = ParseRouteAction(r.Action); err != nil {
+				return nil, fmt.Errorf("routing: %w", err)
+			}
+			for _, match := range r.Match {
+				if err := rule.add(strings.TrimSpace(match)); err != nil {
+					return nil, fmt.Errorf("routing: %w", err)
+				}
+			}
+			if len(rule.Networks) == 0 && len(rule.Domains) == 0 {
+				return nil, fmt.Errorf("routing: a %s rule matches nothing", rule.Action)
+			}
+			opts.Routes = append(opts.Routes, rule)
+		}
+	}
+
+	for _, c := range fc.Chains {
+		chain := Chain{Name: strings.TrimSpace(c.Name)}
+		for _, str := range c.Proxies {
+			p, err := ParseUpstreamProxy(str)
+			if err != nil {
+				return nil, fmt.Errorf("chains: %s: %w", chain.Name, err)
+			}
+			chain.Proxies = append(chain.Proxies, p)
+		}
+		opts.Chains = append(opts.Chains, chain)
+	}
+	if err := checkChains(opts.Chains, opts.Routes, opts.DefaultRoute); err != nil {
+		return nil, fmt.Errorf("chains: %w", err)
+	}
+
+	if fc.Fallback != nil {
+		opts.Fallback = &FallbackOptions{Allow: fc.Fallback.Allow, Deny: fc.Fallback.Deny}
+		if _, err := newFallback(opts.Fallback); err != nil {
+			return nil, fmt.Errorf("fallback: %w", err)
+		}
+	}
+
+	if t := fc.Timeouts; t != nil {
+		for _, v := range []struct {
+			name  string
+			value string
+			d     *time.Duration
+		}{
+			{"handshake", t.Handshake, &opts.Timeouts.Handshake},
+			{"dial", t.Dial, &opts.Timeouts.Dial},
+			{"idle", t.Idle, &opts.Timeouts.Idle},
+			{"lifetime", t.Lifetime, &opts.Timeouts.Lifetime},
+		} {
+			if v.value == "" {
+				continue
+			}
+			if *v.d, err = ParseTimeout(v.value); err != nil {
+				return nil, fmt.Errorf("timeouts: %s: %w", v.name, err)
+			}
+		}
+	}
+	return opts, nil
+}
+
+// parseFileListeners parses listeners the way the [Socks5] and [HTTP]
+// sections are parsed.
+func parseFileListeners(name string, list []fileListener) ([]ListenerOptions, error) {
+	var listeners []ListenerOptions
+	for _, l := range list {
+		var opts ListenerOptions
+		var err error
+		addr := strings.TrimSpace(l.BindAddress)
+		if IsUnixSocketAddress(addr) {
+			if opts.Unix, err = ParseUnixSocket(addr); err != nil {
+				return nil, fmt.Errorf("%s: invalid bind_address: %w", name, err)
+			}
+		} else {
+			addrPort, err := netip.ParseAddrPort(addr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid bind_address: %w", name, err)
+			}
+			opts.Address = &addrPort
+		}
+
+		opts.Username = l.Username
+		if l.Password != "" {
+			if opts.Password, err = resolveSecret(l.Password); err != nil {
+				return nil, fmt.Errorf("%s: invalid password: %w", name, err)
+			}
+			opts.PasswordRef = secretRef(l.Password)
+		}
+		if (opts.Username == "") != (opts.Password == "") {
+			return nil, fmt.Errorf("%s: username and password must be given together", name)
+		}
+		for _, str := range l.Allow {
+			prefix, err := parsePrefix(strings.TrimSpace(str))
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid allow %q: %w", name, str, err)
+			}
+			opts.Allow = append(opts.Allow, prefix)
+		}
+		listeners = append(listeners, opts)
+	}
+	return listeners, nil
+}
@@ -1,6 +1,12 @@
 package wiresocks
 
 import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/go-ini/ini"
@@ -83,3 +89,290 @@ Endpoint = 9.9.9.9:51820`
 		t.Fatal(err)
 	}
 }
+
+func TestWireguardConfWithProxySections(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = anotherkeyanotherkeyanotherkeyanotherkeynow=
+Address = 10.10.0.2/32
+
+[Peer]
+PublicKey = onemorekeyonemorekeyonemorekeyonemorekeynow=
+AllowedIPs = 0.0.0.0/0
+Endpoint = 5.6.7.8:51820
+
+[Socks5]
+BindAddress = 127.0.0.1:1081
+
+[Socks5]
+BindAddress = [::1]:1081, 172.17.0.1:1081
+Username = user
+Password = secret
+Allow = 172.17.0.0/16
+
+[HTTP]
+BindAddress = 127.0.0.1:8119`
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := ParseProxyOptions(iniData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts == nil || len(opts.Socks) != 3 || len(opts.HTTP) != 1 {
+		t.Fatalf("expected three SOCKS and one HTTP listener, got %+v", opts)
+	}
+	if opts.Socks[0].String() != "127.0.0.1:1081" || opts.Socks[0].Username != "" {
+		t.Fatalf("unexpected SOCKS listener: %+v", opts.Socks[0])
+	}
+	for _, l := range opts.Socks[1:] {
+		if l.Username != "user" || l.Password != "secret" || len(l.Allow) != 1 {
+			t.Fatalf("unexpected SOCKS listener options: %+v", l)
+		}
+	}
+	if opts.Socks[1].String() != "[::1]:1081" || opts.Socks[2].String() != "172.17.0.1:1081" {
+		t.Fatalf("unexpected SOCKS bind addresses: %s, %s", opts.Socks[1], opts.Socks[2])
+	}
+	if opts.HTTP[0].String() != "127.0.0.1:8119" {
+		t.Fatalf("unexpected HTTP bind address: %s", opts.HTTP[0])
+	}
+}
+
+func TestConfigurationExportRoundTrip(t *testing.T) {
+	const config = `[Interface]
+PrivateKey = dGhpcyBpcyBhIHRlc3QgcHJpdmF0ZSBleS4uLi4uLi4=
+Address = 10.10.0.1/32
+DNS = 8.8.8.8
+MTU = 1280
+FwMark = 51820
+
+[Peer]
+PublicKey = dGhpcyBpcyBhIHRlc3QgcHVibGljIGtleS4uLi4uLi4=
+PresharedKey = dGhpcyBpcyBhIHRlc3QgcHJlc2hhcmVkIGtleS4uLi4=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = vpn.example.com:51820
+PersistentKeepalive = 25
+
+[Proxy]
+Resolver = 9.9.9.9
+DefaultRoute = tunnel
+Route = direct 192.168.0.0/16, lan
+Route = block ads.example.com
+Route = chain corp intranet.example.com
+Fallback = true
+FallbackAllow = example.com, 192.0.2.0/24
+FallbackDeny = bank.example.com
+IdleTimeout = 10m0s
+MaxLifetime = off
+
+[Socks5]
+BindAddress = 127.0.0.1:1080
+Username = user
+Password = secret
+Allow = 10.0.0.0/8
+
+[HTTP]
+BindAddress = unix:/run/wiresocks.sock?mode=0660
+
+[Forward]
+Listen = 127.0.0.1:2222
+Target = 10.10.0.5:22
+
+[Chain]
+Name = corp
+Proxy = socks5://10.8.0.1:1080
+Proxy = http://proxy.corp:3128
+`
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wg.conf")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ParseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := conf.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported != config {
+		t.Fatalf("export is not lossless:\n%s", exported)
+	}
+
+	redactedConf, err := conf.Export(ExportYAML, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"dGhpcyBpcyBhIHRlc3QgcHJpdmF0ZSBleS4uLi4uLi4=", "dGhpcyBpcyBhIHRlc3QgcHJlc2hhcmVkIGtleS4uLi4=", "secret"} {
+		if strings.Contains(string(redactedConf), secret) {
+			t.Errorf("redacted export contains %q", secret)
+		}
+	}
+}
+
+func TestParseConfigYAML(t *testing.T) {
+	const config = `
+interface:
+  private_key: dGhpcyBpcyBhIHRlc3QgcHJpdmF0ZSBleS4uLi4uLi4=
+  address: [10.10.0.1/32]
+peers:
+  - public_key: dGhpcyBpcyBhIHRlc3QgcHVibGljIGtleS4uLi4uLi4=
+    allowed_ips: [0.0.0.0/0]
+    endpoint: 1.2.3.4:51820
+socks:
+  - bind_address: 127.0.0.1:1080
+forward:
+  - listen: 127.0.0.1:2222
+    target: 10.10.0.5:22
+routing:
+  default: direct
+  rules:
+    - action: tunnel
+      match: [10.0.0.0/8, example.com]
+`
+	conf, err := ParseConfigData([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Proxy == nil || len(conf.Proxy.Socks) != 1 || len(conf.Proxy.Forward) != 1 {
+		t.Fatalf("unexpected proxy options: %+v", conf.Proxy)
+	}
+	if conf.Proxy.DefaultRoute != RouteDirect || len(conf.Proxy.Routes) != 1 {
+		t.Fatalf("unexpected routing: %+v", conf.Proxy)
+	}
+
+	// The same configuration as JSON, through Export.
+	data, err := conf.Export(ExportJSON, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := ParseConfigData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := mustString(t, conf), mustString(t, fromJSON); a != b {
+		t.Fatalf("JSON round trip differs:\n%s\n%s", a, b)
+	}
+
+	if _, err := ParseConfigData([]byte("interface:\n  privat_key: x\n")); err == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+}
+
+func mustString(t *testing.T, conf *Configuration) string {
+	t.Helper()
+	s, err := conf.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestParseConfigSecretReferences(t *testing.T) {
+	const privateKey = "dGhpcyBpcyBhIHRlc3QgcHJpdmF0ZSBleS4uLi4uLi4="
+	const psk = "dGhpcyBpcyBhIHRlc3QgcHVibGljIGtleS4uLi4uLi4="
+	t.Setenv("WIRESOCKS_TEST_PRIVATE_KEY", privateKey)
+	pskFile := filepath.Join(t.TempDir(), "psk")
+	if err := os.WriteFile(pskFile, []byte(psk+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := `
+[Interface]
+PrivateKey = env:WIRESOCKS_TEST_PRIVATE_KEY
+Address = 10.10.0.1/32
+
+[Peer]
+PublicKey = dGhpcyBpcyBhIHRlc3QgcHVibGljIGtleS4uLi4uLi4=
+PresharedKey = file:` + pskFile + `
+AllowedIPs = 0.0.0.0/0
+Endpoint = 1.2.3.4:51820`
+	conf, err := ParseConfigData([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := EncodeBase64ToHex(privateKey); conf.Interface.PrivateKey != want {
+		t.Fatalf("PrivateKey was not read from the environment")
+	}
+	if want, _ := EncodeBase64ToHex(psk); conf.Peers[0].PreSharedKey != want {
+		t.Fatalf("PresharedKey was not read from the file")
+	}
+
+	text, err := conf.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "env:WIRESOCKS_TEST_PRIVATE_KEY") || !strings.Contains(text, "file:"+pskFile) || strings.Contains(text, privateKey) {
+		t.Fatalf("export does not keep the references:\n%s", text)
+	}
+	text, err = conf.Resolved().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "PrivateKey = "+privateKey) || !strings.Contains(text, "PresharedKey = "+psk) || strings.Contains(text, "env:") {
+		t.Fatalf("resolved export does not hold the secrets:\n%s", text)
+	}
+
+	_, err = ParseConfigData([]byte(strings.Replace(config, "WIRESOCKS_TEST_PRIVATE_KEY", "WIRESOCKS_TEST_UNSET", 1)))
+	if err == nil || !strings.Contains(err.Error(), "WIRESOCKS_TEST_UNSET is not set") {
+		t.Fatalf("expected an unset variable error, got %v", err)
+	}
+}
+
+func TestParseConfigVia(t *testing.T) {
+	const tmpl = `
+[Interface]
+PrivateKey = dGhpcyBpcyBhIHRlc3QgcHJpdmF0ZSBleS4uLi4uLi4=
+Address = %s
+%s
+
+[Peer]
+PublicKey = dGhpcyBpcyBhIHRlc3QgcHVibGljIGtleS4uLi4uLi4=
+AllowedIPs = 0.0.0.0/0
+Endpoint = %s`
+	dir := t.TempDir()
+	write := func(name, addr, via, endpoint string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(tmpl, addr, via, endpoint)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	write("entry.conf", "10.10.0.1/32", "", "1.2.3.4:51820")
+	conf, err := ParseConfig(write("exit.conf", "10.20.0.1/32", "Via = entry.conf", "10.10.0.2:51820"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := conf.Interface.Entry
+	if entry == nil || entry.Interface.Addresses[0].String() != "10.10.0.1/32" {
+		t.Fatalf("entry tunnel was not loaded: %+v", entry)
+	}
+
+	// In a directory, an entry tunnel without proxy sections only runs inside
+	// the tunnel naming it. One with its own listeners also runs alone.
+	confs, err := ParseConfigDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := confs["entry"]; ok || confs["exit"] == nil {
+		t.Fatalf("got tunnels %v, want exit only", slices.Sorted(maps.Keys(confs)))
+	}
+	write("entry.conf", "10.10.0.1/32", "[Socks5]\nBindAddress = 127.0.0.1:1080", "1.2.3.4:51820")
+	if confs, err = ParseConfigDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if confs["entry"] == nil || confs["exit"] == nil {
+		t.Fatalf("got tunnels %v, want entry and exit", slices.Sorted(maps.Keys(confs)))
+	}
+
+	write("a.conf", "10.10.0.1/32", "Via = b.conf", "1.2.3.4:51820")
+	_, err = ParseConfig(write("b.conf", "10.20.0.1/32", "Via = a.conf", "1.2.3.4:51820"))
+	if err == nil || !strings.Contains(err.Error(), "Via may loop") {
+		t.Fatalf("expected a loop error, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shahradelahi/wiresocks/proxy/statute"
+)
+
+// ErrNotStarted is returned when the tunnel is used before Start succeeded
+// or after Close.
+var ErrNotStarted = errors.New("wiresocks is not started")
+
+// DialContext connects to address through the first tunnel. Only "tcp" and
+// "udp" networks (and their 4/6 variants) are supported.
+func (s *WireSocks) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	group, err := s.defaultGroup()
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portInt, _ := strconv.Atoi(port)
+
+	t := group.pick(&statute.ProxyRequest{
+		Network:     network,
+		Destination: address,
+		DestHost:    host,
+		DestPort:    int32(portInt),
+	})
+
+	conn, err := t.tnet.DialContext(ctx, network, address)
+	if err != nil {
+		t.release()
+		return nil, err
+	}
+	return &tunnelConn{Conn: conn, t: t}, nil
+}
+
+// ListenPacket listens for UDP packets inside the first tunnel. address is
+// the local address on the tunnel interface; an empty host listens on the
+// tunnel address of the IP version of network, and an empty port picks any.
+// Listening is immediate, so ctx is only checked before it starts.
+func (s *WireSocks) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	group, err := s.defaultGroup()
+	if err != nil {
+		return nil, err
+	}
+
+	var laddr netip.AddrPort
+	if address != "" {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		portInt, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %w", port, err)
+		}
+		var addr netip.Addr
+		if host != "" {
+			if addr, err = netip.ParseAddr(host); err != nil {
+				return nil, err
+			}
+		}
+		laddr = netip.AddrPortFrom(addr, uint16(portInt))
+	}
+
+	t := group.pick(&statute.ProxyRequest{Network: network, Destination: address})
+	if !laddr.Addr().IsValid() {
+		// The netstack needs an address to tell the IP version.
+		addr, err := tunnelAddr(network, t.conf)
+		if err != nil {
+			t.release()
+			return nil, err
+		}
+		laddr = netip.AddrPortFrom(addr, laddr.Port())
+	}
+
+	pc, err := t.tnet.ListenUDPAddrPort(laddr)
+	if err != nil {
+		t.release()
+		return nil, err
+	}
+	return &tunnelPacketConn{PacketConn: pc, t: t}, nil
+}
+
+// NewHTTPTransport returns an http.Transport that sends every request through
+// the first tunnel.
+func (s *WireSocks) NewHTTPTransport() *http.Transport {
+	return &http.Transport{
+		DialContext:           s.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// tunnelAddr returns the first address of the interface of conf in the
+// IP version of network, any version for "udp".
+func tunnelAddr(network string, conf *Configuration) (netip.Addr, error) {
+	for _, prefix := range conf.Interface.Addresses {
+		addr := prefix.Addr()
+		if network == "udp" || (network == "udp4") == addr.Is4() {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("the tunnel has no address for %s", network)
+}
+
+func (s *WireSocks) defaultGroup() (tunnelGroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.instances) == 0 {
+		return nil, ErrNotStarted
+	}
+	return s.instances[0].group, nil
+}
+
+// tunnelConn keeps its tunnel from being closed by a failover until the
+// connection is closed.
+type tunnelConn struct {
+	net.Conn
+	t    *tunnel
+	once sync.Once
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.t.release)
+	return err
+}
+
+// tunnelPacketConn is the net.PacketConn counterpart of tunnelConn.
+type tunnelPacketConn struct {
+	net.PacketConn
+	t    *tunnel
+	once sync.Once
+}
+
+func (c *tunnelPacketConn) Close() error {
+	err := c.PacketConn.Close()
+	c.once.Do(c.t.release)
+	return err
+}
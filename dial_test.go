@@ -0,0 +1,104 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/shahradelahi/wiresocks/proxy/statute"
+)
+
+func TestDialThroughTunnel(t *testing.T) {
+	s, peerNet := newTestWireSocks(t)
+	if _, err := s.DialContext(context.Background(), "tcp", "10.10.0.2:80"); !errors.Is(err, ErrNotStarted) {
+		t.Fatalf("dial before Start: got %v, want ErrNotStarted", err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	group, err := s.defaultGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := group.pick(&statute.ProxyRequest{})
+	tun.release()
+	expectRefs := func(what string, want int64) {
+		t.Helper()
+		if got := tun.active.Load(); got != want {
+			t.Fatalf("%s: tunnel has %d reference(s), want %d", what, got, want)
+		}
+	}
+
+	conn, err := s.DialContext(context.Background(), "tcp", "10.10.0.2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRefs("dialed", 1)
+	_ = conn.Close()
+	_ = conn.Close()
+	expectRefs("closed twice", 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.DialContext(ctx, "tcp", "10.10.0.2:80"); err == nil {
+		t.Fatal("dial succeeded with a cancelled context")
+	}
+	expectRefs("failed dial", 0)
+
+	// HTTP requests hold the tunnel while their connection is open.
+	transport := s.NewHTTPTransport()
+	resp, err := (&http.Client{Transport: transport}).Get("http://10.10.0.2/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+	expectRefs("idle HTTP connection", 1)
+	transport.CloseIdleConnections()
+	expectRefs("HTTP connections closed", 0)
+
+	// UDP through the tunnel, to an echo server on the peer.
+	echo, err := peerNet.ListenUDPAddrPort(netip.MustParseAddrPort("10.10.0.2:7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	if _, err := s.ListenPacket(ctx, "udp", ""); !errors.Is(err, context.Canceled) {
+		t.Fatalf("listen with a cancelled context: got %v", err)
+	}
+	pc, err := s.ListenPacket(context.Background(), "udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRefs("listening", 1)
+	if _, err := pc.WriteTo([]byte("ping"), net.UDPAddrFromAddrPort(netip.MustParseAddrPort("10.10.0.2:7"))); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("echo: got %q, %v", buf[:n], err)
+	}
+	_ = pc.Close()
+	expectRefs("packet conn closed", 0)
+}
@@ -0,0 +1,221 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+
+	"github.com/shahradelahi/wiresocks/log"
+)
+
+const (
+	// handshakeStaleAfter is how old the last handshake of a peer may get
+	// before the peer is considered unreachable. WireGuard rejects sessions
+	// older than three minutes, so a healthy peer always handshakes sooner.
+	handshakeStaleAfter = 3 * time.Minute
+
+	// minEndpointTTL and maxEndpointTTL clamp the TTL reported by DNS so that
+	// we neither hammer the resolver nor hold on to a stale answer forever.
+	minEndpointTTL = 30 * time.Second
+	maxEndpointTTL = time.Hour
+
+	// endpointCheckInterval is how often the watcher looks at handshakes.
+	endpointCheckInterval = 10 * time.Second
+)
+
+// peerEndpoint tracks a peer whose endpoint is configured as a DNS name.
+type peerEndpoint struct {
+	publicKey string
+	hostname  string     // original host:port as written in the config
+	transport *Transport // the peer's own transport, if any
+	addr      netip.AddrPort
+	expires   time.Time
+	resolved  time.Time
+}
+
+// endpointResolver resolves DNS-named peer endpoints and keeps them up to
+// date for the lifetime of a WireGuard device.
+type endpointResolver struct {
+	dnsServer string
+	includeV6 bool
+	// lookup and now are resolveAddressPort and time.Now outside of tests.
+	lookup func(ctx context.Context, hostname string, includeV6 bool, dnsServer string) (netip.AddrPort, time.Duration, error)
+	now    func() time.Time
+	// moved, when set, is told the new address of a peer with its own
+	// transport before the device sends to it, so the bind keeps routing
+	// the peer through its proxy.
+	moved func(t *Transport, from, to netip.AddrPort)
+	// seen, when set, is given the last handshakes of the peers read on
+	// every check, so the tunnel's health needn't read them again.
+	seen func(handshakes map[string]time.Time)
+
+	mu    sync.Mutex
+	peers []*peerEndpoint
+}
+
+func newEndpointResolver(dnsServer string, includeV6 bool) *endpointResolver {
+	return &endpointResolver{
+		dnsServer: dnsServer,
+		includeV6: includeV6,
+		lookup:    resolveAddressPort,
+		now:       time.Now,
+	}
+}
+
+// resolve returns a copy of conf where every peer endpoint is an IP address.
+// The hostnames in conf are left untouched so that they can be resolved again
+// later on. Peers whose endpoint cannot be resolved are left without one
+// until a later attempt succeeds.
+func (r *endpointResolver) resolve(ctx context.Context, conf *Configuration) *Configuration {
+	resolved := *conf
+	resolved.Peers = make([]PeerConfig, len(conf.Peers))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers = nil
+
+	for i, peer := range conf.Peers {
+		resolved.Peers[i] = peer
+		if peer.Endpoint == "" {
+			continue
+		}
+		if _, err := netip.ParseAddrPort(peer.Endpoint); err == nil {
+			// Literal IP endpoints never change.
+			continue
+		}
+
+		addr, ttl, err := r.lookup(ctx, peer.Endpoint, r.includeV6, r.dnsServer)
+		if err != nil {
+			log.Warnf("Failed to resolve peer endpoint %s: %v", peer.Endpoint, err)
+			resolved.Peers[i].Endpoint = ""
+		} else {
+			log.Debugf("Resolved peer endpoint %s to %s", peer.Endpoint, addr.String())
+			resolved.Peers[i].Endpoint = addr.String()
+		}
+
+		now := r.now()
+		p := &peerEndpoint{
+			publicKey: peer.PublicKey,
+			hostname:  peer.Endpoint,
+			transport: peer.Transport,
+			resolved:  now,
+		}
+		if err == nil {
+			p.addr, p.expires = addr, now.Add(clampTTL(ttl))
+		}
+		// A peer that failed to resolve is retried on the next check.
+		r.peers = append(r.peers, p)
+	}
+
+	return &resolved
+}
+
+// watch re-resolves DNS-named endpoints whenever their TTL expires or their
+// peer stops completing handshakes, and pushes any new address to dev. It
+// passes the handshakes to seen on every check and returns once ctx is
+// done.
+func (r *endpointResolver) watch(ctx context.Context, dev *device.Device) {
+	r.mu.Lock()
+	dynamic := len(r.peers)
+	r.mu.Unlock()
+	if dynamic == 0 && r.seen == nil {
+		log.Debugf("No DNS-named peer endpoints, endpoint watcher not started.")
+		return
+	}
+
+	if dynamic > 0 {
+		log.Debugf("Watching %d DNS-named peer endpoint(s) for changes.", dynamic)
+	}
+	ticker := time.NewTicker(endpointCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		handshakes, err := peerHandshakes(dev)
+		if err != nil {
+			log.Debugf("Failed to read peer handshakes: %v", err)
+			continue
+		}
+		if r.seen != nil {
+			r.seen(handshakes)
+		}
+		if dynamic > 0 {
+			r.refresh(ctx, dev, handshakes)
+		}
+	}
+}
+
+func (r *endpointResolver) refresh(ctx context.Context, dev *device.Device, handshakes map[string]time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	for _, peer := range r.peers {
+		expired := now.After(peer.expires)
+		stale := false
+		if last, ok := handshakes[peer.publicKey]; ok {
+			stale = now.Sub(last) > handshakeStaleAfter
+		}
+		// Don't re-resolve a failing peer more often than the minimum TTL.
+		if !expired && !(stale && now.Sub(peer.resolved) > minEndpointTTL) {
+			continue
+		}
+
+		if stale {
+			log.Infof("Peer %s has not completed a handshake recently, re-resolving %s", peer.publicKey[:8], peer.hostname)
+		} else {
+			log.Debugf("DNS record for %s expired, re-resolving", peer.hostname)
+		}
+
+		peer.resolved = now
+		addr, ttl, err := r.lookup(ctx, peer.hostname, r.includeV6, r.dnsServer)
+		if err != nil {
+			log.Warnf("Failed to re-resolve peer endpoint %s: %v", peer.hostname, err)
+			peer.expires = now.Add(minEndpointTTL)
+			continue
+		}
+		peer.expires = now.Add(clampTTL(ttl))
+
+		if addr == peer.addr {
+			continue
+		}
+
+		if peer.addr.IsValid() {
+			log.Infof("Peer endpoint %s changed from %s to %s", peer.hostname, peer.addr, addr)
+		} else {
+			log.Infof("Resolved peer endpoint %s to %s", peer.hostname, addr)
+		}
+		if peer.transport != nil && r.moved != nil {
+			r.moved(peer.transport, peer.addr, addr)
+		}
+		if err := updatePeerEndpoint(dev, peer.publicKey, addr); err != nil {
+			log.Errorf("Failed to update endpoint of peer %s: %v", peer.publicKey[:8], err)
+			continue
+		}
+		peer.addr = addr
+	}
+}
+
+// updatePeerEndpoint points an existing peer of dev at a new endpoint.
+func updatePeerEndpoint(dev *device.Device, publicKey string, addr netip.AddrPort) error {
+	return dev.IpcSet(fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", publicKey, addr))
+}
+
+func clampTTL(ttl time.Duration) time.Duration {
+	if ttl < minEndpointTTL {
+		return minEndpointTTL
+	}
+	if ttl > maxEndpointTTL {
+		return maxEndpointTTL
+	}
+	return ttl
+}
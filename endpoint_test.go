@@ -0,0 +1,321 @@
+package wiresocks
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/conn"
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDNS answers endpoint lookups from records, on a clock moved by hand.
+type testDNS struct {
+	records map[string]string // hostname to address, no entry fails
+	lookups []string
+	clock   time.Time
+}
+
+func (d *testDNS) resolver() *endpointResolver {
+	r := newEndpointResolver("", true)
+	r.now = func() time.Time { return d.clock }
+	r.lookup = func(_ context.Context, hostname string, _ bool, _ string) (netip.AddrPort, time.Duration, error) {
+		d.lookups = append(d.lookups, hostname)
+		host, port, _ := strings.Cut(hostname, ":")
+		addr, ok := d.records[host]
+		if !ok {
+			return netip.AddrPort{}, 0, errors.New("no such host")
+		}
+		return netip.MustParseAddrPort(addr + ":" + port), time.Minute, nil
+	}
+	return r
+}
+
+func TestEndpointResolverResolve(t *testing.T) {
+	dns := &testDNS{records: map[string]string{"a.example": "192.0.2.1"}, clock: time.Now()}
+	r := dns.resolver()
+	conf := &Configuration{Peers: []PeerConfig{
+		{PublicKey: "a", Endpoint: "a.example:51820"},
+		{PublicKey: "b", Endpoint: "b.example:51820"},
+		{PublicKey: "c", Endpoint: "c.example:51820", Transport: &Transport{}},
+		{PublicKey: "d", Endpoint: "192.0.2.4:51820"},
+	}}
+
+	resolved := r.resolve(context.Background(), conf)
+	want := []string{"192.0.2.1:51820", "", "", "192.0.2.4:51820"}
+	for i, peer := range resolved.Peers {
+		if peer.Endpoint != want[i] {
+			t.Errorf("peer %s: endpoint %q, want %q", peer.PublicKey, peer.Endpoint, want[i])
+		}
+	}
+	if conf.Peers[0].Endpoint != "a.example:51820" {
+		t.Error("resolve changed the endpoints of conf")
+	}
+
+	// The DNS-named peers are kept up to date, those that failed to resolve
+	// included.
+	var tracked []string
+	for _, p := range r.peers {
+		tracked = append(tracked, p.publicKey)
+	}
+	if fmt.Sprint(tracked) != "[a b c]" {
+		t.Errorf("tracked peers %v, want [a b c]", tracked)
+	}
+}
+
+func TestEndpointResolverTransportPeer(t *testing.T) {
+	key, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := PublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer's proxy is looked up by its endpoint, which does not resolve
+	// at first.
+	dns := &testDNS{records: map[string]string{}, clock: time.Now()}
+	r := dns.resolver()
+	transport := &Transport{Scheme: "socks5", Address: "127.0.0.1:1080"}
+	resolved := r.resolve(context.Background(), &Configuration{
+		Interface: &InterfaceConfig{},
+		Peers:     []PeerConfig{{PublicKey: pub, Endpoint: "a.example:51820", Transport: transport}},
+	})
+	bind, ok := newBind(resolved).(*socksBind)
+	if !ok {
+		t.Fatal("peer with a transport got no SOCKS5 bind")
+	}
+	r.moved = bind.movePeer
+	dev := testDevice(t, resolved)
+
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2"} {
+		dns.records["a.example"] = addr
+		dns.clock = dns.clock.Add(maxEndpointTTL)
+		r.refresh(context.Background(), dev, nil)
+		if got := bind.proxy(netip.MustParseAddrPort(addr + ":51820")); got != transport {
+			t.Errorf("datagrams to %s go through %v, want the peer's transport", addr, got)
+		}
+	}
+	if got := bind.proxy(netip.MustParseAddrPort("192.0.2.1:51820")); got != nil {
+		t.Errorf("datagrams to the old address still go through %v", got)
+	}
+}
+
+func TestEndpointResolverRefresh(t *testing.T) {
+	keys := make([]string, 2)
+	for i := range keys {
+		key, err := GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys[i], err = PublicKey(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := keys[0], keys[1]
+
+	dns := &testDNS{records: map[string]string{"a.example": "192.0.2.1"}, clock: time.Now()}
+	r := dns.resolver()
+	resolved := r.resolve(context.Background(), &Configuration{Peers: []PeerConfig{
+		{PublicKey: a, Endpoint: "a.example:51820"},
+		{PublicKey: b, Endpoint: "b.example:51820"},
+	}})
+	dev := testDevice(t, resolved)
+
+	refresh := func(after time.Duration, handshakes map[string]time.Time) {
+		t.Helper()
+		dns.clock = dns.clock.Add(after)
+		dns.lookups = nil
+		r.refresh(context.Background(), dev, handshakes)
+	}
+	expect := func(lookups string, endpoints map[string]string) {
+		t.Helper()
+		if got := fmt.Sprint(dns.lookups); got != lookups {
+			t.Errorf("lookups %s, want %s", got, lookups)
+		}
+		got := deviceEndpoints(t, dev)
+		for key, want := range endpoints {
+			if got[key] != want {
+				t.Errorf("endpoint of peer %s is %q, want %q", key[:8], got[key], want)
+			}
+		}
+	}
+	recent := func() map[string]time.Time {
+		return map[string]time.Time{a: dns.clock, b: dns.clock}
+	}
+
+	// The peer that failed to resolve is retried, and left alone after
+	// another failure until the minimum TTL has passed.
+	refresh(endpointCheckInterval, recent())
+	expect("[b.example:51820]", map[string]string{a: "192.0.2.1:51820", b: ""})
+	refresh(endpointCheckInterval, recent())
+	expect("[]", nil)
+
+	// Once it resolves, its address is pushed to the device.
+	dns.records["b.example"] = "192.0.2.2"
+	refresh(minEndpointTTL, recent())
+	expect("[b.example:51820]", map[string]string{b: "192.0.2.2:51820"})
+
+	// A record is looked up again once its TTL expires.
+	dns.records["a.example"] = "192.0.2.11"
+	refresh(5*time.Second, recent()) // 55s after the first lookup
+	expect("[]", nil)
+	refresh(endpointCheckInterval, recent())
+	expect("[a.example:51820]", map[string]string{a: "192.0.2.11:51820", b: "192.0.2.2:51820"})
+
+	// A peer without a recent handshake is looked up again before its TTL
+	// expires, once the minimum TTL has passed.
+	dns.records["b.example"] = "192.0.2.12"
+	stale := recent()
+	stale[b] = dns.clock.Add(-handshakeStaleAfter)
+	refresh(20*time.Second, stale)
+	expect("[b.example:51820]", map[string]string{a: "192.0.2.11:51820", b: "192.0.2.12:51820"})
+}
+
+// testDevice returns a WireGuard device, which is never brought up, with the
+// peers of conf.
+func testDevice(t *testing.T, conf *Configuration) *device.Device {
+	t.Helper()
+	tunDev, _, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.10.0.1")}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(dev.Close)
+
+	var config strings.Builder
+	for _, peer := range conf.Peers {
+		fmt.Fprintf(&config, "public_key=%s\n", peer.PublicKey)
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&config, "endpoint=%s\n", peer.Endpoint)
+		}
+	}
+	if err := dev.IpcSet(config.String()); err != nil {
+		t.Fatal(err)
+	}
+	return dev
+}
+
+// deviceEndpoints returns the endpoint of every peer of dev by public key.
+func deviceEndpoints(t *testing.T, dev *device.Device) map[string]string {
+	t.Helper()
+	get, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints := make(map[string]string)
+	var key string
+	scanner := bufio.NewScanner(strings.NewReader(get))
+	for scanner.Scan() {
+		k, v, _ := strings.Cut(scanner.Text(), "=")
+		switch k {
+		case "public_key":
+			key = v
+			endpoints[key] = ""
+		case "endpoint":
+			endpoints[key] = v
+		}
+	}
+	return endpoints
+}
+
+// TestTunnelAlive checks that a tunnel is alive until the latest handshake
+// the watcher saw gets stale.
+func TestTunnelAlive(t *testing.T) {
+	tun := &tunnel{dev: &device.Device{}}
+	if tun.alive() {
+		t.Fatal("a tunnel without handshakes is alive")
+	}
+	now := time.Now()
+	tun.seen(map[string]time.Time{"a": now.Add(-handshakeStaleAfter - time.Minute), "b": {}})
+	if tun.alive() {
+		t.Fatal("a tunnel with a stale handshake is alive")
+	}
+	tun.seen(map[string]time.Time{"a": now.Add(-handshakeStaleAfter - time.Minute), "b": now})
+	if !tun.alive() {
+		t.Fatal("a tunnel with a recent handshake is not alive")
+	}
+	// A read without handshakes keeps the last one seen.
+	tun.seen(map[string]time.Time{"a": {}})
+	if !tun.alive() {
+		t.Fatal("a tunnel forgot its last handshake")
+	}
+}
+
+func TestLookupTruncated(t *testing.T) {
+	// The server truncates its answers over UDP and sends them whole over
+	// TCP, on the same port.
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	answer := func(query []byte, truncated bool) []byte {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(query); err != nil {
+			t.Error(err)
+			return nil
+		}
+		msg.Response, msg.Truncated = true, truncated
+		if !truncated {
+			msg.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			}}
+		}
+		packed, _ := msg.Pack()
+		return packed
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udp.WriteTo(answer(buf[:n], true), addr)
+		}
+	}()
+	go func() {
+		for {
+			c, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			var size [2]byte
+			if _, err := io.ReadFull(c, size[:]); err == nil {
+				query := make([]byte, binary.BigEndian.Uint16(size[:]))
+				if _, err := io.ReadFull(c, query); err == nil {
+					resp := answer(query, false)
+					_, _ = c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+				}
+			}
+			_ = c.Close()
+		}
+	}()
+
+	addrs, ttl, err := lookupWithTTL(context.Background(), "a.example", dnsmessage.TypeA, udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(addrs) != "[192.0.2.1]" || ttl != 300*time.Second {
+		t.Fatalf("got %v with TTL %v, want [192.0.2.1] with TTL 5m0s", addrs, ttl)
+	}
+}
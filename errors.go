@@ -0,0 +1,48 @@
+package wiresocks
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidConfig is returned when a configuration is malformed or
+	// misses a required setting.
+	ErrInvalidConfig = errors.New("invalid configuration")
+	// ErrHandshakeTimeout is returned when no WireGuard handshake completes
+	// with the peers in time.
+	ErrHandshakeTimeout = errors.New("wireguard handshake timed out")
+	// ErrConnectivityTest is returned when the handshake succeeded but no
+	// traffic could be sent through the tunnel.
+	ErrConnectivityTest = errors.New("tunnel connectivity test failed")
+	// ErrListenerBind is returned when a proxy listener cannot be opened.
+	// The concrete error is a *ListenerError.
+	ErrListenerBind = errors.New("failed to open proxy listener")
+)
+
+// ListenerError reports a proxy listener that could not be opened.
+type ListenerError struct {
+	// Proxy is the kind of proxy the listener was for, "socks" or "http".
+	Proxy string
+	// Addr is the address the listener should have been bound to.
+	Addr string
+	Err  error
+}
+
+func (e *ListenerError) Error() string {
+	return fmt.Sprintf("failed to listen on %s address %s: %v", e.Proxy, e.Addr, e.Err)
+}
+
+func (e *ListenerError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports ListenerError as ErrListenerBind.
+func (e *ListenerError) Is(target error) bool {
+	return target == ErrListenerBind
+}
+
+// invalidConfigf returns an error that matches ErrInvalidConfig.
+func invalidConfigf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidConfig, fmt.Sprintf(format, args...))
+}
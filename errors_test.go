@@ -0,0 +1,127 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
+)
+
+const (
+	testPrivateKey = "a8dbd3d6fd9a1ba2e8bcc6d6fc42fb3c0d0a9c5a3e6a1f3b6e2c5d4b3a291807"
+	testPublicKey  = "0a6c4fd4a29d8b6f3e5a9c2d1b7e4f60a3c8d5e2b9f1a4c7d0e3b6a9c2f5d807"
+)
+
+func TestParseConfigInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.conf")
+	const config = `
+[Interface]
+PrivateKey = not base64
+Address = 10.10.0.1
+
+[Peer]
+PublicKey = dGhpcyBpcyBhIHRlc3QgcHVibGljIGtleS4uLi4uLi4=`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ParseConfig(path)
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("expected ErrInvalidConfig, got %v", err)
+	}
+}
+
+func TestStartInvalidConfig(t *testing.T) {
+	addr := netip.MustParseAddrPort("127.0.0.1:0")
+	ws, err := NewWireSocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.WithSocksBindAddr(&addr)
+	defer ws.Close()
+
+	err = ws.Start(context.Background())
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("expected ErrInvalidConfig, got %v", err)
+	}
+}
+
+func TestProxyListenerBind(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	addr := netip.MustParseAddrPort(ln.Addr().String())
+	server := NewProxyServer(nil, &ProxyOptions{SocksBindAddress: &addr})
+	err = server.Start()
+	if !errors.Is(err, ErrListenerBind) {
+		t.Fatalf("expected ErrListenerBind, got %v", err)
+	}
+
+	var lerr *ListenerError
+	if !errors.As(err, &lerr) {
+		t.Fatalf("expected *ListenerError, got %T", err)
+	}
+	if lerr.Proxy != "socks" || lerr.Addr != addr.String() {
+		t.Errorf("unexpected listener error: %+v", lerr)
+	}
+}
+
+func TestEstablishWireguardHandshakeTimeout(t *testing.T) {
+	tunDev, _, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.10.0.1")}, nil, 1330)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &Configuration{
+		Interface: &InterfaceConfig{PrivateKey: testPrivateKey},
+		Peers: []PeerConfig{{
+			PublicKey:    testPublicKey,
+			PreSharedKey: strings.Repeat("0", 64),
+			Endpoint:     "127.0.0.1:9",
+			AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+		}},
+	}
+
+	_, err = establishWireguard(context.Background(), conf, tunDev, newBind(conf), 0, time.Second)
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("expected ErrHandshakeTimeout, got %v", err)
+	}
+
+	// Cancelling ctx ends the wait before the timeout.
+	tunDev, _, err = netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.10.0.1")}, nil, 1330)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = establishWireguard(ctx, conf, tunDev, newBind(conf), 0, time.Minute)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 5*time.Second {
+		t.Fatalf("expected the wait to end with ctx, got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestConnectivityTestFailure(t *testing.T) {
+	_, tnet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.10.0.1")}, nil, 1330)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	err = connectivityTest(ctx, tnet, "http://10.10.0.2/")
+	if !errors.Is(err, ErrConnectivityTest) {
+		t.Fatalf("expected ErrConnectivityTest, got %v", err)
+	}
+}
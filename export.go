@@ -0,0 +1,387 @@
+package wiresocks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ExportFormat names a format Configuration.Export can write.
+type ExportFormat string
+
+const (
+	ExportINI  ExportFormat = "ini"
+	ExportJSON ExportFormat = "json"
+	ExportYAML ExportFormat = "yaml"
+)
+
+// ParseExportFormat parses the name of an export format.
+func ParseExportFormat(s string) (ExportFormat, error) {
+	switch f := ExportFormat(strings.ToLower(s)); f {
+	case ExportINI, ExportJSON, ExportYAML:
+		return f, nil
+	case "conf", "wg":
+		return ExportINI, nil
+	case "yml":
+		return ExportYAML, nil
+	default:
+		return "", fmt.Errorf("unknown export format %q, expected ini, json or yaml", s)
+	}
+}
+
+// redacted replaces secrets in exports made with redaction.
+const redacted = "(redacted)"
+
+// zeroKey is the hex preshared key of a peer that has none.
+const zeroKey = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Effective returns a copy of c with the settings Start forces on every
+// tunnel applied, i.e. the configuration wiresocks actually runs with.
+func (c *Configuration) Effective() *Configuration {
+	conf := *c
+	if c.Interface != nil {
+		iface := *c.Interface
+		if iface.Entry != nil {
+			iface.Entry = iface.Entry.Effective()
+		}
+		conf.Interface = &iface
+	}
+	conf.Peers = append([]PeerConfig(nil), c.Peers...)
+	if conf.Interface != nil {
+		applyRunDefaults(&conf)
+	}
+	return &conf
+}
+
+// Resolved returns a copy of c that exports the secrets read from env:NAME or
+// file:/path references as their values rather than as the references.
+func (c *Configuration) Resolved() *Configuration {
+	conf := *c
+	if c.Interface != nil {
+		iface := *c.Interface
+		iface.PrivateKeyRef = ""
+		if iface.Entry != nil {
+			iface.Entry = iface.Entry.Resolved()
+		}
+		conf.Interface = &iface
+	}
+	conf.Peers = append([]PeerConfig(nil), c.Peers...)
+	for i := range conf.Peers {
+		conf.Peers[i].PreSharedKeyRef = ""
+	}
+	if c.Proxy != nil {
+		proxy := *c.Proxy
+		for _, list := range []*[]ListenerOptions{&proxy.Socks, &proxy.HTTP} {
+			*list = append([]ListenerOptions(nil), *list...)
+			for i := range *list {
+				(*list)[i].PasswordRef = ""
+			}
+		}
+		conf.Proxy = &proxy
+	}
+	return &conf
+}
+
+// Export renders c in format. With redact, the private key, preshared keys
+// and proxy passwords are replaced by a placeholder, so the output can be
+// shared but not loaded back. Secrets read from env:NAME or file:/path
+// references are written as those references, which hold no secret, unless
+// c comes from Resolved.
+func (c *Configuration) Export(format ExportFormat, redact bool) ([]byte, error) {
+	e, err := c.export(redact)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case ExportINI:
+		return []byte(e.ini()), nil
+	case ExportJSON:
+		b, err := json.MarshalIndent(e, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	case ExportYAML:
+		return yaml.Marshal(e)
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+func (c *Configuration) export(redact bool) (*fileConfig, error) {
+	secret := func(hexKey, ref string) (string, error) {
+		if ref != "" {
+			return ref, nil
+		}
+		if redact {
+			return redacted, nil
+		}
+		return EncodeHexToBase64(hexKey)
+	}
+
+	e := &fileConfig{}
+	if c.Interface != nil {
+		if c.Interface.PrivateKey != "" {
+			key, err := secret(c.Interface.PrivateKey, c.Interface.PrivateKeyRef)
+			if err != nil {
+				return nil, fmt.Errorf("invalid PrivateKey: %w", err)
+			}
+			e.Interface.PrivateKey = key
+		}
+		e.Interface.Address = prefixStrings(c.Interface.Addresses)
+		for _, addr := range c.Interface.DNS {
+			e.Interface.DNS = append(e.Interface.DNS, addr.String())
+		}
+		e.Interface.MTU = c.Interface.MTU
+		e.Interface.FwMark = c.Interface.FwMark
+		e.Interface.ListenPort = c.Interface.ListenPort
+		if c.Interface.BindAddress.IsValid() {
+			e.Interface.BindAddress = c.Interface.BindAddress.String()
+		}
+		e.Interface.BindInterface = c.Interface.BindInterface
+		e.Interface.Jc, e.Interface.Jmin, e.Interface.Jmax = c.Interface.Jc, c.Interface.Jmin, c.Interface.Jmax
+		e.Interface.S1, e.Interface.S2 = c.Interface.S1, c.Interface.S2
+		e.Interface.H1, e.Interface.H2 = c.Interface.H1, c.Interface.H2
+		e.Interface.H3, e.Interface.H4 = c.Interface.H3, c.Interface.H4
+		e.Interface.Transport = exportTransport(c.Interface.Transport, redact)
+		e.Interface.Via = c.Interface.Via
+	}
+
+	e.Peers = make([]filePeer, 0, len(c.Peers))
+	for i, peer := range c.Peers {
+		p := filePeer{
+			AllowedIPs:          prefixStrings(peer.AllowedIPs),
+			Endpoint:            peer.Endpoint,
+			PersistentKeepalive: peer.KeepAlive,
+		}
+		if peer.PublicKey != "" {
+			key, err := EncodeHexToBase64(peer.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("peer %d: invalid PublicKey: %w", i+1, err)
+			}
+			p.PublicKey = key
+		}
+		if peer.PreSharedKey != "" && peer.PreSharedKey != zeroKey {
+			key, err := secret(peer.PreSharedKey, peer.PreSharedKeyRef)
+			if err != nil {
+				return nil, fmt.Errorf("peer %d: invalid PresharedKey: %w", i+1, err)
+			}
+			p.PresharedKey = key
+		}
+		p.Transport = exportTransport(peer.Transport, redact)
+		e.Peers = append(e.Peers, p)
+	}
+
+	if c.Proxy != nil {
+		e.Socks = fileListeners(c.Proxy.socksListeners(), redact)
+		e.HTTP = fileListeners(c.Proxy.httpListeners(), redact)
+		for _, fwd := range c.Proxy.Forward {
+			e.Forward = append(e.Forward, fileForward{Listen: fwd.Listen.String(), Target: fwd.Target})
+		}
+		if len(c.Proxy.Routes) > 0 || c.Proxy.DefaultRoute != "" {
+			e.Routing = &fileRouting{Default: string(c.Proxy.DefaultRoute)}
+			for _, rule := range c.Proxy.Routes {
+				e.Routing.Rules = append(e.Routing.Rules, fileRule{Action: string(rule.Action), Chain: rule.Chain, Match: rule.matches()})
+			}
+		}
+		for _, chain := range c.Proxy.Chains {
+			fc := fileChain{Name: chain.Name}
+			for _, p := range chain.Proxies {
+				fc.Proxies = append(fc.Proxies, exportUpstreamProxy(p, redact))
+			}
+			e.Chains = append(e.Chains, fc)
+		}
+		e.Resolver = c.Proxy.Resolver
+		if fb := c.Proxy.Fallback; fb != nil {
+			e.Fallback = &fileFallback{Allow: fb.Allow, Deny: fb.Deny}
+		}
+		if t := c.Proxy.Timeouts; t != (TimeoutOptions{}) {
+			e.Timeouts = &fileTimeouts{
+				Handshake: formatTimeout(t.Handshake),
+				Dial:      formatTimeout(t.Dial),
+				Idle:      formatTimeout(t.Idle),
+				Lifetime:  formatTimeout(t.Lifetime),
+			}
+		}
+	}
+	return e, nil
+}
+
+// exportTransport returns the URL of t, if any, with its password redacted
+// when redact is set.
+func exportTransport(t *Transport, redact bool) string {
+	if t == nil {
+		return ""
+	}
+	if redact && t.Password != "" {
+		c := *t
+		c.Password = redacted
+		t = &c
+	}
+	return t.String()
+}
+
+// exportUpstreamProxy returns the URL of p with its password redacted when
+// redact is set.
+func exportUpstreamProxy(p *UpstreamProxy, redact bool) string {
+	if redact && p.Password != "" {
+		c := *p
+		c.Password = redacted
+		p = &c
+	}
+	return p.String()
+}
+
+// fileListeners converts list, leaving out pre-opened listeners since they
+// cannot be described by an address.
+func fileListeners(list []ListenerOptions, redact bool) []fileListener {
+	var listeners []fileListener
+	for _, opts := range list {
+		var l fileListener
+		switch {
+		case opts.Unix != nil:
+			l.BindAddress = opts.Unix.address()
+		case opts.Address != nil:
+			l.BindAddress = opts.Address.String()
+		default:
+			continue
+		}
+		l.Username = opts.Username
+		switch {
+		case opts.PasswordRef != "":
+			l.Password = opts.PasswordRef
+		case redact && opts.Password != "":
+			l.Password = redacted
+		default:
+			l.Password = opts.Password
+		}
+		l.Allow = prefixStrings(opts.Allow)
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	var list []string
+	for _, prefix := range prefixes {
+		list = append(list, prefix.String())
+	}
+	return list
+}
+
+// ini renders e in the wg-quick format read by ParseConfig.
+func (e *fileConfig) ini() string {
+	var b strings.Builder
+
+	b.WriteString("[Interface]\n")
+	writeKey(&b, "PrivateKey", e.Interface.PrivateKey)
+	writeKey(&b, "Address", strings.Join(e.Interface.Address, ", "))
+	writeKey(&b, "DNS", strings.Join(e.Interface.DNS, ", "))
+	if e.Interface.MTU != 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", e.Interface.MTU)
+	}
+	if e.Interface.FwMark != 0 {
+		fmt.Fprintf(&b, "FwMark = %d\n", e.Interface.FwMark)
+	}
+	if e.Interface.ListenPort != 0 {
+		fmt.Fprintf(&b, "ListenPort = %d\n", e.Interface.ListenPort)
+	}
+	writeKey(&b, "BindAddress", e.Interface.BindAddress)
+	writeKey(&b, "BindInterface", e.Interface.BindInterface)
+	for _, key := range []struct {
+		name  string
+		value uint64
+	}{
+		{"Jc", uint64(e.Interface.Jc)}, {"Jmin", uint64(e.Interface.Jmin)}, {"Jmax", uint64(e.Interface.Jmax)},
+		{"S1", uint64(e.Interface.S1)}, {"S2", uint64(e.Interface.S2)},
+		{"H1", uint64(e.Interface.H1)}, {"H2", uint64(e.Interface.H2)},
+		{"H3", uint64(e.Interface.H3)}, {"H4", uint64(e.Interface.H4)},
+	} {
+		if key.value != 0 {
+			fmt.Fprintf(&b, "%s = %d\n", key.name, key.value)
+		}
+	}
+	writeKey(&b, "Transport", e.Interface.Transport)
+	writeKey(&b, "Via", e.Interface.Via)
+
+	for _, peer := range e.Peers {
+		b.WriteString("\n[Peer]\n")
+		writeKey(&b, "PublicKey", peer.PublicKey)
+		writeKey(&b, "PresharedKey", peer.PresharedKey)
+		writeKey(&b, "AllowedIPs", strings.Join(peer.AllowedIPs, ", "))
+		writeKey(&b, "Endpoint", peer.Endpoint)
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+		writeKey(&b, "Transport", peer.Transport)
+	}
+
+	if e.Resolver != "" || e.Routing != nil || e.Fallback != nil || e.Timeouts != nil {
+		b.WriteString("\n[Proxy]\n")
+		writeKey(&b, "Resolver", e.Resolver)
+		if e.Routing != nil {
+			writeKey(&b, "DefaultRoute", e.Routing.Default)
+			for _, rule := range e.Routing.Rules {
+				action := rule.Action
+				if rule.Chain != "" {
+					action += " " + rule.Chain
+				}
+				writeKey(&b, "Route", action+" "+strings.Join(rule.Match, ", "))
+			}
+		}
+		if e.Fallback != nil {
+			writeKey(&b, "Fallback", "true")
+			writeKey(&b, "FallbackAllow", strings.Join(e.Fallback.Allow, ", "))
+			writeKey(&b, "FallbackDeny", strings.Join(e.Fallback.Deny, ", "))
+		}
+		if t := e.Timeouts; t != nil {
+			writeKey(&b, "HandshakeTimeout", t.Handshake)
+			writeKey(&b, "DialTimeout", t.Dial)
+			writeKey(&b, "IdleTimeout", t.Idle)
+			writeKey(&b, "MaxLifetime", t.Lifetime)
+		}
+	}
+
+	writeListeners := func(section string, listeners []fileListener) {
+		for _, l := range listeners {
+			fmt.Fprintf(&b, "\n[%s]\n", section)
+			writeKey(&b, "BindAddress", l.BindAddress)
+			writeKey(&b, "Username", l.Username)
+			writeKey(&b, "Password", l.Password)
+			writeKey(&b, "Allow", strings.Join(l.Allow, ", "))
+		}
+	}
+	writeListeners("Socks5", e.Socks)
+	writeListeners("HTTP", e.HTTP)
+
+	for _, fwd := range e.Forward {
+		b.WriteString("\n[Forward]\n")
+		writeKey(&b, "Listen", fwd.Listen)
+		writeKey(&b, "Target", fwd.Target)
+	}
+
+	for _, chain := range e.Chains {
+		b.WriteString("\n[Chain]\n")
+		writeKey(&b, "Name", chain.Name)
+		for _, p := range chain.Proxies {
+			writeKey(&b, "Proxy", p)
+		}
+	}
+
+	return b.String()
+}
+
+func writeKey(b *strings.Builder, key, value string) {
+	if value == "" {
+		return
+	}
+	// Quote values that would otherwise be cut at an inline comment.
+	if strings.ContainsAny(value, "#;") && !strings.Contains(value, "`") {
+		value = "`" + value + "`"
+	}
+	fmt.Fprintf(b, "%s = %s\n", key, value)
+}
@@ -0,0 +1,206 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shahradelahi/wiresocks/log"
+	"github.com/shahradelahi/wiresocks/proxy/statute"
+)
+
+const (
+	// healthCheckInterval is how often the active tunnel is probed.
+	healthCheckInterval = 30 * time.Second
+	// healthCheckFailures is the number of consecutive failed probes after
+	// which the next configuration is brought up.
+	healthCheckFailures = 3
+)
+
+// failover brings up the first working configuration out of an ordered list
+// and switches to the next one whenever the active tunnel stops passing
+// health checks.
+type failover struct {
+	confs     []*Configuration
+	dnsServer string
+	testURL   string
+	// startTunnel brings up a tunnel; it is replaced in tests.
+	startTunnel func(ctx context.Context, conf *Configuration, dnsServer, testURL string) (*tunnel, error)
+
+	mu     sync.Mutex
+	index  int
+	active *tunnel
+	// draining holds the replaced tunnels until their connections are gone.
+	draining map[*tunnel]struct{}
+	closed   bool
+}
+
+func newFailover(confs []*Configuration, dnsServer, testURL string) *failover {
+	return &failover{
+		confs:       confs,
+		dnsServer:   dnsServer,
+		testURL:     testURL,
+		startTunnel: startTunnel,
+		draining:    make(map[*tunnel]struct{}),
+	}
+}
+
+// start brings up the first configuration that establishes a working tunnel.
+func (f *failover) start(ctx context.Context) error {
+	if len(f.confs) == 0 {
+		return errors.New("no WireGuard configuration provided")
+	}
+
+	t, index, err := f.next(ctx, 0, len(f.confs))
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.active, f.index = t, index
+	f.mu.Unlock()
+	return nil
+}
+
+// next tries count configurations in order, starting at index from and
+// wrapping around, and returns the first tunnel that comes up along with its
+// index.
+func (f *failover) next(ctx context.Context, from, count int) (*tunnel, int, error) {
+	var errs []error
+	for i := 0; i < count; i++ {
+		index := (from + i) % len(f.confs)
+		if len(f.confs) > 1 {
+			log.Infof("Bringing up WireGuard configuration %d of %d.", index+1, len(f.confs))
+		}
+
+		t, err := f.startTunnel(ctx, f.confs[index], f.dnsServer, f.testURL)
+		if err != nil {
+			log.Warnf("WireGuard configuration %d failed: %v", index+1, err)
+			errs = append(errs, fmt.Errorf("configuration %d: %w", index+1, err))
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		return t, index, nil
+	}
+
+	return nil, 0, errors.Join(errs...)
+}
+
+func (f *failover) pick(*statute.ProxyRequest) *tunnel {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active != nil {
+		f.active.acquire()
+	}
+	return f.active
+}
+
+func (f *failover) healthy() bool {
+	f.mu.Lock()
+	active := f.active
+	f.mu.Unlock()
+	return active != nil && active.alive()
+}
+
+// monitor probes the active tunnel until ctx is done. When it fails
+// healthCheckFailures times in a row the following configurations are tried
+// in order, and the first one that comes up replaces the active tunnel.
+// Connections through the old tunnel are left to drain.
+func (f *failover) monitor(ctx context.Context) {
+	if len(f.confs) < 2 {
+		log.Debugf("Only one WireGuard configuration, failover disabled.")
+		return
+	}
+
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		f.mu.Lock()
+		active := f.active
+		f.mu.Unlock()
+
+		if err := active.check(ctx, f.testURL); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			log.Warnf("Tunnel health check failed (%d/%d): %v", failures, healthCheckFailures, err)
+		} else {
+			failures = 0
+		}
+		if failures < healthCheckFailures {
+			continue
+		}
+
+		log.Warnf("Active WireGuard configuration is unhealthy, failing over.")
+		if err := f.switchOver(ctx); err != nil {
+			log.Errorf("No WireGuard configuration could be brought up, keeping the current one: %v", err)
+			continue
+		}
+		failures = 0
+	}
+}
+
+// switchOver tries the configurations following the active one in order, and
+// makes the first that comes up the active tunnel. The replaced tunnel is
+// left to drain.
+func (f *failover) switchOver(ctx context.Context) error {
+	f.mu.Lock()
+	index := f.index
+	f.mu.Unlock()
+
+	t, next, err := f.next(ctx, index+1, len(f.confs)-1)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		t.Close()
+		return errors.New("failover is closed")
+	}
+	old := f.active
+	f.active, f.index = t, next
+	f.draining[old] = struct{}{}
+	f.mu.Unlock()
+
+	log.Infof("Switched proxies to WireGuard configuration %d.", next+1)
+	go func() {
+		old.drain(tunnelDrainTimeout)
+		f.mu.Lock()
+		delete(f.draining, old)
+		f.mu.Unlock()
+	}()
+	return nil
+}
+
+// Close closes the active tunnel along with the replaced ones that are still
+// draining.
+func (f *failover) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	if f.active != nil {
+		f.active.Close()
+	}
+	for t := range f.draining {
+		t.Close()
+	}
+}
@@ -0,0 +1,118 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testFailover is a failover over n configurations whose tunnels are stubs.
+// Configurations listed in broken fail to come up.
+type testFailover struct {
+	*failover
+	broken  map[int]bool
+	started []int
+	tunnels map[*tunnel]int
+	closed  map[int]bool
+}
+
+func newTestFailover(n int) *testFailover {
+	tf := &testFailover{
+		broken:  make(map[int]bool),
+		tunnels: make(map[*tunnel]int),
+		closed:  make(map[int]bool),
+	}
+	confs := make([]*Configuration, n)
+	for i := range confs {
+		confs[i] = &Configuration{}
+	}
+	tf.failover = newFailover(confs, "", "")
+	tf.startTunnel = func(_ context.Context, conf *Configuration, _, _ string) (*tunnel, error) {
+		index := -1
+		for i, c := range confs {
+			if c == conf {
+				index = i
+			}
+		}
+		tf.started = append(tf.started, index)
+		if tf.broken[index] {
+			return nil, errors.New("broken")
+		}
+		t := &tunnel{idle: make(chan struct{}, 1)}
+		t.cancel = func() { tf.closed[index] = true }
+		tf.tunnels[t] = index
+		return t, nil
+	}
+	return tf
+}
+
+func (tf *testFailover) activeIndex() int {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	return tf.tunnels[tf.active]
+}
+
+func TestFailoverStart(t *testing.T) {
+	tf := newTestFailover(3)
+	tf.broken[0] = true
+	if err := tf.start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := tf.activeIndex(); got != 1 {
+		t.Fatalf("started configuration %d, want 1", got)
+	}
+
+	tf = newTestFailover(2)
+	tf.broken[0], tf.broken[1] = true, true
+	if err := tf.start(context.Background()); err == nil {
+		t.Fatal("start succeeded with every configuration broken")
+	}
+	if want := []int{0, 1}; !reflect.DeepEqual(tf.started, want) {
+		t.Fatalf("tried configurations %v, want %v", tf.started, want)
+	}
+}
+
+func TestFailoverSwitchOver(t *testing.T) {
+	tf := newTestFailover(3)
+	if err := tf.start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// A connection picked before the switch keeps the replaced tunnel
+	// draining.
+	first := tf.pick(nil)
+	if first != tf.active || first.active.Load() != 1 {
+		t.Fatal("pick did not hold a reference on the active tunnel")
+	}
+
+	// The configurations after the active one are tried in order.
+	tf.broken[1] = true
+	if err := tf.switchOver(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := tf.activeIndex(); got != 2 {
+		t.Fatalf("switched to configuration %d, want 2", got)
+	}
+	if tf.closed[0] {
+		t.Fatal("replaced tunnel closed while a connection uses it")
+	}
+
+	// The active configuration is never started a second time.
+	tf.broken[0] = true
+	tf.started = nil
+	if err := tf.switchOver(context.Background()); err == nil {
+		t.Fatal("switched over with every other configuration broken")
+	}
+	if want := []int{0, 1}; !reflect.DeepEqual(tf.started, want) {
+		t.Fatalf("tried configurations %v, want %v", tf.started, want)
+	}
+	if got := tf.activeIndex(); got != 2 {
+		t.Fatalf("active configuration changed to %d", got)
+	}
+
+	// Close takes the draining tunnel down along with the active one.
+	tf.Close()
+	if !tf.closed[0] || !tf.closed[2] {
+		t.Fatalf("closed tunnels %v, want 0 and 2", tf.closed)
+	}
+}
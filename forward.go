@@ -0,0 +1,68 @@
+package wiresocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/shahradelahi/wiresocks/log"
+	"github.com/shahradelahi/wiresocks/proxy/statute"
+)
+
+// ForwardOptions forwards the TCP connections accepted on Listen to Target,
+// like `ssh -L`. They are routed like proxied connections, so Target is
+// normally a host reachable through the tunnel.
+type ForwardOptions struct {
+	Listen netip.AddrPort
+	// Target is the host:port connections are forwarded to.
+	Target string
+}
+
+func (o ForwardOptions) String() string {
+	return o.Listen.String() + " -> " + o.Target
+}
+
+// ParseForwardOptions parses a forward from its listen address, addr:port,
+// and its target, host:port.
+func ParseForwardOptions(listen, target string) (ForwardOptions, error) {
+	addr, err := netip.ParseAddrPort(strings.TrimSpace(listen))
+	if err != nil {
+		return ForwardOptions{}, fmt.Errorf("invalid forward listen address: %w", err)
+	}
+	target = strings.TrimSpace(target)
+	if host, port, err := net.SplitHostPort(target); err != nil || host == "" || port == "" {
+		return ForwardOptions{}, fmt.Errorf("invalid forward target %q, expected host:port", target)
+	}
+	return ForwardOptions{Listen: addr, Target: target}, nil
+}
+
+func (s *ProxyServer) serveForward(ln net.Listener, opts ForwardOptions) {
+	log.Debugf("Starting port forward %s.", opts.String())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Errorf("Port forward %s stopped with error: %v", opts.String(), err)
+			} else {
+				log.Debugf("Port forward listener on %s closed.", opts.Listen)
+			}
+			return
+		}
+
+		go func() {
+			log.Debugf("Forwarding connection from %s to %s", conn.RemoteAddr(), opts.Target)
+			err := s.vt.handler(&statute.ProxyRequest{
+				Conn:        conn,
+				Reader:      conn,
+				Writer:      conn,
+				Network:     "tcp",
+				Destination: opts.Target,
+			})
+			if err != nil {
+				_ = conn.Close()
+			}
+		}()
+	}
+}
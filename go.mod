@@ -7,8 +7,12 @@ toolchain go1.24.6
 require (
 	github.com/amnezia-vpn/amneziawg-go v0.2.13
 	github.com/go-ini/ini v1.67.0
+	github.com/makiuchi-d/gozxing v0.1.1
 	github.com/sagernet/sing v0.7.5
+	golang.org/x/crypto v0.41.0
+	golang.org/x/net v0.43.0
 	golang.org/x/sys v0.35.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require go.uber.org/atomic v1.11.0
@@ -16,9 +20,9 @@ require go.uber.org/atomic v1.11.0
 require (
 	github.com/google/btree v1.1.3 // indirect
 	github.com/tevino/abool v1.2.0 // indirect
-	golang.org/x/crypto v0.41.0 // indirect
-	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
 	golang.org/x/time v0.12.0 // indirect
+	golang.org/x/xerrors v0.0.0-20220907171357-04be3eba64a2 // indirect
 	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
 	gvisor.dev/gvisor v0.0.0-20250503011706-39ed1f5ac29c // indirect
 )
@@ -0,0 +1,97 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/shahradelahi/wiresocks/log"
+)
+
+// tunnelSpec describes one named tunnel managed by WireSocks: the WireGuard
+// configurations it may run with and the proxy listeners in front of it.
+type tunnelSpec struct {
+	name  string
+	confs []*Configuration // primary configuration first, then failovers
+	opts  *ProxyOptions
+	// balance, when set, runs all confs side by side and balances new
+	// connections over them instead of failing over in order.
+	balance BalanceStrategy
+}
+
+// instance is a started tunnelSpec.
+type instance struct {
+	spec  *tunnelSpec
+	group tunnelGroup
+	proxy *ProxyServer
+
+	cancel      context.CancelFunc
+	monitorDone chan struct{}
+}
+
+// startInstance brings up the tunnel described by spec and opens its proxy
+// listeners. The instance keeps running until ctx is done or stop is called.
+func startInstance(ctx context.Context, spec *tunnelSpec, dnsServer, testURL string) (*instance, error) {
+	log.Infof("Starting tunnel %q.", spec.name)
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	group, err := startGroup(ctx, spec, dnsServer, testURL)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("tunnel %q: failed to create WireGuard device: %w", spec.name, err)
+	}
+
+	// Tunnels used only through the Go API have no listeners.
+	var proxy *ProxyServer
+	if spec.opts.hasListeners() {
+		proxy = newProxyServer(group, spec.opts)
+		if err := proxy.Start(); err != nil {
+			cancel()
+			group.Close()
+			return nil, fmt.Errorf("tunnel %q: failed to start proxy server: %w", spec.name, err)
+		}
+	}
+
+	inst := &instance{
+		spec:        spec,
+		group:       group,
+		proxy:       proxy,
+		cancel:      cancel,
+		monitorDone: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(inst.monitorDone)
+		group.monitor(ctx)
+	}()
+
+	return inst, nil
+}
+
+// startGroup brings up the tunnels of spec.
+func startGroup(ctx context.Context, spec *tunnelSpec, dnsServer, testURL string) (tunnelGroup, error) {
+	if spec.balance != "" {
+		return newBalancer(ctx, spec.balance, spec.confs, dnsServer, testURL)
+	}
+
+	fo := newFailover(spec.confs, dnsServer, testURL)
+	if err := fo.start(ctx); err != nil {
+		return nil, err
+	}
+	return fo, nil
+}
+
+// stop closes the proxy listeners, lets in-flight connections finish until
+// ctx is done, and then closes the WireGuard device. It returns how many
+// connections were drained and how many were force-closed.
+func (i *instance) stop(ctx context.Context) (drained, killed int) {
+	log.Infof("Stopping tunnel %q.", i.spec.name)
+	if i.proxy != nil {
+		drained, killed = i.proxy.Shutdown(ctx)
+	}
+
+	i.cancel()
+	<-i.monitorDone
+	i.group.Close()
+	return drained, killed
+}
@@ -0,0 +1,108 @@
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by the service manager.
+const listenFdsStart = 3
+
+// Listeners returns the sockets passed by the service manager for socket
+// activation, keyed by the name set with FileDescriptorName=: the stream
+// sockets as listeners and the datagram sockets as packet connections.
+// Sockets without a name are keyed "unknown", like systemd does. It returns
+// nil maps when the process was not socket activated.
+//
+// The LISTEN_* variables are removed from the environment so that child
+// processes don't try to adopt the same sockets.
+func Listeners() (map[string][]net.Listener, map[string][]net.PacketConn, error) {
+	names, err := listenFds(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"))
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || len(names) == 0 {
+		return nil, nil, err
+	}
+
+	files := make([]*os.File, len(names))
+	for i, name := range names {
+		files[i] = os.NewFile(uintptr(listenFdsStart+i), name)
+	}
+	return sockets(names, files)
+}
+
+// sockets adopts files as listeners or packet connections keyed by the name
+// at the same index in names, and closes them.
+func sockets(names []string, files []*os.File) (map[string][]net.Listener, map[string][]net.PacketConn, error) {
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	listeners := make(map[string][]net.Listener)
+	packetConns := make(map[string][]net.PacketConn)
+	for i, f := range files {
+		name := names[i]
+		if ln, err := net.FileListener(f); err == nil {
+			listeners[name] = append(listeners[name], ln)
+			continue
+		}
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			for _, lns := range listeners {
+				for _, ln := range lns {
+					_ = ln.Close()
+				}
+			}
+			for _, pcs := range packetConns {
+				for _, pc := range pcs {
+					_ = pc.Close()
+				}
+			}
+			return nil, nil, fmt.Errorf("socket %q (fd %d) is neither a stream listener nor a datagram socket: %w", name, f.Fd(), err)
+		}
+		packetConns[name] = append(packetConns[name], pc)
+	}
+	return listeners, packetConns, nil
+}
+
+// listenFds returns the name of every socket passed by the service manager,
+// given the values of LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES.
+func listenFds(pid, fds, fdNames string) ([]string, error) {
+	if fds == "" {
+		return nil, nil
+	}
+	if pid != "" {
+		p, err := strconv.Atoi(pid)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LISTEN_PID: %w", err)
+		}
+		if p != os.Getpid() {
+			return nil, nil
+		}
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %w", err)
+	}
+	if n < 0 {
+		return nil, errors.New("invalid LISTEN_FDS: negative count")
+	}
+
+	names := make([]string, n)
+	given := strings.Split(fdNames, ":")
+	for i := range names {
+		names[i] = "unknown"
+		if fdNames != "" && i < len(given) && given[i] != "" {
+			names[i] = given[i]
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,75 @@
+// Package systemd implements the parts of the systemd service protocol that
+// wiresocks uses: readiness notification and the watchdog.
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// Ready tells the service manager that startup has finished.
+	Ready = "READY=1"
+	// Stopping tells the service manager that the service is shutting down.
+	Stopping = "STOPPING=1"
+	// Watchdog keeps the service manager's watchdog timer from expiring.
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status returns a STATUS= line describing the service state in free text.
+func Status(status string) string {
+	return "STATUS=" + status
+}
+
+// Notify sends state to the socket named by $NOTIFY_SOCKET. It reports false,
+// and does nothing, when the process was not started by a service manager
+// that listens for notifications.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+
+	// A leading @ names a socket in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the watchdog timeout the service manager expects
+// pings within, or zero when the watchdog is not enabled for this process.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" {
+		p, err := strconv.Atoi(pid)
+		if err != nil {
+			return 0, err
+		}
+		if p != os.Getpid() {
+			return 0, nil
+		}
+	}
+
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
@@ -0,0 +1,124 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	sent, err := Notify(Ready)
+	if err != nil || !sent {
+		t.Fatalf("Notify = %v, %v", sent, err)
+	}
+
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != Ready {
+		t.Errorf("received %q, want %q", got, Ready)
+	}
+}
+
+func TestNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	sent, err := Notify(Ready)
+	if err != nil || sent {
+		t.Fatalf("Notify = %v, %v", sent, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if d, err := WatchdogInterval(); err != nil || d != 30*time.Second {
+		t.Fatalf("WatchdogInterval = %v, %v", d, err)
+	}
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if d, err := WatchdogInterval(); err != nil || d != 0 {
+		t.Fatalf("WatchdogInterval for another pid = %v, %v", d, err)
+	}
+}
+
+func TestListenFds(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+
+	names, err := listenFds(pid, "3", "socks:http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"socks", "http", "unknown"}
+	if len(names) != len(want) {
+		t.Fatalf("got %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("name %d = %q, want %q", i, names[i], want[i])
+		}
+	}
+
+	if names, err := listenFds(strconv.Itoa(os.Getpid()+1), "2", ""); err != nil || names != nil {
+		t.Errorf("sockets for another pid = %v, %v", names, err)
+	}
+	if _, err := listenFds(pid, "two", ""); err == nil {
+		t.Error("expected an error for an invalid LISTEN_FDS")
+	}
+}
+
+func TestSockets(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	lnFile, err := ln.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcFile, err := pc.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners, packetConns, err := sockets([]string{"socks", "dns"}, []*os.File{lnFile, pcFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners["socks"]) != 1 || len(packetConns["dns"]) != 1 || len(listeners)+len(packetConns) != 2 {
+		t.Fatalf("got listeners %v and packet conns %v", listeners, packetConns)
+	}
+	defer listeners["socks"][0].Close()
+	defer packetConns["dns"][0].Close()
+	if got := packetConns["dns"][0].LocalAddr().String(); got != pc.LocalAddr().String() {
+		t.Errorf("packet conn on %s, want %s", got, pc.LocalAddr())
+	}
+
+	// A socket that is neither fails the activation.
+	f, err := os.CreateTemp(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sockets([]string{"file"}, []*os.File{f}); err == nil {
+		t.Error("adopted a regular file")
+	}
+}
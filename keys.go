@@ -0,0 +1,43 @@
+package wiresocks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// GeneratePrivateKey returns a new hex-encoded Curve25519 private key, clamped
+// the way WireGuard expects.
+func GeneratePrivateKey() (string, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", fmt.Errorf("failed to generate private key: %w", err)
+	}
+	key[0] &= 248
+	key[31] = (key[31] & 127) | 64
+	return hex.EncodeToString(key[:]), nil
+}
+
+// GeneratePresharedKey returns a new random hex-encoded preshared key.
+func GeneratePresharedKey() (string, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", fmt.Errorf("failed to generate preshared key: %w", err)
+	}
+	return hex.EncodeToString(key[:]), nil
+}
+
+// PublicKey returns the hex-encoded public key of a hex-encoded private key.
+func PublicKey(privateKey string) (string, error) {
+	key, err := hex.DecodeString(privateKey)
+	if err != nil || len(key) != 32 {
+		return "", fmt.Errorf("invalid private key")
+	}
+	pub, err := curve25519.X25519(key, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(pub), nil
+}
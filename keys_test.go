@@ -0,0 +1,35 @@
+package wiresocks
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestPublicKey(t *testing.T) {
+	// Test vector from RFC 7748, section 6.1.
+	pub, err := PublicKey("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub != "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a" {
+		t.Fatalf("unexpected public key: %s", pub)
+	}
+
+	if _, err := PublicKey("abcd"); err == nil {
+		t.Fatal("expected an error for a short key")
+	}
+}
+
+func TestGeneratePrivateKey(t *testing.T) {
+	key, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := hex.DecodeString(key)
+	if err != nil || len(b) != 32 {
+		t.Fatalf("invalid key %q", key)
+	}
+	if b[0]&7 != 0 || b[31]&128 != 0 || b[31]&64 == 0 {
+		t.Fatalf("key is not clamped: %s", key)
+	}
+}
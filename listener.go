@@ -0,0 +1,355 @@
+package wiresocks
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/shahradelahi/wiresocks/log"
+)
+
+// ListenerOptions describes one proxy listener. Exactly one of Address, Unix
+// and Listener is set.
+type ListenerOptions struct {
+	Address *netip.AddrPort
+	Unix    *UnixSocketOptions
+	// Listener is a pre-opened listener, such as a socket passed by systemd
+	// socket activation.
+	Listener net.Listener
+
+	// Username and Password, when set, are required from clients: through
+	// username/password authentication for SOCKS5, where SOCKS4 clients are
+	// refused, and through Basic Proxy-Authorization for HTTP.
+	Username string
+	Password string
+	// PasswordRef is the env:NAME or file:/path reference Password was read
+	// from, if any.
+	PasswordRef string
+	// Allow restricts TCP clients to the listed networks. Empty allows every
+	// client.
+	Allow []netip.Prefix
+}
+
+func (o ListenerOptions) String() string {
+	switch {
+	case o.Listener != nil:
+		return o.Listener.Addr().String()
+	case o.Unix != nil:
+		return o.Unix.String()
+	case o.Address != nil:
+		return o.Address.String()
+	default:
+		return "<none>"
+	}
+}
+
+// ParseListenerOptions parses a proxy listen address, either addr:port or a
+// unix: socket address, optionally followed by query parameters: user and
+// pass for the credentials, allow for comma-separated client networks, and
+// the Unix socket options of ParseUnixSocket, e.g.
+// "0.0.0.0:1080?user=me&pass=secret&allow=10.0.0.0/8,192.168.0.0/16".
+func ParseListenerOptions(addr string) (ListenerOptions, error) {
+	var opts ListenerOptions
+
+	address, query, _ := strings.Cut(addr, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return opts, fmt.Errorf("invalid options in %q: %w", addr, err)
+	}
+
+	unixParams := url.Values{}
+	for key, values := range params {
+		value := values[len(values)-1]
+		switch key {
+		case "user":
+			opts.Username = value
+		case "pass":
+			opts.Password = value
+		case "allow":
+			for _, v := range values {
+				for _, str := range strings.Split(v, ",") {
+					prefix, err := parsePrefix(strings.TrimSpace(str))
+					if err != nil {
+						return opts, fmt.Errorf("invalid allowed network %q: %w", str, err)
+					}
+					opts.Allow = append(opts.Allow, prefix)
+				}
+			}
+		default:
+			unixParams[key] = values
+		}
+	}
+	if (opts.Username == "") != (opts.Password == "") {
+		return opts, fmt.Errorf("%q: user and pass must be given together", addr)
+	}
+
+	if IsUnixSocketAddress(address) {
+		if len(unixParams) > 0 {
+			address += "?" + unixParams.Encode()
+		}
+		opts.Unix, err = ParseUnixSocket(address)
+		return opts, err
+	}
+
+	if len(unixParams) > 0 {
+		return opts, fmt.Errorf("unknown listener options in %q", addr)
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return opts, err
+	}
+	opts.Address = &addrPort
+	return opts, nil
+}
+
+// parsePrefix parses a CIDR prefix or a single IP address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	return netip.ParsePrefix(s)
+}
+
+// aclListener closes connections from clients outside of allow.
+type aclListener struct {
+	net.Listener
+	allow []netip.Prefix
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		log.Warnf("Refusing connection from %s, not in the allowed networks of %s.", conn.RemoteAddr(), l.Addr())
+		_ = conn.Close()
+	}
+}
+
+func (l *aclListener) allowed(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		// Unix socket clients are controlled by the socket permissions.
+		return true
+	}
+	ip, ok := netip.AddrFromSlice(tcp.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range l.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// unixScheme prefixes a listen address that names a Unix domain socket.
+const unixScheme = "unix:"
+
+// UnixSocketOptions describes a proxy listener on a Unix domain socket.
+// Access to the socket is controlled through its file permissions.
+type UnixSocketOptions struct {
+	Path string
+	// Mode is the permission of the socket file. Zero leaves the mode set by
+	// the umask.
+	Mode fs.FileMode
+	// Owner and Group name the user and group, by name or numeric ID, the
+	// socket file is handed to. Empty keeps the current one.
+	Owner string
+	Group string
+}
+
+func (o *UnixSocketOptions) String() string {
+	return unixScheme + o.Path
+}
+
+// address returns o in the form accepted by ParseUnixSocket, including the
+// socket options.
+func (o *UnixSocketOptions) address() string {
+	params := url.Values{}
+	if o.Mode != 0 {
+		params.Set("mode", fmt.Sprintf("%04o", uint32(o.Mode)))
+	}
+	if o.Owner != "" {
+		params.Set("owner", o.Owner)
+	}
+	if o.Group != "" {
+		params.Set("group", o.Group)
+	}
+	if len(params) == 0 {
+		return o.String()
+	}
+	return o.String() + "?" + params.Encode()
+}
+
+// IsUnixSocketAddress reports whether addr names a Unix domain socket.
+func IsUnixSocketAddress(addr string) bool {
+	return strings.HasPrefix(addr, unixScheme)
+}
+
+// ParseUnixSocket parses a Unix socket listen address of the form
+// "unix:/path/to.sock", optionally followed by the query parameters mode,
+// owner and group, e.g. "unix:/run/wiresocks.sock?mode=0660&group=proxy".
+func ParseUnixSocket(addr string) (*UnixSocketOptions, error) {
+	if !IsUnixSocketAddress(addr) {
+		return nil, fmt.Errorf("%q is not a unix: address", addr)
+	}
+
+	path, query, _ := strings.Cut(strings.TrimPrefix(addr, unixScheme), "?")
+	if path == "" {
+		return nil, fmt.Errorf("%q has no socket path", addr)
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options in %q: %w", addr, err)
+	}
+
+	opts := &UnixSocketOptions{Path: path}
+	for key, values := range params {
+		value := values[len(values)-1]
+		switch key {
+		case "mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 0o777 {
+				return nil, fmt.Errorf("invalid socket mode %q", value)
+			}
+			opts.Mode = fs.FileMode(mode)
+		case "owner":
+			opts.Owner = value
+		case "group":
+			opts.Group = value
+		default:
+			return nil, fmt.Errorf("unknown socket option %q", key)
+		}
+	}
+	return opts, nil
+}
+
+// listenUnix opens a listener on the socket described by o. A stale socket
+// file left behind by a previous run is removed first.
+func listenUnix(o *UnixSocketOptions) (net.Listener, error) {
+	if fi, err := os.Lstat(o.Path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", o.Path)
+		}
+		if err := os.Remove(o.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	// Bind the socket in a private directory and move it into place once its
+	// permissions are set, so no one can connect to it in between.
+	dir, err := os.MkdirTemp(filepath.Dir(o.Path), ".sock")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+
+	if err := o.applyPermissions(tmp); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, o.Path); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ln, path: o.Path}, nil
+}
+
+// unixListener is a listener on the socket file at path, which it removes
+// when closed. The socket was bound under another name.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if rerr := os.Remove(l.path); rerr != nil && !errors.Is(rerr, fs.ErrNotExist) && err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func (o *UnixSocketOptions) applyPermissions(path string) error {
+	if o.Mode != 0 {
+		if err := os.Chmod(path, o.Mode); err != nil {
+			return err
+		}
+	}
+
+	if o.Owner == "" && o.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if o.Owner != "" {
+		id, err := lookupID(o.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("unknown socket owner %q: %w", o.Owner, err)
+		}
+		uid = id
+	}
+	if o.Group != "" {
+		id, err := lookupID(o.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("unknown socket group %q: %w", o.Group, err)
+		}
+		gid = id
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// lookupID returns the numeric ID named by name, which is either a number or
+// a name resolved with lookup.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, errors.New("not a numeric ID: " + id)
+	}
+	return n, nil
+}
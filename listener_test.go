@@ -0,0 +1,117 @@
+package wiresocks
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseUnixSocket(t *testing.T) {
+	opts, err := ParseUnixSocket("unix:/run/wiresocks.sock?mode=0660&owner=1000&group=proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Path != "/run/wiresocks.sock" || opts.Mode != 0o660 || opts.Owner != "1000" || opts.Group != "proxy" {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+
+	for _, addr := range []string{"unix:", "unix:/a.sock?mode=999", "unix:/a.sock?color=red", "/a.sock"} {
+		if _, err := ParseUnixSocket(addr); err == nil {
+			t.Errorf("expected an error for %q", addr)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket file modes are not supported on Windows")
+	}
+
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	opts := &UnixSocketOptions{Path: path, Mode: 0o600}
+
+	ln, err := listenUnix(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&fs.ModeSocket == 0 || fi.Mode().Perm() != 0o600 {
+		t.Errorf("unexpected socket file mode: %v", fi.Mode())
+	}
+	if ln.Addr().String() != path {
+		t.Errorf("listener address = %s, want %s", ln.Addr(), path)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("unexpected files next to the socket: %v", entries)
+	}
+	_ = ln.Close()
+	if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("socket file not removed on close: %v", err)
+	}
+
+	// A stale socket from a previous run doesn't prevent listening again.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+	ln, err = listenUnix(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ln.Close()
+}
+
+func TestParseListenerOptions(t *testing.T) {
+	opts, err := ParseListenerOptions("0.0.0.0:1080?user=me&pass=secret&allow=10.0.0.0/8,192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.String() != "0.0.0.0:1080" || opts.Username != "me" || opts.Password != "secret" {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+	if len(opts.Allow) != 2 || opts.Allow[1].String() != "192.168.1.1/32" {
+		t.Fatalf("unexpected allowed networks: %v", opts.Allow)
+	}
+
+	opts, err = ParseListenerOptions("unix:/run/wiresocks.sock?mode=0600&user=me&pass=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Unix == nil || opts.Unix.Mode != 0o600 || opts.Username != "me" {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+
+	for _, addr := range []string{"127.0.0.1:1080?user=me", "127.0.0.1:1080?mode=0600", "127.0.0.1:1080?allow=nope", "localhost"} {
+		if _, err := ParseListenerOptions(addr); err == nil {
+			t.Errorf("expected an error for %q", addr)
+		}
+	}
+}
+
+func TestACLListener(t *testing.T) {
+	l := &aclListener{allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+
+	for addr, want := range map[string]bool{
+		"10.1.2.3:5000":          true,
+		"[::ffff:10.1.2.3]:5000": true,
+		"192.168.1.1:5000":       false,
+	} {
+		tcp := net.TCPAddrFromAddrPort(netip.MustParseAddrPort(addr))
+		if got := l.allowed(tcp); got != want {
+			t.Errorf("allowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if !l.allowed(&net.UnixAddr{Name: "@", Net: "unix"}) {
+		t.Error("Unix socket clients should not be filtered")
+	}
+}
@@ -3,15 +3,18 @@ package wiresocks
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/netip"
+	"strings"
+	"time"
 
 	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
-	"github.com/sagernet/sing/common/buf"
 
 	"github.com/shahradelahi/wiresocks/log"
 	"github.com/shahradelahi/wiresocks/proxy/http"
 	"github.com/shahradelahi/wiresocks/proxy/socks"
+	"github.com/shahradelahi/wiresocks/proxy/socks/socks5"
 	"github.com/shahradelahi/wiresocks/proxy/statute"
 )
 
@@ -19,25 +22,172 @@ import (
 type ProxyOptions struct {
 	SocksBindAddress *netip.AddrPort
 	HttpBindAddress  *netip.AddrPort
+
+	// SocksUnixSocket and HttpUnixSocket bind the proxies to Unix domain
+	// sockets. They take the place of the corresponding bind address.
+	SocksUnixSocket *UnixSocketOptions
+	HttpUnixSocket  *UnixSocketOptions
+
+	// SocksListener and HttpListener are pre-opened listeners, such as the
+	// sockets passed by systemd socket activation. When set they are used
+	// instead of binding the corresponding address.
+	SocksListener net.Listener
+	HttpListener  net.Listener
+
+	// Socks and HTTP list further listeners of each proxy, each with its own
+	// credentials and allowed clients. All of them share the same tunnel.
+	Socks []ListenerOptions
+	HTTP  []ListenerOptions
+
+	// Forward lists ports forwarded to fixed destinations.
+	Forward []ForwardOptions
+
+	// Routes decide, in order, how each proxied connection is carried.
+	// DefaultRoute applies when none of them matches and defaults to
+	// RouteTunnel.
+	Routes       []RouteRule
+	DefaultRoute RouteAction
+
+	// Chains are the upstream proxy chains named by RouteChain rules.
+	Chains []Chain
+
+	// Fallback, when set, dials the connections routed through the tunnel
+	// directly while the tunnel is down.
+	Fallback *FallbackOptions
+
+	// Timeouts bound the stages of the proxied connections.
+	Timeouts TimeoutOptions
+
+	// Resolver is the DNS server used to resolve the endpoint hostnames of
+	// the tunnel. Empty uses the default resolver.
+	Resolver string
+}
+
+// Default timeouts of proxied connections.
+const (
+	DefaultHandshakeTimeout = 30 * time.Second
+	DefaultDialTimeout      = 30 * time.Second
+	DefaultIdleTimeout      = time.Hour
+)
+
+// TimeoutOptions bounds the stages of proxied connections. A zero value
+// takes the default and a negative value disables the timeout.
+type TimeoutOptions struct {
+	// Handshake bounds the negotiation with the client, up to its request.
+	Handshake time.Duration
+	// Dial bounds the connection to the destination, through the tunnel or
+	// a chain.
+	Dial time.Duration
+	// Idle closes TCP connections that carried no data either way for this
+	// long.
+	Idle time.Duration
+	// Lifetime closes connections open for this long. There is no limit by
+	// default.
+	Lifetime time.Duration
+}
+
+// effective returns o with the defaults applied and the disabled timeouts
+// set to zero.
+func (o TimeoutOptions) effective() TimeoutOptions {
+	pick := func(d, def time.Duration) time.Duration {
+		switch {
+		case d == 0:
+			return def
+		case d < 0:
+			return 0
+		default:
+			return d
+		}
+	}
+	return TimeoutOptions{
+		Handshake: pick(o.Handshake, DefaultHandshakeTimeout),
+		Dial:      pick(o.Dial, DefaultDialTimeout),
+		Idle:      pick(o.Idle, DefaultIdleTimeout),
+		Lifetime:  pick(o.Lifetime, 0),
+	}
+}
+
+// ParseTimeout parses a timeout of TimeoutOptions: a duration such as "90s",
+// or "off" to disable it.
+func ParseTimeout(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if strings.EqualFold(s, "off") {
+		return -1, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q, expected a duration such as 90s or off", s)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid timeout %q, durations cannot be negative", s)
+	}
+	return d, nil
+}
+
+// formatTimeout formats a timeout the way ParseTimeout reads it, or returns
+// "" for the default.
+func formatTimeout(d time.Duration) string {
+	switch {
+	case d == 0:
+		return ""
+	case d < 0:
+		return "off"
+	default:
+		return d.String()
+	}
+}
+
+// socksListeners returns every SOCKS listener of o.
+func (o *ProxyOptions) socksListeners() []ListenerOptions {
+	return withListener(o.Socks, o.SocksListener, o.SocksUnixSocket, o.SocksBindAddress)
+}
+
+// httpListeners returns every HTTP listener of o.
+func (o *ProxyOptions) httpListeners() []ListenerOptions {
+	return withListener(o.HTTP, o.HttpListener, o.HttpUnixSocket, o.HttpBindAddress)
+}
+
+// withListener prepends the listener given by the single-listener fields of
+// ProxyOptions, if any, to list.
+func withListener(list []ListenerOptions, pre net.Listener, unix *UnixSocketOptions, addr *netip.AddrPort) []ListenerOptions {
+	var first ListenerOptions
+	switch {
+	case pre != nil:
+		first.Listener = pre
+	case unix != nil:
+		first.Unix = unix
+	case addr != nil:
+		first.Address = addr
+	default:
+		return list
+	}
+	return append([]ListenerOptions{first}, list...)
+}
+
+func (o *ProxyOptions) hasListeners() bool {
+	return o != nil && (len(o.socksListeners()) > 0 || len(o.httpListeners()) > 0 || len(o.Forward) > 0)
 }
 
 // ProxyServer is a struct that manages the proxy servers.
 type ProxyServer struct {
-	opts    *ProxyOptions
-	tnet    *netstack.Net
-	ctx     context.Context
-	cancel  context.CancelFunc
-	vt      *virtualTun
-	httpLn  net.Listener
-	socksLn net.Listener
+	opts      *ProxyOptions
+	group     tunnelGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+	vt        *virtualTun
+	listeners []net.Listener
 }
 
 // NewProxyServer creates a new ProxyServer.
 func NewProxyServer(tnet *netstack.Net, opts *ProxyOptions) *ProxyServer {
+	return newProxyServer(&staticGroup{t: &tunnel{tnet: tnet, idle: make(chan struct{}, 1)}}, opts)
+}
+
+func newProxyServer(group tunnelGroup, opts *ProxyOptions) *ProxyServer {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &ProxyServer{
 		opts:   opts,
-		tnet:   tnet,
+		group:  group,
 		ctx:    ctx,
 		cancel: cancel,
 	}
@@ -45,81 +195,155 @@ func NewProxyServer(tnet *netstack.Net, opts *ProxyOptions) *ProxyServer {
 
 // Start starts the proxy servers.
 func (s *ProxyServer) Start() error {
-	s.vt = &virtualTun{
-		Tnet: s.tnet,
-		Dev:  nil,
-		Ctx:  s.ctx,
-		pool: buf.DefaultAllocator,
+	if err := checkChains(s.opts.Chains, s.opts.Routes, s.opts.DefaultRoute); err != nil {
+		return err
 	}
+	fb, err := newFallback(s.opts.Fallback)
+	if err != nil {
+		return err
+	}
+	s.vt = newVirtualTun(s.ctx, s.group)
+	s.vt.routes = newRouter(s.opts.Routes, s.opts.DefaultRoute, s.opts.Chains)
+	s.vt.fallback = fb
+	s.vt.timeouts = s.opts.Timeouts.effective()
 
-	if s.opts.SocksBindAddress != nil {
-		log.Debugf("Attempting to listen on SOCKS address: %s", s.opts.SocksBindAddress.String())
-		ln, err := net.Listen("tcp", s.opts.SocksBindAddress.String())
-		if err != nil {
-			log.Errorf("Failed to listen on SOCKS address %s: %v", s.opts.SocksBindAddress.String(), err)
-			return err
-		}
-		s.socksLn = ln
-		log.Infof("SOCKS proxy listener started on %s", s.socksLn.Addr().String())
+	type server struct {
+		ln    net.Listener
+		opts  ListenerOptions
+		serve func(net.Listener, ListenerOptions)
 	}
+	var servers []server
 
-	if s.opts.HttpBindAddress != nil {
-		log.Debugf("Attempting to listen on HTTP address: %s", s.opts.HttpBindAddress.String())
-		ln, err := net.Listen("tcp", s.opts.HttpBindAddress.String())
-		if err != nil {
-			log.Errorf("Failed to listen on HTTP address %s: %v", s.opts.HttpBindAddress.String(), err)
-			if s.socksLn != nil {
-				log.Warnf("Closing SOCKS listener due to HTTP listener failure.")
-				_ = s.socksLn.Close()
+	open := func(proxy string, list []ListenerOptions, serve func(net.Listener, ListenerOptions)) error {
+		for _, opts := range list {
+			ln, err := openListener(proxy, opts)
+			if err != nil {
+				return err
 			}
-			return err
+			s.listeners = append(s.listeners, ln)
+			servers = append(servers, server{ln: ln, opts: opts, serve: serve})
 		}
-		s.httpLn = ln
-		log.Infof("HTTP proxy listener started on %s", s.httpLn.Addr().String())
+		return nil
 	}
 
-	if s.socksLn == nil && s.httpLn == nil {
-		return errors.New("no proxy listeners configured")
+	err = open("socks", s.opts.socksListeners(), s.serveSocks)
+	if err == nil {
+		err = open("http", s.opts.httpListeners(), s.serveHTTP)
 	}
-
-	if s.socksLn != nil {
-		go s.startSocksProxy()
+	for _, fwd := range s.opts.Forward {
+		if err != nil {
+			break
+		}
+		err = open("forward", []ListenerOptions{{Address: &fwd.Listen}}, func(ln net.Listener, _ ListenerOptions) {
+			s.serveForward(ln, fwd)
+		})
+	}
+	if err != nil {
+		if len(s.listeners) > 0 {
+			log.Warnf("Closing the proxy listeners opened so far due to a listener failure.")
+			s.closeListeners()
+		}
+		return err
 	}
 
-	if s.httpLn != nil {
-		go s.startHttpProxy()
+	if len(servers) == 0 {
+		return errors.New("no proxy listeners configured")
 	}
 
-	go func() {
-		<-s.ctx.Done()
-		log.Infof("ProxyServer context cancelled, stopping virtual tunnel.")
-		s.vt.Stop()
-	}()
+	for _, srv := range servers {
+		ln := srv.ln
+		if len(srv.opts.Allow) > 0 {
+			ln = &aclListener{Listener: ln, allow: srv.opts.Allow}
+		}
+		go srv.serve(ln, srv.opts)
+	}
 
 	log.Debugf("Proxy servers started successfully.")
 	return nil
 }
 
-// Stop stops the proxy servers.
+// openListener returns the listener described by opts: the pre-opened
+// listener, or a new listener on its Unix socket or address.
+func openListener(proxy string, opts ListenerOptions) (net.Listener, error) {
+	name := strings.ToUpper(proxy)
+	switch {
+	case opts.Listener != nil:
+		log.Infof("%s proxy listener adopted on %s", name, opts.Listener.Addr().String())
+		return opts.Listener, nil
+	case opts.Unix != nil:
+		log.Debugf("Attempting to listen on %s socket: %s", name, opts.Unix.Path)
+		ln, err := listenUnix(opts.Unix)
+		if err != nil {
+			log.Errorf("Failed to listen on %s socket %s: %v", name, opts.Unix.Path, err)
+			return nil, &ListenerError{Proxy: proxy, Addr: opts.Unix.String(), Err: err}
+		}
+		log.Infof("%s proxy listener started on %s", name, opts.Unix.String())
+		return ln, nil
+	case opts.Address != nil:
+		log.Debugf("Attempting to listen on %s address: %s", name, opts.Address.String())
+		ln, err := net.Listen("tcp", opts.Address.String())
+		if err != nil {
+			log.Errorf("Failed to listen on %s address %s: %v", name, opts.Address.String(), err)
+			return nil, &ListenerError{Proxy: proxy, Addr: opts.Address.String(), Err: err}
+		}
+		log.Infof("%s proxy listener started on %s", name, ln.Addr().String())
+		return ln, nil
+	default:
+		return nil, &ListenerError{Proxy: proxy, Addr: opts.String(), Err: errors.New("no address given")}
+	}
+}
+
+func (s *ProxyServer) closeListeners() {
+	for _, ln := range s.listeners {
+		log.Debugf("Closing proxy listener on %s.", ln.Addr())
+		_ = ln.Close()
+	}
+}
+
+// Stop stops the proxy servers and closes every connection right away.
 func (s *ProxyServer) Stop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
+}
+
+// Shutdown stops the proxy servers in two phases. The listeners are closed
+// first, so no new connection is accepted, and in-flight connections are then
+// given until ctx is done to finish. Connections still open at that point are
+// force-closed. Shutdown returns how many connections finished on their own
+// and how many had to be closed.
+func (s *ProxyServer) Shutdown(ctx context.Context) (drained, killed int) {
 	log.Infof("Stopping proxy servers...")
-	s.cancel()
-	if s.httpLn != nil {
-		log.Debugf("Closing HTTP listener.")
-		_ = s.httpLn.Close()
+	s.closeListeners()
+
+	if s.vt == nil {
+		s.cancel()
+		return 0, 0
 	}
-	if s.socksLn != nil {
-		log.Debugf("Closing SOCKS listener.")
-		_ = s.socksLn.Close()
+
+	finished := s.vt.finished.Load()
+	if inFlight := s.vt.active.Load(); inFlight > 0 && ctx.Err() == nil {
+		log.Infof("Waiting for %d proxy connection(s) to finish.", inFlight)
 	}
-	log.Infof("Proxy servers stopped.")
+	s.vt.wait(ctx)
+
+	s.cancel()
+	// Force-closed connections unblock right away; wait for their handlers so
+	// that nothing is left using the tunnel once Shutdown returns.
+	s.vt.wait(context.Background())
+
+	drained = int(s.vt.finished.Load() - finished)
+	killed = int(s.vt.killed.Load())
+	log.Infof("Proxy servers stopped: %d connection(s) drained, %d force-closed.", drained, killed)
+	return drained, killed
 }
 
-func (s *ProxyServer) startSocksProxy() {
-	log.Debugf("Starting SOCKS proxy handler.")
-	proxy := socks.NewServer(
-		socks.WithListener(s.socksLn),
+func (s *ProxyServer) serveSocks(ln net.Listener, opts ListenerOptions) {
+	log.Debugf("Starting SOCKS proxy handler on %s.", ln.Addr())
+	options := []socks.Option{
+		socks.WithListener(ln),
 		socks.WithContext(s.ctx),
+		socks.WithHandshakeTimeout(s.vt.timeouts.Handshake),
 		socks.WithConnectHandler(func(request *statute.ProxyRequest) error {
 			log.Debugf("SOCKS Connect request for %s://%s", request.Network, request.Destination)
 			return s.vt.handler(request)
@@ -128,7 +352,11 @@ func (s *ProxyServer) startSocksProxy() {
 			log.Debugf("SOCKS Associate request for %s://%s", request.Network, request.Destination)
 			return s.vt.handler(request)
 		}),
-	)
+	}
+	if opts.Username != "" {
+		options = append(options, socks.WithCredentials(socks5.StaticCredentials{opts.Username: opts.Password}))
+	}
+	proxy := socks.NewServer(options...)
 
 	err := proxy.ListenAndServe()
 	if err != nil && !errors.Is(err, net.ErrClosed) {
@@ -138,16 +366,21 @@ func (s *ProxyServer) startSocksProxy() {
 	}
 }
 
-func (s *ProxyServer) startHttpProxy() {
-	log.Debugf("Starting HTTP proxy handler.")
-	proxy := http.NewServer(
+func (s *ProxyServer) serveHTTP(ln net.Listener, opts ListenerOptions) {
+	log.Debugf("Starting HTTP proxy handler on %s.", ln.Addr())
+	options := []http.ServerOption{
 		http.WithContext(s.ctx),
+		http.WithHandshakeTimeout(s.vt.timeouts.Handshake),
 		http.WithConnectHandle(func(request *statute.ProxyRequest) error {
 			log.Debugf("HTTP Connect request for %s://%s", request.Network, request.Destination)
 			return s.vt.handler(request)
 		}),
-	)
-	proxy.Listener = s.httpLn
+	}
+	if opts.Username != "" {
+		options = append(options, http.WithCredentials(socks5.StaticCredentials{opts.Username: opts.Password}))
+	}
+	proxy := http.NewServer(options...)
+	proxy.Listener = ln
 
 	err := proxy.ListenAndServe()
 	if err != nil && !errors.Is(err, net.ErrClosed) {
@@ -0,0 +1,64 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Connect asks the HTTP proxy on conn to open a tunnel to addr, given as
+// host:port, with the CONNECT method, sending Basic credentials when
+// username is set. It returns the connection carrying the tunnel, which
+// replaces conn.
+func Connect(conn net.Conn, addr, username, password string) (net.Conn, error) {
+	var b bytes.Buffer
+	_, _ = fmt.Fprintf(&b, "CONNECT %s HTTP/1.1%sHost: %s%s", addr, CRLF, addr, CRLF)
+	if username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		_, _ = fmt.Fprintf(&b, "%s: Basic %s%s", proxyAuthorizationHeader, creds, CRLF)
+	}
+	b.WriteString(CRLF)
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT failed: %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The target spoke first; keep what was read along with the reply.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were read ahead.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// CloseWrite shuts down the writing side of the connection, when it can be.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
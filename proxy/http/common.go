@@ -2,6 +2,7 @@ package http
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -69,6 +70,14 @@ type customConn struct {
 	once        sync.Once
 }
 
+// CloseWrite shuts down the writing side of the connection, when it can be.
+func (c *customConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
 func (c *customConn) Read(p []byte) (n int, err error) {
 	c.once.Do(func() {
 		buf := &bytes.Buffer{}
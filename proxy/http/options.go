@@ -2,6 +2,7 @@ package http
 
 import (
 	"context"
+	"time"
 
 	"github.com/shahradelahi/wiresocks/proxy/statute"
 )
@@ -14,6 +15,12 @@ func WithBind(bindAddress string) ServerOption {
 	}
 }
 
+func WithHandshakeTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.HandshakeTimeout = timeout
+	}
+}
+
 func WithConnectHandle(handler statute.UserConnectHandler) ServerOption {
 	return func(s *Server) {
 		s.UserConnectHandle = handler
@@ -37,3 +44,11 @@ func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 		s.BytesPool = bytesPool
 	}
 }
+
+// WithCredentials requires clients to authenticate with Basic
+// Proxy-Authorization.
+func WithCredentials(creds CredentialStore) ServerOption {
+	return func(s *Server) {
+		s.Credentials = creds
+	}
+}
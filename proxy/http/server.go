@@ -3,12 +3,14 @@ package http
 import (
 	"bufio"
 	"context"
+	"encoding/base64"
 	"errors"
 	"io"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/shahradelahi/wiresocks/log"
 	"github.com/shahradelahi/wiresocks/proxy/statute"
@@ -20,9 +22,10 @@ const (
 	defaultHTTPSPort = "443"
 
 	// HTTP headers
-	connectionHeader      = "Connection"
-	upgradeHeader         = "Upgrade"
-	capsuleProtocolHeader = "Capsule-Protocol"
+	connectionHeader         = "Connection"
+	upgradeHeader            = "Upgrade"
+	capsuleProtocolHeader    = "Capsule-Protocol"
+	proxyAuthorizationHeader = "Proxy-Authorization"
 
 	// HTTP header values
 	connectIP = "connect-ip"
@@ -30,7 +33,10 @@ const (
 
 	// HTTP responses
 	httpConnectionEstablished = "HTTP/1.1 200 Connection Established" + CRLF + CRLF
-	httpSwitchingProtocols    = "HTTP/1.1 101 Switching Protocols" + CRLF +
+	httpProxyAuthRequired     = "HTTP/1.1 407 Proxy Authentication Required" + CRLF +
+		"Proxy-Authenticate: Basic realm=\"wiresocks\"" + CRLF +
+		"Content-Length: 0" + CRLF + CRLF
+	httpSwitchingProtocols = "HTTP/1.1 101 Switching Protocols" + CRLF +
 		"Connection: Upgrade" + CRLF +
 		"Upgrade: connect-ip" + CRLF +
 		"Capsule-Protocol: ?1" + CRLF + CRLF
@@ -51,6 +57,17 @@ type Server struct {
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool statute.BytesPool
+	// HandshakeTimeout, when set, bounds the reading and authentication of
+	// the request
+	HandshakeTimeout time.Duration
+	// Credentials, when set, are required from clients through the
+	// Proxy-Authorization header
+	Credentials CredentialStore
+}
+
+// CredentialStore is an interface for validating user credentials.
+type CredentialStore interface {
+	Valid(user, password string) bool
 }
 
 func NewServer(options ...ServerOption) *Server {
@@ -77,7 +94,7 @@ func (s *Server) ListenAndServe() error {
 		s.Listener = ln
 	}
 
-	s.Bind = s.Listener.Addr().(*net.TCPAddr).String()
+	s.Bind = s.Listener.Addr().String()
 
 	// ensure listener will be closed
 	defer func() {
@@ -99,6 +116,9 @@ func (s *Server) ListenAndServe() error {
 		default:
 			conn, err := s.Listener.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return err
+				}
 				log.Errorf("Failed to accept incoming HTTP connection: %v", err)
 				continue
 			}
@@ -121,6 +141,9 @@ func (s *Server) ListenAndServe() error {
 }
 
 func (s *Server) ServeConn(conn net.Conn) error {
+	if s.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
 	reader := bufio.NewReader(conn)
 	req, err := http.ReadRequest(reader)
 	if err != nil {
@@ -134,6 +157,15 @@ func (s *Server) ServeConn(conn net.Conn) error {
 
 	log.Debugf("Received HTTP request: Method=%s, Host=%s, URL=%s from %s", req.Method, req.Host, req.URL.String(), conn.RemoteAddr())
 
+	if s.Credentials != nil {
+		if err := s.authenticate(conn, req); err != nil {
+			return err
+		}
+	}
+	if s.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Time{})
+	}
+
 	// Handle IP proxying requests (RFC 9484)
 	if req.Method == http.MethodGet &&
 		strings.EqualFold(req.Header.Get(connectionHeader), upgrade) &&
@@ -147,6 +179,44 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	return s.handleHTTP(conn, req, req.Method == http.MethodConnect)
 }
 
+// authenticate checks the Basic credentials in the Proxy-Authorization header
+// and answers 407 when they are missing or invalid. The header is removed so
+// that it is not forwarded to the target.
+func (s *Server) authenticate(conn net.Conn, req *http.Request) error {
+	auth := req.Header.Get(proxyAuthorizationHeader)
+	req.Header.Del(proxyAuthorizationHeader)
+
+	user, password, ok := parseBasicAuth(auth)
+	if ok && s.Credentials.Valid(user, password) {
+		log.Debugf("User '%s' authenticated successfully from %s", user, conn.RemoteAddr())
+		return nil
+	}
+
+	if auth == "" {
+		log.Debugf("Missing proxy credentials from %s", conn.RemoteAddr())
+	} else {
+		log.Warnf("Invalid proxy credentials for user '%s' from %s", user, conn.RemoteAddr())
+	}
+	if _, err := conn.Write([]byte(httpProxyAuthRequired)); err != nil {
+		log.Errorf("Failed to write 407 Proxy Authentication Required to %s: %v", conn.RemoteAddr(), err)
+		return err
+	}
+	return errors.New("proxy authentication required")
+}
+
+// parseBasicAuth parses a Basic authorization header value.
+func parseBasicAuth(auth string) (user, password string, ok bool) {
+	scheme, encoded, found := strings.Cut(auth, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
 // handleIPProxy handles IP proxying over HTTP (RFC 9484).
 func (s *Server) handleIPProxy(conn net.Conn, req *http.Request) error {
 	// As per RFC 9484, the "Capsule-Protocol" header must be present.
@@ -183,13 +253,8 @@ func (s *Server) handleHTTP(conn net.Conn, req *http.Request, isConnectMethod bo
 		return s.embedHandleHTTP(conn, req, isConnectMethod)
 	}
 
-	if isConnectMethod {
-		log.Debugf("Sending 200 Connection Established for CONNECT method to %s", conn.RemoteAddr())
-		if _, err := conn.Write([]byte(httpConnectionEstablished)); err != nil {
-			log.Errorf("Failed to write 200 Connection Established to %s: %v", conn.RemoteAddr(), err)
-			return err
-		}
-	} else {
+	clientConn := conn
+	if !isConnectMethod {
 		// For non-CONNECT methods, we wrap the connection to prepend the request data.
 		log.Debugf("Wrapping connection for non-CONNECT method for %s", conn.RemoteAddr())
 		conn = &customConn{
@@ -207,6 +272,7 @@ func (s *Server) handleHTTP(conn net.Conn, req *http.Request, isConnectMethod bo
 		return err
 	}
 
+	replied := false
 	proxyReq := &statute.ProxyRequest{
 		Conn:        conn,
 		Reader:      io.Reader(conn),
@@ -215,10 +281,46 @@ func (s *Server) handleHTTP(conn net.Conn, req *http.Request, isConnectMethod bo
 		Destination: targetAddr,
 		DestHost:    host,
 		DestPort:    int32(portInt),
+		Reply: func(err error, _ net.Addr) error {
+			replied = true
+			if err != nil {
+				status := errToStatus(err)
+				log.Debugf("Sending %d to %s after failing to dial %s: %v", status, clientConn.RemoteAddr(), targetAddr, err)
+				http.Error(NewHTTPResponseWriter(clientConn), http.StatusText(status), status)
+				return nil
+			}
+			if isConnectMethod {
+				log.Debugf("Sending 200 Connection Established for CONNECT method to %s", clientConn.RemoteAddr())
+				if _, err := clientConn.Write([]byte(httpConnectionEstablished)); err != nil {
+					log.Errorf("Failed to write 200 Connection Established to %s: %v", clientConn.RemoteAddr(), err)
+					return err
+				}
+			}
+			return nil
+		},
 	}
 
 	log.Infof("Invoking user connect handler for %s to %s", conn.RemoteAddr(), targetAddr)
-	return s.UserConnectHandle(proxyReq)
+	err = s.UserConnectHandle(proxyReq)
+	if err != nil && !replied {
+		http.Error(NewHTTPResponseWriter(clientConn), http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	}
+	return err
+}
+
+// errToStatus maps the error of a dial to the status telling it: 504 when the
+// destination didn't answer in time, 403 when a rule refused it and 502
+// otherwise. The error itself stays in the log, the response only carries
+// the status text.
+func errToStatus(err error) int {
+	if errors.Is(err, statute.ErrRuleBlocked) {
+		return http.StatusForbidden
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() || strings.Contains(err.Error(), "timed out") {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
 }
 
 func (s *Server) embedHandleHTTP(conn net.Conn, req *http.Request, isConnectMethod bool) error {
@@ -227,11 +329,8 @@ func (s *Server) embedHandleHTTP(conn net.Conn, req *http.Request, isConnectMeth
 	target, err := s.ProxyDial(s.Context, "tcp", targetAddr)
 	if err != nil {
 		log.Errorf("Failed to dial target %s for %s: %v", targetAddr, conn.RemoteAddr(), err)
-		http.Error(
-			NewHTTPResponseWriter(conn),
-			err.Error(),
-			http.StatusServiceUnavailable,
-		)
+		status := errToStatus(err)
+		http.Error(NewHTTPResponseWriter(conn), http.StatusText(status), status)
 		return err
 	}
 	defer func() {
@@ -0,0 +1,33 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/shahradelahi/wiresocks/proxy/statute"
+)
+
+func TestErrToStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, http.StatusBadGateway},
+		{"unreachable", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ENETUNREACH}, http.StatusBadGateway},
+		{"deadline", fmt.Errorf("dial: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{"timeout", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, http.StatusGatewayTimeout},
+		{"timed out", errors.New("connect tcp 10.0.0.1:80: connection timed out"), http.StatusGatewayTimeout},
+		{"blocked", fmt.Errorf("example.com: %w", statute.ErrRuleBlocked), http.StatusForbidden},
+	} {
+		if got := errToStatus(tt.err); got != tt.want {
+			t.Errorf("%s: errToStatus(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
@@ -3,7 +3,9 @@ package socks
 import (
 	"context"
 	"net"
+	"time"
 
+	"github.com/shahradelahi/wiresocks/proxy/socks/socks5"
 	"github.com/shahradelahi/wiresocks/proxy/statute"
 )
 
@@ -74,3 +76,22 @@ func WithBytesPool(bytesPool statute.BytesPool) Option {
 		s.socks4Proxy.BytesPool = bytesPool
 	}
 }
+
+// WithHandshakeTimeout bounds the negotiation with each client, from the
+// first byte to the end of its request.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.handshakeTimeout = timeout
+		s.socks5Proxy.HandshakeTimeout = timeout
+		s.socks4Proxy.HandshakeTimeout = timeout
+	}
+}
+
+// WithCredentials requires SOCKS5 clients to authenticate with a username and
+// password. SOCKS4 clients are refused, as SOCKS4 has no way to authenticate.
+func WithCredentials(creds socks5.CredentialStore) Option {
+	return func(s *Server) {
+		s.credentials = creds
+		s.socks5Proxy.Credentials = creds
+	}
+}
@@ -3,8 +3,10 @@ package socks
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/shahradelahi/wiresocks/log"
 	"github.com/shahradelahi/wiresocks/proxy/socks/socks4"
@@ -27,8 +29,12 @@ type Server struct {
 	userAssociateHandle statute.UserAssociateHandler
 	// overwrite dial functions of http, socks4, socks5
 	userDialFunc statute.ProxyDialFunc
+	// credentials, when set, are required from every client
+	credentials socks5.CredentialStore
 	// ctx is default context
 	ctx context.Context
+	// handshakeTimeout, when set, bounds the negotiation with each client
+	handshakeTimeout time.Duration
 }
 
 func NewServer(options ...Option) *Server {
@@ -66,6 +72,14 @@ func (c *SwitchConn) Read(p []byte) (n int, err error) {
 	return c.Reader.Read(p)
 }
 
+// CloseWrite shuts down the writing side of the connection, when it can be.
+func (c *SwitchConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
 func (s *Server) ListenAndServe() error {
 	log.Debugf("SOCKS proxy server listening on %s", s.bind)
 
@@ -88,6 +102,9 @@ func (s *Server) ListenAndServe() error {
 		default:
 			conn, err := s.listener.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return err
+				}
 				log.Errorf("Failed to accept incoming SOCKS connection: %v", err)
 				continue
 			}
@@ -113,6 +130,10 @@ func (s *Server) handleConnection(conn net.Conn) error {
 	// Create a SwitchConn
 	switchConn := NewSwitchConn(conn)
 
+	if s.handshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	}
+
 	// Peek one byte to determine the protocol
 	buf, err := switchConn.Peek(1)
 	if err != nil {
@@ -126,6 +147,10 @@ func (s *Server) handleConnection(conn net.Conn) error {
 		err = s.socks5Proxy.ServeConn(switchConn)
 	case 4:
 		log.Debugf("Detected SOCKS4 protocol from %s", conn.RemoteAddr())
+		if s.credentials != nil {
+			log.Warnf("Refusing SOCKS4 connection from %s, authentication is required.", conn.RemoteAddr())
+			return fmt.Errorf("SOCKS4 is not allowed when authentication is required")
+		}
 		err = s.socks4Proxy.ServeConn(switchConn)
 	default:
 		log.Warnf("Unsupported SOCKS version %d from %s", buf[0], conn.RemoteAddr())
@@ -65,6 +65,16 @@ func (c Reply) String() string {
 	}
 }
 
+// errToReply maps the error of a dial to the reply code telling it. SOCKS4
+// has a single failure code, so refusals, timeouts and blocked rules all
+// reply RejectedReply.
+func errToReply(err error) Reply {
+	if err == nil {
+		return GrantedReply
+	}
+	return RejectedReply
+}
+
 // Address is a SOCKS-specific address.
 type Address struct {
 	// Name is the fully-qualified domain name.
@@ -0,0 +1,29 @@
+package socks4
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/shahradelahi/wiresocks/proxy/statute"
+)
+
+func TestErrToReply(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want Reply
+	}{
+		{"success", nil, GrantedReply},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, RejectedReply},
+		{"unreachable", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ENETUNREACH}, RejectedReply},
+		{"timeout", fmt.Errorf("dial: %w", context.DeadlineExceeded), RejectedReply},
+		{"blocked", fmt.Errorf("example.com: %w", statute.ErrRuleBlocked), RejectedReply},
+	} {
+		if got := errToReply(tt.err); got != tt.want {
+			t.Errorf("%s: errToReply(%v) = %s, want %s", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
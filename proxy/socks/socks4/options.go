@@ -2,6 +2,7 @@ package socks4
 
 import (
 	"context"
+	"time"
 
 	"github.com/shahradelahi/wiresocks/proxy/statute"
 )
@@ -45,6 +46,12 @@ func WithContext(ctx context.Context) ServerOption {
 }
 
 // WithBytesPool sets the bytes pool for the server
+func WithHandshakeTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.HandshakeTimeout = timeout
+	}
+}
+
 func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 	return func(s *Server) {
 		s.BytesPool = bytesPool
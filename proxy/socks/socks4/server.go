@@ -2,9 +2,11 @@ package socks4
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"github.com/shahradelahi/wiresocks/log"
 	"github.com/shahradelahi/wiresocks/proxy/statute"
@@ -27,6 +29,8 @@ type Server struct {
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool statute.BytesPool
+	// HandshakeTimeout, when set, bounds the reading of the request
+	HandshakeTimeout time.Duration
 }
 
 // NewServer creates a new SOCKS4 server
@@ -63,6 +67,9 @@ func (s *Server) ListenAndServe() error {
 		default:
 			conn, err := s.Listener.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return err
+				}
 				log.Errorf("Failed to accept SOCKS4 connection: %v", err)
 				continue
 			}
@@ -84,11 +91,17 @@ func (s *Server) ListenAndServe() error {
 // ServeConn handles a single SOCKS4 connection
 func (s *Server) ServeConn(conn net.Conn) error {
 	log.Debugf("Serving SOCKS4 connection from %s", conn.RemoteAddr())
+	if s.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
 	req, err := NewRequest(conn)
 	if err != nil {
 		log.Errorf("Failed to read SOCKS4 request from %s: %v", conn.RemoteAddr(), err)
 		return err
 	}
+	if s.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Time{})
+	}
 
 	log.Debugf("SOCKS4 request from %s: Command=%s, Destination=%s, User=%s", conn.RemoteAddr(), req.Command, req.DestAddr.String(), req.User)
 
@@ -108,7 +121,8 @@ func (s *Server) ServeConn(conn net.Conn) error {
 func (s *Server) handleConnect(conn net.Conn, req *Request) error {
 	if s.UserConnectHandle != nil {
 		log.Debugf("Invoking user connect handler for SOCKS4 CONNECT from %s to %s", conn.RemoteAddr(), req.DestAddr.String())
-		return s.UserConnectHandle(&statute.ProxyRequest{
+		replied := false
+		err := s.UserConnectHandle(&statute.ProxyRequest{
 			Conn:        conn,
 			Reader:      io.Reader(conn),
 			Writer:      io.Writer(conn),
@@ -116,7 +130,29 @@ func (s *Server) handleConnect(conn net.Conn, req *Request) error {
 			Destination: req.DestAddr.String(),
 			DestHost:    req.DestAddr.Name,
 			DestPort:    int32(req.DestAddr.Port),
+			Reply: func(err error, bound net.Addr) error {
+				replied = true
+				if err != nil {
+					code := errToReply(err)
+					log.Debugf("Sending SOCKS4 %s to %s", code, conn.RemoteAddr())
+					return WriteReply(conn, code, nil)
+				}
+				var bind *Address
+				if tcp, ok := bound.(*net.TCPAddr); ok {
+					bind = &Address{IP: tcp.IP, Port: tcp.Port}
+				}
+				log.Debugf("Sending SOCKS4 GrantedReply to %s", conn.RemoteAddr())
+				if err := WriteReply(conn, GrantedReply, bind); err != nil {
+					log.Errorf("Failed to write SOCKS4 GrantedReply to %s: %v", conn.RemoteAddr(), err)
+					return fmt.Errorf("failed to write reply: %v", err)
+				}
+				return nil
+			},
 		})
+		if err != nil && !replied {
+			_ = WriteReply(conn, errToReply(err), nil)
+		}
+		return err
 	}
 	log.Debugf("Using embedded connect handler for SOCKS4 CONNECT from %s to %s", conn.RemoteAddr(), req.DestAddr.String())
 	return s.embedHandleConnect(conn, req)
@@ -127,7 +163,7 @@ func (s *Server) embedHandleConnect(conn net.Conn, req *Request) error {
 	target, err := s.ProxyDial(s.Context, "tcp", req.DestAddr.String())
 	if err != nil {
 		log.Errorf("Failed to dial target %s for SOCKS4 CONNECT from %s: %v", req.DestAddr.String(), conn.RemoteAddr(), err)
-		if err := WriteReply(conn, RejectedReply, nil); err != nil {
+		if err := WriteReply(conn, errToReply(err), nil); err != nil {
 			log.Errorf("Failed to write SOCKS4 RejectedReply to %s: %v", conn.RemoteAddr(), err)
 		}
 		return fmt.Errorf("connect to %v failed: %w", req.DestAddr, err)
@@ -0,0 +1,213 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// ContextDialer dials the connection to a SOCKS5 proxy.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// clientHandshake authenticates with the SOCKS5 server on conn, with
+// username/password authentication when username is set, and sends the cmd
+// request for dst. It returns the address bound by the server.
+func clientHandshake(conn net.Conn, cmd Command, dst *address, username, password string) (*address, error) {
+	method := noAuth
+	if username != "" {
+		method = usernamePasswordAuth
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, byte(method)}); err != nil {
+		return nil, err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return nil, err
+	}
+	if resp[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported SOCKS version: %d", resp[0])
+	}
+	if authMethod(resp[1]) != method {
+		return nil, errNoSupportedAuth
+	}
+
+	if method == usernamePasswordAuth {
+		if len(username) > 255 || len(password) > 255 {
+			return nil, errStringTooLong
+		}
+		var b bytes.Buffer
+		b.WriteByte(1)
+		b.WriteByte(byte(len(username)))
+		b.WriteString(username)
+		b.WriteByte(byte(len(password)))
+		b.WriteString(password)
+		if _, err := conn.Write(b.Bytes()); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return nil, err
+		}
+		if resp[1] != 0 {
+			return nil, errors.New("invalid username or password")
+		}
+	}
+
+	var b bytes.Buffer
+	b.Write([]byte{socks5Version, byte(cmd), 0})
+	if err := writeAddr(&b, dst); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+
+	var header [3]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+	if code := reply(header[1]); code != successReply {
+		return nil, fmt.Errorf("%s failed: %s", cmd, code)
+	}
+	return readAddr(conn)
+}
+
+// Connect asks the SOCKS5 server on conn to connect to addr, given as
+// host:port, authenticating with username and password when username is
+// set. Once it returns, conn carries the connection to addr.
+func Connect(conn net.Conn, addr, username, password string) error {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	dst := &address{Name: host, Port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		dst = &address{IP: ip, Port: port}
+	}
+	_, err = clientHandshake(conn, ConnectCommand, dst, username, password)
+	return err
+}
+
+// UDPAssociation relays datagrams through a SOCKS5 proxy with the UDP
+// ASSOCIATE command of RFC 1928. It lasts as long as its control
+// connection.
+type UDPAssociation struct {
+	ctrl  net.Conn
+	udp   *net.UDPConn
+	relay netip.AddrPort
+	once  sync.Once
+
+	// readMu guards buf, the datagram buffer of ReadFrom.
+	readMu sync.Mutex
+	buf    []byte
+}
+
+// AssociateUDP asks the SOCKS5 proxy at proxyAddr, dialed with d, to relay
+// UDP datagrams, authenticating with username and password when username
+// is set. The datagrams are sent from a socket made with lc, or with the
+// zero ListenConfig when it is nil, on the local address of the connection
+// to the proxy.
+func AssociateUDP(ctx context.Context, d ContextDialer, lc *net.ListenConfig, proxyAddr, username, password string) (*UDPAssociation, error) {
+	ctrl, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = ctrl.SetDeadline(deadline)
+	}
+
+	bound, err := clientHandshake(ctrl, AssociateCommand, nil, username, password)
+	if err != nil {
+		_ = ctrl.Close()
+		return nil, err
+	}
+	_ = ctrl.SetDeadline(time.Time{})
+
+	// A server bound to the unspecified address relays on the address it
+	// was reached at.
+	relayIP, ok := netip.AddrFromSlice(bound.IP)
+	if !ok || relayIP.IsUnspecified() {
+		relayIP = ctrl.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()
+	}
+	relay := netip.AddrPortFrom(relayIP.Unmap(), uint16(bound.Port))
+
+	if lc == nil {
+		lc = &net.ListenConfig{}
+	}
+	local := ctrl.LocalAddr().(*net.TCPAddr).AddrPort().Addr()
+	pc, err := lc.ListenPacket(ctx, "udp", net.JoinHostPort(local.Unmap().String(), "0"))
+	if err != nil {
+		_ = ctrl.Close()
+		return nil, err
+	}
+
+	// The buffer holds the largest UDP datagram.
+	a := &UDPAssociation{ctrl: ctrl, udp: pc.(*net.UDPConn), relay: relay, buf: make([]byte, 0xffff)}
+	// The association ends with the control connection.
+	go func() {
+		_, _ = io.Copy(io.Discard, ctrl)
+		_ = a.Close()
+	}()
+	return a, nil
+}
+
+// WriteTo sends b to addr through the proxy.
+func (a *UDPAssociation) WriteTo(b []byte, addr netip.AddrPort) (int, error) {
+	var packet bytes.Buffer
+	packet.Write([]byte{0, 0, 0})
+	if err := writeAddr(&packet, &address{IP: addr.Addr().AsSlice(), Port: int(addr.Port())}); err != nil {
+		return 0, err
+	}
+	packet.Write(b)
+	if _, err := a.udp.WriteToUDPAddrPort(packet.Bytes(), a.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads a datagram relayed by the proxy into b and returns its
+// source. Fragmented datagrams and datagrams from elsewhere than the relay
+// are dropped.
+func (a *UDPAssociation) ReadFrom(b []byte) (int, netip.AddrPort, error) {
+	a.readMu.Lock()
+	defer a.readMu.Unlock()
+	buf := a.buf
+	for {
+		n, from, err := a.udp.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return 0, netip.AddrPort{}, err
+		}
+		if from.Addr().Unmap() != a.relay.Addr() || from.Port() != a.relay.Port() || n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		src, err := readAddr(r)
+		if err != nil {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(src.IP)
+		if !ok {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), netip.AddrPortFrom(ip.Unmap(), uint16(src.Port)), nil
+	}
+}
+
+// Close ends the association.
+func (a *UDPAssociation) Close() error {
+	var err error
+	a.once.Do(func() {
+		err = errors.Join(a.udp.Close(), a.ctrl.Close())
+	})
+	return err
+}
@@ -2,6 +2,7 @@ package socks5
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -10,6 +11,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+
+	"github.com/shahradelahi/wiresocks/proxy/statute"
 )
 
 var (
@@ -60,18 +63,31 @@ const (
 	addrTypeNotSupported reply = 0x08
 )
 
+// errToReply maps the error of a dial to the reply code telling it. The
+// errors of the host and of the tunnel's network stack only share their
+// messages.
 func errToReply(err error) reply {
 	if err == nil {
 		return successReply
 	}
+	if errors.Is(err, statute.ErrRuleBlocked) {
+		return ruleFailure
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return ttlExpired
+	}
 	msg := err.Error()
-	resp := hostUnreachable
-	if strings.Contains(msg, "refused") {
-		resp = connectionRefused
-	} else if strings.Contains(msg, "network is unreachable") {
-		resp = networkUnreachable
+	switch {
+	case strings.Contains(msg, "refused"):
+		return connectionRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return networkUnreachable
+	case strings.Contains(msg, "timed out"):
+		return ttlExpired
+	default:
+		return hostUnreachable
 	}
-	return resp
 }
 
 // reply is a SOCKS Command reply code.
@@ -0,0 +1,35 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/shahradelahi/wiresocks/proxy/statute"
+)
+
+func TestErrToReply(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want reply
+	}{
+		{"success", nil, successReply},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, connectionRefused},
+		{"refused by netstack", errors.New("connect tcp 10.0.0.1:80: connection was refused"), connectionRefused},
+		{"network unreachable", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ENETUNREACH}, networkUnreachable},
+		{"host unreachable", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.EHOSTUNREACH}, hostUnreachable},
+		{"deadline", fmt.Errorf("dial: %w", context.DeadlineExceeded), ttlExpired},
+		{"timeout", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, ttlExpired},
+		{"timed out", errors.New("connect tcp 10.0.0.1:80: connection timed out"), ttlExpired},
+		{"blocked", fmt.Errorf("example.com: %w", statute.ErrRuleBlocked), ruleFailure},
+	} {
+		if got := errToReply(tt.err); got != tt.want {
+			t.Errorf("%s: errToReply(%v) = %s, want %s", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package socks5
 
 import (
 	"context"
+	"time"
 
 	"github.com/shahradelahi/wiresocks/proxy/statute"
 )
@@ -44,6 +45,12 @@ func WithPacketForwardAddress(packetForwardAddress statute.PacketForwardAddress)
 	}
 }
 
+func WithHandshakeTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.HandshakeTimeout = timeout
+	}
+}
+
 func WithCredentials(creds CredentialStore) ServerOption {
 	return func(s *Server) {
 		s.Credentials = creds
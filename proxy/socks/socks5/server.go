@@ -3,9 +3,11 @@ package socks5
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"github.com/shahradelahi/wiresocks/log"
 	"github.com/shahradelahi/wiresocks/proxy/statute"
@@ -36,6 +38,9 @@ type Server struct {
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool statute.BytesPool
+	// HandshakeTimeout, when set, bounds the negotiation up to the end of
+	// the request
+	HandshakeTimeout time.Duration
 }
 
 func NewServer(options ...ServerOption) *Server {
@@ -77,6 +82,9 @@ func (s *Server) ListenAndServe() error {
 		default:
 			conn, err := s.Listener.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return err
+				}
 				log.Errorf("Failed to accept SOCKS5 connection: %v", err)
 				continue
 			}
@@ -100,6 +108,9 @@ func (s *Server) ListenAndServe() error {
 
 func (s *Server) ServeConn(conn net.Conn) error {
 	log.Debugf("Serving SOCKS5 connection from %s", conn.RemoteAddr())
+	if s.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
 	version, err := readByte(conn)
 	if err != nil {
 		log.Errorf("Failed to read SOCKS version from %s: %v", conn.RemoteAddr(), err)
@@ -149,8 +160,8 @@ func (s *Server) authenticate(conn net.Conn) error {
 		return s.handleUsernamePasswordAuth(conn)
 	}
 
-	// Fallback to no-auth
-	if bytes.IndexByte(methods, byte(noAuth)) != -1 {
+	// Fallback to no-auth, unless credentials are required
+	if s.Credentials == nil && bytes.IndexByte(methods, byte(noAuth)) != -1 {
 		log.Debugf("No authentication required selected for %s", conn.RemoteAddr())
 		_, err := conn.Write([]byte{socks5Version, byte(noAuth)})
 		return err
@@ -241,6 +252,9 @@ func (s *Server) handleRequest(conn net.Conn) error {
 	}
 	req.DestinationAddr = dest
 	log.Debugf("Destination address for %s: %s", conn.RemoteAddr(), req.DestinationAddr.String())
+	if s.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Time{})
+	}
 	err = s.handle(req)
 	if err != nil {
 		log.Errorf("Error handling SOCKS5 request from %s: %v", conn.RemoteAddr(), err)
@@ -278,15 +292,12 @@ func (s *Server) handleConnect(req *request) error {
 	}
 
 	log.Debugf("Invoking user connect handler for SOCKS5 CONNECT from %s to %s", req.Conn.RemoteAddr(), req.DestinationAddr.String())
-	if err := sendReply(req.Conn, successReply, nil); err != nil {
-		log.Errorf("Failed to send SOCKS5 success reply to %s: %v", req.Conn.RemoteAddr(), err)
-		return fmt.Errorf("failed to send reply: %v", err)
-	}
 	host := req.DestinationAddr.IP.String()
 	if req.DestinationAddr.Name != "" {
 		host = req.DestinationAddr.Name
 	}
 
+	replied := false
 	proxyReq := &statute.ProxyRequest{
 		Conn:        req.Conn,
 		Reader:      io.Reader(req.Conn),
@@ -295,9 +306,32 @@ func (s *Server) handleConnect(req *request) error {
 		Destination: req.DestinationAddr.String(),
 		DestHost:    host,
 		DestPort:    int32(req.DestinationAddr.Port),
+		Reply: func(err error, bound net.Addr) error {
+			replied = true
+			if err != nil {
+				code := errToReply(err)
+				log.Debugf("Sending SOCKS5 %q reply to %s", code, req.Conn.RemoteAddr())
+				return sendReply(req.Conn, code, nil)
+			}
+			var bind *address
+			if tcp, ok := bound.(*net.TCPAddr); ok {
+				bind = &address{IP: tcp.IP, Port: tcp.Port}
+			}
+			log.Debugf("Sending SOCKS5 success reply to %s with bind address %s", req.Conn.RemoteAddr(), bind.String())
+			if err := sendReply(req.Conn, successReply, bind); err != nil {
+				log.Errorf("Failed to send SOCKS5 success reply to %s: %v", req.Conn.RemoteAddr(), err)
+				return fmt.Errorf("failed to send reply: %v", err)
+			}
+			return nil
+		},
 	}
 
-	return s.UserConnectHandle(proxyReq)
+	err := s.UserConnectHandle(proxyReq)
+	if err != nil && !replied {
+		// The handler failed before dialing.
+		_ = sendReply(req.Conn, serverFailure, nil)
+	}
+	return err
 }
 
 func (s *Server) embedHandleConnect(req *request) error {
@@ -355,8 +389,12 @@ func (s *Server) embedHandleBind(req *request) error {
 	ctx, cancel := context.WithCancel(s.Context)
 	defer cancel()
 
-	// Create a listener
-	listenIP := req.Conn.LocalAddr().(*net.TCPAddr).IP
+	// Create a listener on the address the client reached us on. Clients
+	// connected through a Unix socket get a loopback listener.
+	listenIP := net.IPv4(127, 0, 0, 1)
+	if local, ok := req.Conn.LocalAddr().(*net.TCPAddr); ok {
+		listenIP = local.IP
+	}
 	log.Debugf("Attempting to listen for SOCKS5 BIND on %s for %s", listenIP.String(), req.Conn.RemoteAddr())
 	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: listenIP})
 	if err != nil {
@@ -2,6 +2,7 @@ package statute
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -22,6 +23,9 @@ func (l DefaultLogger) Error(v ...interface{}) {
 	fmt.Println(v...)
 }
 
+// ErrRuleBlocked is returned by handlers refusing a destination by policy.
+var ErrRuleBlocked = errors.New("blocked by a routing rule")
+
 type ProxyRequest struct {
 	Conn        net.Conn
 	Reader      io.Reader
@@ -30,9 +34,16 @@ type ProxyRequest struct {
 	Destination string
 	DestHost    string
 	DestPort    int32
+
+	// Reply, when set, tells the client the outcome of the dial: the
+	// handler calls it once, after dialing Destination and before relaying
+	// any data, with the dial error or with the local address of the dialed
+	// connection. Data is only relayed when it returns nil.
+	Reply func(err error, bound net.Addr) error
 }
 
-// UserConnectHandler is used for socks5, socks4 and http
+// UserConnectHandler is used for socks5, socks4 and http. Handlers dial the
+// destination first and report the outcome through request.Reply.
 type UserConnectHandler func(request *ProxyRequest) error
 
 // UserBindHandler is used for socks4
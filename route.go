@@ -0,0 +1,234 @@
+package wiresocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// RouteAction tells what to do with a proxied connection.
+type RouteAction string
+
+const (
+	// RouteTunnel sends the connection through the WireGuard tunnel.
+	RouteTunnel RouteAction = "tunnel"
+	// RouteDirect dials the destination from the host, bypassing the tunnel.
+	RouteDirect RouteAction = "direct"
+	// RouteBlock refuses the connection.
+	RouteBlock RouteAction = "block"
+	// RouteChain sends the connection through the WireGuard tunnel and then
+	// through the upstream proxies of a Chain.
+	RouteChain RouteAction = "chain"
+)
+
+// ParseRouteAction parses the name of a route action.
+func ParseRouteAction(s string) (RouteAction, error) {
+	switch a := RouteAction(strings.ToLower(strings.TrimSpace(s))); a {
+	case RouteTunnel, RouteDirect, RouteBlock, RouteChain:
+		return a, nil
+	default:
+		return "", fmt.Errorf("unknown route action %q, expected tunnel, direct, block or chain", s)
+	}
+}
+
+// RouteRule applies Action to the connections whose destination is in one of
+// Networks or under one of Domains.
+type RouteRule struct {
+	Action RouteAction
+	// Chain names the chain of RouteChain rules.
+	Chain    string
+	Networks []netip.Prefix
+	// Domains match the domain itself and every subdomain.
+	Domains []string
+}
+
+// ParseRouteRule parses a rule written as the action followed by a
+// comma-separated list of networks and domains, e.g.
+// "direct 192.168.0.0/16, lan, example.com". The chain action is followed by
+// the name of the chain, e.g. "chain corp intranet.example.com".
+func ParseRouteRule(s string) (RouteRule, error) {
+	action, matches, _ := strings.Cut(strings.TrimSpace(s), " ")
+	a, err := ParseRouteAction(action)
+	if err != nil {
+		return RouteRule{}, err
+	}
+	rule := RouteRule{Action: a}
+	if a == RouteChain {
+		rule.Chain, matches, _ = strings.Cut(strings.TrimSpace(matches), " ")
+		if rule.Chain == "" {
+			return RouteRule{}, fmt.Errorf("route %q names no chain", s)
+		}
+	}
+	for _, match := range splitList(matches) {
+		if err := rule.add(match); err != nil {
+			return RouteRule{}, err
+		}
+	}
+	if len(rule.Networks) == 0 && len(rule.Domains) == 0 {
+		return RouteRule{}, fmt.Errorf("route %q matches nothing", s)
+	}
+	return rule, nil
+}
+
+// add adds match, a network, an IP address or a domain, to r.
+func (r *RouteRule) add(match string) error {
+	if prefix, err := parsePrefix(match); err == nil {
+		r.Networks = append(r.Networks, prefix.Masked())
+		return nil
+	}
+	domain := strings.TrimSuffix(strings.TrimLeft(strings.ToLower(match), "*."), ".")
+	if domain == "" || strings.ContainsAny(domain, "/:* ") {
+		return fmt.Errorf("route match %q is neither a network nor a domain", match)
+	}
+	r.Domains = append(r.Domains, domain)
+	return nil
+}
+
+// matches lists the networks and domains of r.
+func (r RouteRule) matches() []string {
+	list := prefixStrings(r.Networks)
+	return append(list, r.Domains...)
+}
+
+// action returns the action of r as written in a rule, with its chain.
+func (r RouteRule) action() string {
+	if r.Action == RouteChain {
+		return string(r.Action) + " " + r.Chain
+	}
+	return string(r.Action)
+}
+
+func (r RouteRule) String() string {
+	return r.action() + " " + strings.Join(r.matches(), ", ")
+}
+
+// match reports whether r applies to host, an IP address or a domain name.
+func (r RouteRule) match(host string) bool {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		for _, prefix := range r.Networks {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, domain := range r.Domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// router picks the route of each proxied connection: the action of the first
+// matching rule, or the default action.
+type router struct {
+	rules  []RouteRule
+	def    RouteAction
+	chains map[string]*Chain
+}
+
+func newRouter(rules []RouteRule, def RouteAction, chains []Chain) *router {
+	if def == "" {
+		def = RouteTunnel
+	}
+	r := &router{rules: rules, def: def, chains: make(map[string]*Chain, len(chains))}
+	for i := range chains {
+		r.chains[chains[i].Name] = &chains[i]
+	}
+	return r
+}
+
+// route returns the action for destination, given as host:port, and the
+// chain of RouteChain actions.
+func (r *router) route(destination string) (RouteAction, *Chain) {
+	host, _, err := net.SplitHostPort(destination)
+	if err != nil {
+		host = destination
+	}
+	for _, rule := range r.rules {
+		if rule.match(host) {
+			return rule.Action, r.chains[rule.Chain]
+		}
+	}
+	return r.def, nil
+}
+
+// checkChains checks that chains have distinct names and at least one
+// proxy, and that every rule of routes names one of them.
+func checkChains(chains []Chain, routes []RouteRule, def RouteAction) error {
+	names := make(map[string]bool, len(chains))
+	for _, c := range chains {
+		if c.Name == "" {
+			return errors.New("chain has no name")
+		}
+		if names[c.Name] {
+			return fmt.Errorf("chain %s is defined more than once", c.Name)
+		}
+		if len(c.Proxies) == 0 {
+			return fmt.Errorf("chain %s has no proxy", c.Name)
+		}
+		names[c.Name] = true
+	}
+	if def == RouteChain {
+		return errors.New("the default route cannot be a chain")
+	}
+	for _, rule := range routes {
+		if rule.Action == RouteChain && !names[rule.Chain] {
+			return fmt.Errorf("route %q names an unknown chain", rule)
+		}
+	}
+	return nil
+}
+
+// FallbackOptions lets the connections routed through the tunnel be dialed
+// directly from the host while the tunnel is down, instead of failing.
+type FallbackOptions struct {
+	// Allow lists the networks and domains that may fall back. Empty allows
+	// every destination Deny doesn't list.
+	Allow []string
+	// Deny lists the networks and domains that never fall back, even when
+	// Allow lists them too.
+	Deny []string
+}
+
+// fallback decides which destinations fall back to a direct dial.
+type fallback struct {
+	allow, deny RouteRule
+}
+
+// newFallback returns the fallback policy of opts, or nil when opts is nil.
+func newFallback(opts *FallbackOptions) (*fallback, error) {
+	if opts == nil {
+		return nil, nil
+	}
+	f := &fallback{}
+	for _, match := range opts.Allow {
+		if err := f.allow.add(strings.TrimSpace(match)); err != nil {
+			return nil, err
+		}
+	}
+	for _, match := range opts.Deny {
+		if err := f.deny.add(strings.TrimSpace(match)); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// allowed reports whether destination, given as host:port, may fall back.
+func (f *fallback) allowed(destination string) bool {
+	host, _, err := net.SplitHostPort(destination)
+	if err != nil {
+		host = destination
+	}
+	if f.deny.match(host) {
+		return false
+	}
+	return len(f.allow.Networks) == 0 && len(f.allow.Domains) == 0 || f.allow.match(host)
+}
@@ -0,0 +1,81 @@
+package wiresocks
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/shahradelahi/wiresocks/proxy/statute"
+)
+
+func TestRouter(t *testing.T) {
+	var rules []RouteRule
+	for _, s := range []string{"block ads.example.com", "direct 192.168.0.0/16, *.lan, example.com"} {
+		rule, err := ParseRouteRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	r := newRouter(rules, "", nil)
+
+	for dest, want := range map[string]RouteAction{
+		"192.168.1.10:80":          RouteDirect,
+		"[::ffff:192.168.1.10]:80": RouteDirect,
+		"printer.lan:631":          RouteDirect,
+		"EXAMPLE.com.:443":         RouteDirect,
+		"ads.example.com:443":      RouteBlock,
+		"notexample.com:443":       RouteTunnel,
+		"10.0.0.1:22":              RouteTunnel,
+	} {
+		if got, _ := r.route(dest); got != want {
+			t.Errorf("route(%s) = %s, want %s", dest, got, want)
+		}
+	}
+
+	for _, s := range []string{"direct", "teleport 10.0.0.0/8", "direct 10.0.0.0/33"} {
+		if _, err := ParseRouteRule(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+// downGroup is a tunnelGroup whose tunnel is down.
+type downGroup struct{}
+
+func (downGroup) pick(*statute.ProxyRequest) *tunnel { return nil }
+func (downGroup) monitor(context.Context)            {}
+func (downGroup) healthy() bool                      { return false }
+func (downGroup) Close()                             {}
+
+func TestFallback(t *testing.T) {
+	f, err := newFallback(&FallbackOptions{Allow: []string{"example.com", "127.0.0.0/8"}, Deny: []string{"bank.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for dest, want := range map[string]bool{
+		"www.example.com:443":  true,
+		"bank.example.com:443": false,
+		"127.0.0.1:80":         true,
+		"10.0.0.1:80":          false,
+	} {
+		if got := f.allowed(dest); got != want {
+			t.Errorf("allowed(%s) = %v, want %v", dest, got, want)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	vt := newVirtualTun(context.Background(), downGroup{})
+	vt.fallback = f
+	conn, release, err := vt.dial(&statute.ProxyRequest{Network: "tcp", Destination: ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	_ = conn.Close()
+}
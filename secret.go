@@ -0,0 +1,63 @@
+package wiresocks
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prefixes of secret values read from elsewhere than the configuration file.
+const (
+	envSecretPrefix  = "env:"
+	fileSecretPrefix = "file:"
+)
+
+// resolveSecret returns the secret value refers to: the content of an
+// environment variable for "env:NAME", the content of a file for
+// "file:/path", such as a mounted Kubernetes or Docker secret, or else value
+// itself. Surrounding whitespace is removed. Errors never include the secret.
+func resolveSecret(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(value, envSecretPrefix):
+		name := strings.TrimPrefix(value, envSecretPrefix)
+		secret, ok := os.LookupEnv(name)
+		if !ok || strings.TrimSpace(secret) == "" {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return strings.TrimSpace(secret), nil
+	case strings.HasPrefix(value, fileSecretPrefix):
+		path := strings.TrimPrefix(value, fileSecretPrefix)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		secret := strings.TrimSpace(string(data))
+		if secret == "" {
+			return "", fmt.Errorf("secret file %s is empty", path)
+		}
+		return secret, nil
+	default:
+		return value, nil
+	}
+}
+
+// secretRef returns value when it refers to a secret held elsewhere, for
+// resolveSecret, and "" when it is the secret itself.
+func secretRef(value string) string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, envSecretPrefix) || strings.HasPrefix(value, fileSecretPrefix) {
+		return value
+	}
+	return ""
+}
+
+// resolveKey resolves a base64 key that may be given through resolveSecret
+// and returns it hex-encoded.
+func resolveKey(value string) (string, error) {
+	key, err := resolveSecret(value)
+	if err != nil {
+		return "", err
+	}
+	return EncodeBase64ToHex(key)
+}
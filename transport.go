@@ -0,0 +1,494 @@
+package wiresocks
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/conn"
+	"golang.org/x/net/websocket"
+
+	"github.com/shahradelahi/wiresocks/log"
+)
+
+// Transport schemes. WireGuard speaks UDP; tcp, ws and wss carry its
+// datagrams over a stream to a relay that forwards them to the peer over
+// UDP, and socks5 sends them through a SOCKS5 proxy with UDP ASSOCIATE.
+const (
+	TransportTCP       = "tcp"
+	TransportWebSocket = "ws"
+	TransportWSS       = "wss"
+	TransportSOCKS5    = "socks5"
+)
+
+// transportDialTimeout bounds the connection to the relay, TLS and WebSocket
+// handshakes included.
+const transportDialTimeout = 10 * time.Second
+
+// Transport carries WireGuard datagrams elsewhere than straight to the
+// peers. It is either a stream to a relay, such as one run by
+// `wiresocks relay`: a TCP connection where every datagram is prefixed by its
+// 16-bit big-endian length, or a WebSocket, optionally over TLS, with one
+// binary message per datagram; or a SOCKS5 proxy relaying the datagrams to
+// the peer endpoints.
+type Transport struct {
+	Scheme string
+	// Address is the host:port of the relay or proxy.
+	Address string
+	// Path is the HTTP path of WebSocket transports.
+	Path string
+	// Insecure skips the verification of the relay's TLS certificate.
+	Insecure bool
+	// Username and Password authenticate with a SOCKS5 proxy.
+	Username string
+	Password string
+}
+
+// ParseTransport parses a transport URL: tcp://host:port, ws://host[:port]/path,
+// wss://host[:port]/path, where wss may be followed by ?insecure=1 to accept
+// any certificate, or socks5://[user:pass@]host[:port]. It returns nil for
+// "udp", the plain transport.
+func ParseTransport(s string) (*Transport, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.EqualFold(s, "udp") {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transport %q: %w", s, err)
+	}
+
+	t := &Transport{Scheme: strings.ToLower(u.Scheme), Address: u.Host, Path: u.Path}
+	defaultPort := ""
+	switch t.Scheme {
+	case TransportTCP:
+		if t.Path != "" && t.Path != "/" {
+			return nil, fmt.Errorf("invalid transport %q: tcp transports have no path", s)
+		}
+		t.Path = ""
+	case TransportWebSocket:
+		defaultPort = "80"
+	case TransportWSS:
+		defaultPort = "443"
+	case TransportSOCKS5:
+		if t.Path != "" && t.Path != "/" {
+			return nil, fmt.Errorf("invalid transport %q: socks5 transports have no path", s)
+		}
+		t.Path = ""
+		defaultPort = "1080"
+		if u.User != nil {
+			t.Username = u.User.Username()
+			t.Password, _ = u.User.Password()
+		}
+	default:
+		return nil, fmt.Errorf("unknown transport %q, expected udp, tcp://, ws://, wss:// or socks5://", s)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid transport %q: missing relay host", s)
+	}
+	if u.Port() == "" {
+		if defaultPort == "" {
+			return nil, fmt.Errorf("invalid transport %q: missing relay port", s)
+		}
+		t.Address = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	if (t.Scheme == TransportWebSocket || t.Scheme == TransportWSS) && t.Path == "" {
+		t.Path = "/"
+	}
+	switch u.Query().Get("insecure") {
+	case "", "0", "false":
+	default:
+		t.Insecure = true
+	}
+	return t, nil
+}
+
+// parsePeerTransport parses the transport of a single peer, which can only
+// be a SOCKS5 proxy since stream transports carry every peer.
+func parsePeerTransport(s string) (*Transport, error) {
+	t, err := ParseTransport(s)
+	if err != nil {
+		return nil, err
+	}
+	if t != nil && t.Scheme != TransportSOCKS5 {
+		return nil, fmt.Errorf("invalid transport %q: only socks5:// transports can be set per peer", s)
+	}
+	return t, nil
+}
+
+func (t *Transport) String() string {
+	s := t.Scheme + "://"
+	if t.Username != "" {
+		s += url.UserPassword(t.Username, t.Password).String() + "@"
+	}
+	s += t.Address + t.Path
+	if t.Insecure {
+		s += "?insecure=1"
+	}
+	return s
+}
+
+// isStream reports whether t carries the datagrams over a stream to a relay.
+func (t *Transport) isStream() bool {
+	return t.Scheme != TransportSOCKS5
+}
+
+// url returns the WebSocket URL of t.
+func (t *Transport) url() string {
+	return t.Scheme + "://" + t.Address + t.Path
+}
+
+// packetStream carries datagrams over a stream.
+type packetStream interface {
+	readPacket() ([]byte, error)
+	writePacket(b []byte) error
+	Close() error
+}
+
+// tcpStream frames datagrams with their 16-bit big-endian length.
+type tcpStream struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+func (s *tcpStream) readPacket() ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(s.Conn, size[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(s.Conn, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *tcpStream) writePacket(b []byte) error {
+	if len(b) > 0xffff {
+		return fmt.Errorf("datagram of %d bytes is too large", len(b))
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.Conn.Write(frame)
+	return err
+}
+
+// wsStream sends every datagram as a binary WebSocket message.
+type wsStream struct {
+	*websocket.Conn
+}
+
+func (s *wsStream) readPacket() ([]byte, error) {
+	var b []byte
+	err := websocket.Message.Receive(s.Conn, &b)
+	return b, err
+}
+
+func (s *wsStream) writePacket(b []byte) error {
+	return websocket.Message.Send(s.Conn, b)
+}
+
+// dial connects to the relay of t, from localAddr when it is valid.
+func (t *Transport) dial(localAddr netip.Addr) (packetStream, error) {
+	dialer := &net.Dialer{Timeout: transportDialTimeout}
+	if localAddr.IsValid() {
+		dialer.LocalAddr = &net.TCPAddr{IP: localAddr.AsSlice()}
+	}
+
+	if t.Scheme == TransportTCP {
+		c, err := dialer.Dial("tcp", t.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &tcpStream{Conn: c}, nil
+	}
+
+	origin := "http://" + t.Address
+	if t.Scheme == TransportWSS {
+		origin = "https://" + t.Address
+	}
+	config, err := websocket.NewConfig(t.url(), origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Dialer = dialer
+	if t.Scheme == TransportWSS {
+		host, _, _ := net.SplitHostPort(t.Address)
+		config.TlsConfig = &tls.Config{ServerName: host, InsecureSkipVerify: t.Insecure}
+	}
+	c, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	c.PayloadType = websocket.BinaryFrame
+	return &wsStream{Conn: c}, nil
+}
+
+// streamBind is a conn.Bind sending every datagram to the relay of its
+// transport, whatever the peer endpoint. The relay forwards them to its own
+// target, so the configuration should have a single peer. The stream is
+// dialed on the first datagram and dialed again after it breaks.
+type streamBind struct {
+	transport *Transport
+	localAddr netip.Addr
+
+	mu     sync.Mutex
+	stream packetStream
+	in     chan []byte
+	closed chan struct{}
+	// peer is the endpoint datagrams were last sent to, reported as the
+	// source of the received ones.
+	peer netip.AddrPort
+}
+
+func newStreamBind(t *Transport, localAddr netip.Addr) *streamBind {
+	return &streamBind{transport: t, localAddr: localAddr}
+}
+
+func (b *streamBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	in := make(chan []byte, conn.IdealBatchSize)
+	closed := make(chan struct{})
+	b.in, b.closed = in, closed
+
+	receive := func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case p := <-in:
+			sizes[0] = copy(packets[0], p)
+			b.mu.Lock()
+			eps[0] = &localEndpoint{dst: b.peer}
+			b.mu.Unlock()
+			return 1, nil
+		case <-closed:
+			return 0, net.ErrClosed
+		}
+	}
+	return []conn.ReceiveFunc{receive}, port, nil
+}
+
+func (b *streamBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		close(b.closed)
+		b.closed = nil
+	}
+	if b.stream != nil {
+		err := b.stream.Close()
+		b.stream = nil
+		return err
+	}
+	return nil
+}
+
+// connect returns the stream to the relay, dialing it if needed.
+func (b *streamBind) connect() (packetStream, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed == nil {
+		return nil, net.ErrClosed
+	}
+	if b.stream != nil {
+		return b.stream, nil
+	}
+
+	log.Debugf("Connecting to WireGuard relay %s.", b.transport.String())
+	stream, err := b.transport.dial(b.localAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to relay %s: %w", b.transport.Address, err)
+	}
+	b.stream = stream
+	go b.read(stream, b.in, b.closed)
+	return stream, nil
+}
+
+// read queues the datagrams received on stream until it breaks.
+func (b *streamBind) read(stream packetStream, in chan<- []byte, closed <-chan struct{}) {
+	for {
+		p, err := stream.readPacket()
+		if err != nil {
+			b.drop(stream, err)
+			return
+		}
+		select {
+		case in <- p:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// drop forgets stream after err so that the next datagram dials again.
+func (b *streamBind) drop(stream packetStream, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stream != stream {
+		return
+	}
+	log.Debugf("Connection to WireGuard relay %s lost: %v", b.transport.Address, err)
+	_ = stream.Close()
+	b.stream = nil
+}
+
+func (b *streamBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	e, ok := ep.(*localEndpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+	b.mu.Lock()
+	b.peer = e.dst
+	b.mu.Unlock()
+
+	stream, err := b.connect()
+	if err != nil {
+		return err
+	}
+	for _, buf := range bufs {
+		if err := stream.writePacket(buf); err != nil {
+			b.drop(stream, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *streamBind) SetMark(uint32) error {
+	return nil
+}
+
+func (b *streamBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &localEndpoint{dst: addr}, nil
+}
+
+func (b *streamBind) BatchSize() int {
+	return 1
+}
+
+// RelayOptions configures a relay accepting the streams of a Transport.
+type RelayOptions struct {
+	// Listen is the transport the relay accepts: its scheme, the local
+	// address to listen on and, for WebSockets, the path.
+	Listen *Transport
+	// Target is the host:port of the WireGuard server datagrams are
+	// forwarded to.
+	Target string
+	// TLSConfig holds the certificate of wss relays.
+	TLSConfig *tls.Config
+}
+
+// ServeRelay accepts transport streams and forwards their datagrams to
+// opts.Target over UDP, each stream from its own UDP socket, until ctx is
+// done.
+func ServeRelay(ctx context.Context, opts RelayOptions) error {
+	if opts.Listen == nil || !opts.Listen.isStream() {
+		return errors.New("relay needs a tcp, ws or wss listen transport")
+	}
+	if _, _, err := net.SplitHostPort(opts.Target); err != nil {
+		return fmt.Errorf("invalid relay target %q: %w", opts.Target, err)
+	}
+	if opts.Listen.Scheme == TransportWSS && opts.TLSConfig == nil {
+		return errors.New("wss relay needs a TLS certificate")
+	}
+
+	ln, err := net.Listen("tcp", opts.Listen.Address)
+	if err != nil {
+		return err
+	}
+	if opts.Listen.Scheme == TransportWSS {
+		ln = tls.NewListener(ln, opts.TLSConfig)
+	}
+	log.Infof("Relaying %s to udp://%s.", opts.Listen.String(), opts.Target)
+
+	stop := context.AfterFunc(ctx, func() { _ = ln.Close() })
+	defer stop()
+
+	if opts.Listen.Scheme == TransportTCP {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			go relayStream(ctx, &tcpStream{Conn: c}, opts.Target)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(opts.Listen.Path, websocket.Server{Handler: func(c *websocket.Conn) {
+		c.PayloadType = websocket.BinaryFrame
+		relayStream(ctx, &wsStream{Conn: c}, opts.Target)
+	}})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: transportDialTimeout}
+	if err := server.Serve(ln); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// relayStream forwards datagrams between stream and a new UDP socket
+// connected to target until either side fails.
+func relayStream(ctx context.Context, stream packetStream, target string) {
+	defer stream.Close()
+	udp, err := net.Dial("udp", target)
+	if err != nil {
+		log.Errorf("Failed to dial relay target %s: %v", target, err)
+		return
+	}
+	defer udp.Close()
+	log.Debugf("Relaying a new stream to udp://%s.", target)
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = stream.Close()
+		_ = udp.Close()
+	})
+	defer stop()
+
+	go func() {
+		defer stream.Close()
+		buf := make([]byte, 0xffff)
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				return
+			}
+			if err := stream.writePacket(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		p, err := stream.readPacket()
+		if err != nil {
+			return
+		}
+		if _, err := udp.Write(p); err != nil {
+			log.Debugf("Failed to forward a datagram to %s: %v", target, err)
+			return
+		}
+	}
+}
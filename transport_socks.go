@@ -0,0 +1,241 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/amnezia-vpn/amneziawg-go/conn"
+
+	"github.com/shahradelahi/wiresocks/log"
+	"github.com/shahradelahi/wiresocks/proxy/socks/socks5"
+)
+
+// socksPacket is a datagram received through a SOCKS5 proxy.
+type socksPacket struct {
+	data []byte
+	from netip.AddrPort
+}
+
+// socksBind is a conn.Bind sending WireGuard datagrams through SOCKS5 UDP
+// associations: to the proxy of the peer they are sent to, else to the
+// default proxy, else straight through direct. Associations are made on
+// the first datagram and made again after they break.
+type socksBind struct {
+	direct    conn.Bind
+	def       *Transport
+	localAddr netip.Addr
+	ifname    string
+
+	mu     sync.Mutex
+	peers  map[netip.AddrPort]*Transport
+	assocs map[*Transport]*socks5.UDPAssociation
+	in     chan socksPacket
+	closed chan struct{}
+}
+
+// newSOCKSBind returns a socksBind for def, the transport of every peer
+// without one in peers, which maps peer endpoints to their own transport.
+// direct is the bind of the peers without a proxy, and is nil when def is
+// set. The connections to the proxies are made from localAddr, or from the
+// network interface ifname, when set.
+func newSOCKSBind(def *Transport, peers map[netip.AddrPort]*Transport, direct conn.Bind, localAddr netip.Addr, ifname string) *socksBind {
+	return &socksBind{direct: direct, def: def, peers: peers, localAddr: localAddr, ifname: ifname}
+}
+
+func (b *socksBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	var fns []conn.ReceiveFunc
+	if b.direct != nil {
+		var err error
+		if fns, port, err = b.direct.Open(port); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	in := make(chan socksPacket, conn.IdealBatchSize)
+	closed := make(chan struct{})
+	b.in, b.closed = in, closed
+	b.assocs = make(map[*Transport]*socks5.UDPAssociation)
+
+	receive := func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case p := <-in:
+			ep, err := b.ParseEndpoint(p.from.String())
+			if err != nil {
+				return 0, err
+			}
+			sizes[0] = copy(packets[0], p.data)
+			eps[0] = ep
+			return 1, nil
+		case <-closed:
+			return 0, net.ErrClosed
+		}
+	}
+	return append(fns, receive), port, nil
+}
+
+func (b *socksBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		close(b.closed)
+		b.closed = nil
+	}
+	for t, assoc := range b.assocs {
+		_ = assoc.Close()
+		delete(b.assocs, t)
+	}
+	if b.direct != nil {
+		return b.direct.Close()
+	}
+	return nil
+}
+
+// proxy returns the transport of the datagrams sent to dst, or nil to send
+// them directly.
+func (b *socksBind) proxy(dst netip.AddrPort) *Transport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t, ok := b.peers[dst]; ok {
+		return t
+	}
+	return b.def
+}
+
+// movePeer routes the datagrams of the peer using transport t to its new
+// endpoint to instead of from, which is invalid when it had none.
+func (b *socksBind) movePeer(t *Transport, from, to netip.AddrPort) {
+	from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+	to = netip.AddrPortFrom(to.Addr().Unmap(), to.Port())
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.peers[from] == t {
+		delete(b.peers, from)
+	}
+	b.peers[to] = t
+}
+
+// associate returns the association with the proxy of t, making it if
+// needed.
+func (b *socksBind) associate(t *Transport) (*socks5.UDPAssociation, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed == nil {
+		return nil, net.ErrClosed
+	}
+	if assoc, ok := b.assocs[t]; ok {
+		return assoc, nil
+	}
+
+	log.Debugf("Associating with SOCKS5 proxy %s.", t.Address)
+	localAddr := b.localAddr
+	if !localAddr.IsValid() && b.ifname != "" {
+		var err error
+		if localAddr, err = interfaceAddr(b.ifname); err != nil {
+			return nil, err
+		}
+	}
+	control := deviceControl(b.ifname)
+	dialer := &net.Dialer{Control: control}
+	if localAddr.IsValid() {
+		dialer.LocalAddr = &net.TCPAddr{IP: localAddr.AsSlice()}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), transportDialTimeout)
+	defer cancel()
+	assoc, err := socks5.AssociateUDP(ctx, dialer, &net.ListenConfig{Control: control}, t.Address, t.Username, t.Password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to associate with SOCKS5 proxy %s: %w", t.Address, err)
+	}
+	b.assocs[t] = assoc
+	go b.read(t, assoc, b.in, b.closed)
+	return assoc, nil
+}
+
+// read queues the datagrams received on assoc until it breaks.
+func (b *socksBind) read(t *Transport, assoc *socks5.UDPAssociation, in chan<- socksPacket, closed <-chan struct{}) {
+	buf := make([]byte, 0xffff)
+	for {
+		n, from, err := assoc.ReadFrom(buf)
+		if err != nil {
+			b.drop(t, assoc, err)
+			return
+		}
+		select {
+		case in <- socksPacket{data: append([]byte(nil), buf[:n]...), from: from}:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// drop forgets assoc after err so that the next datagram associates again.
+func (b *socksBind) drop(t *Transport, assoc *socks5.UDPAssociation, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.assocs[t] != assoc {
+		return
+	}
+	log.Debugf("Association with SOCKS5 proxy %s lost: %v", t.Address, err)
+	_ = assoc.Close()
+	delete(b.assocs, t)
+}
+
+func (b *socksBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	dst, err := netip.ParseAddrPort(ep.DstToString())
+	if err != nil {
+		return conn.ErrWrongEndpointType
+	}
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	t := b.proxy(dst)
+	if t == nil {
+		return b.direct.Send(bufs, ep)
+	}
+
+	assoc, err := b.associate(t)
+	if err != nil {
+		return err
+	}
+	for _, buf := range bufs {
+		if _, err := assoc.WriteTo(buf, dst); err != nil {
+			b.drop(t, assoc, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *socksBind) SetMark(mark uint32) error {
+	if b.direct != nil {
+		return b.direct.SetMark(mark)
+	}
+	return nil
+}
+
+// ParseEndpoint returns endpoints of direct, if any, so that they can be
+// handed to it.
+func (b *socksBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	if b.direct != nil {
+		return b.direct.ParseEndpoint(s)
+	}
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &localEndpoint{dst: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())}, nil
+}
+
+func (b *socksBind) BatchSize() int {
+	if b.direct != nil {
+		return b.direct.BatchSize()
+	}
+	return 1
+}
@@ -0,0 +1,207 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
+	"go.uber.org/atomic"
+
+	"github.com/shahradelahi/wiresocks/log"
+	"github.com/shahradelahi/wiresocks/proxy/statute"
+)
+
+// tunnelDrainTimeout bounds how long a replaced tunnel is kept alive for the
+// connections that were opened through it before it is closed regardless.
+const tunnelDrainTimeout = 2 * time.Minute
+
+// tunnel is a running WireGuard device together with the netstack on top of
+// it. Connections dialed through a tunnel hold a reference to it, so that the
+// device is only torn down once it is no longer in use.
+type tunnel struct {
+	conf  *Configuration
+	dev   *device.Device
+	tnet  *netstack.Net
+	entry *tunnel
+
+	cancel context.CancelFunc
+	active atomic.Int64
+	idle   chan struct{}
+	once   sync.Once
+	// handshake is the time of the latest handshake of the peers, in Unix
+	// nanoseconds, as last read by the endpoint watcher.
+	handshake atomic.Int64
+}
+
+// startTunnel brings up a WireGuard device for conf and verifies that traffic
+// flows through it. DNS-named endpoints are resolved against dnsServer and
+// kept up to date for as long as the tunnel runs.
+func startTunnel(ctx context.Context, conf *Configuration, dnsServer, testURL string) (*tunnel, error) {
+	// Resolve DNS-named endpoints for the device while keeping the hostnames
+	// in conf, so they can be re-resolved when the record changes.
+	endpoints := newEndpointResolver(dnsServer, true)
+	resolved := endpoints.resolve(ctx, conf)
+
+	// A nested tunnel sends its datagrams through its entry tunnel, which
+	// comes up first.
+	var entry *tunnel
+	bind := newBind(resolved)
+	if b, ok := bind.(*socksBind); ok {
+		endpoints.moved = b.movePeer
+	}
+	if conf.Interface.Entry != nil {
+		log.Infof("Bringing up entry tunnel %s.", conf.Interface.Via)
+		var err error
+		if entry, err = startTunnel(ctx, conf.Interface.Entry, dnsServer, testURL); err != nil {
+			return nil, fmt.Errorf("entry tunnel %s: %w", conf.Interface.Via, err)
+		}
+		bind = newNetstackBind(entry.tnet, conf.Interface.Entry)
+	}
+
+	log.Debugf("Attempting to create WireGuard device.")
+	dev, tnet, err := createWireguardDevice(ctx, resolved, bind, testURL)
+	if err != nil {
+		if entry != nil {
+			entry.Close()
+		}
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	t := &tunnel{
+		conf:   conf,
+		dev:    dev,
+		tnet:   tnet,
+		entry:  entry,
+		cancel: cancel,
+		idle:   make(chan struct{}, 1),
+	}
+	if handshakes, err := peerHandshakes(dev); err == nil {
+		t.seen(handshakes)
+	}
+	endpoints.seen = t.seen
+	go endpoints.watch(ctx, dev)
+
+	return t, nil
+}
+
+// seen records the latest of the peer handshakes read from the device.
+func (t *tunnel) seen(handshakes map[string]time.Time) {
+	var latest time.Time
+	for _, last := range handshakes {
+		if last.After(latest) {
+			latest = last
+		}
+	}
+	if !latest.IsZero() {
+		t.handshake.Store(latest.UnixNano())
+	}
+}
+
+// acquire marks the tunnel as used by one more connection.
+func (t *tunnel) acquire() {
+	t.active.Inc()
+}
+
+// release drops a reference taken by acquire.
+func (t *tunnel) release() {
+	if t.active.Dec() == 0 {
+		select {
+		case t.idle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// check reports whether the tunnel still carries traffic.
+func (t *tunnel) check(ctx context.Context, testURL string) error {
+	return connectivityTest(ctx, t.tnet, testURL)
+}
+
+// alive reports whether at least one peer of the tunnel completed a
+// handshake within handshakeStaleAfter. It reads the handshakes the endpoint
+// watcher last saw, so it is cheap enough to call for every connection, but
+// a tunnel that goes down is only reported dead up to three minutes and
+// endpointCheckInterval later.
+func (t *tunnel) alive() bool {
+	if t.dev == nil {
+		return true
+	}
+	return time.Since(time.Unix(0, t.handshake.Load())) < handshakeStaleAfter
+}
+
+// drain waits until no connection uses the tunnel any more, or until timeout
+// expires, and then closes it.
+func (t *tunnel) drain(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for t.active.Load() > 0 {
+		select {
+		case <-t.idle:
+		case <-timer.C:
+			log.Warnf("Closing replaced tunnel with %d connection(s) still open.", t.active.Load())
+			t.Close()
+			return
+		}
+	}
+
+	log.Debugf("Replaced tunnel has no connections left, closing it.")
+	t.Close()
+}
+
+// Close stops the tunnel and closes its WireGuard device.
+func (t *tunnel) Close() {
+	t.once.Do(func() {
+		if t.cancel != nil {
+			t.cancel()
+		}
+		if t.dev != nil {
+			log.Infof("Closing WireGuard device.")
+			t.dev.Close()
+		}
+		if t.entry != nil {
+			t.entry.Close()
+		}
+	})
+}
+
+// tunnelGroup hands out the tunnel each proxied connection is dialed through
+// and owns the lifecycle of those tunnels.
+type tunnelGroup interface {
+	// pick returns the tunnel to dial req through, with a reference taken
+	// for the caller to release. It is taken along with the choice, so a
+	// tunnel being replaced is never handed out once it started draining.
+	pick(req *statute.ProxyRequest) *tunnel
+	// monitor runs the health checks of the group until ctx is done.
+	monitor(ctx context.Context)
+	// healthy reports whether the group can currently carry traffic. It
+	// relies on tunnel.alive, so it only notices a dead tunnel once its last
+	// handshake is older than handshakeStaleAfter.
+	healthy() bool
+	// Close closes every tunnel of the group.
+	Close()
+}
+
+// staticGroup is a tunnelGroup made of a single tunnel.
+type staticGroup struct {
+	t *tunnel
+}
+
+func (g *staticGroup) pick(*statute.ProxyRequest) *tunnel {
+	g.t.acquire()
+	return g.t
+}
+
+func (g *staticGroup) monitor(context.Context) {}
+
+func (g *staticGroup) healthy() bool {
+	return g.t.alive()
+}
+
+func (g *staticGroup) Close() {
+	g.t.Close()
+}
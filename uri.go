@@ -0,0 +1,317 @@
+package wiresocks
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Schemes of the configuration links understood by ParseURI.
+const (
+	wireguardScheme = "wireguard://"
+	wgScheme        = "wg://"
+	amneziaScheme   = "vpn://"
+)
+
+// IsConfigURI reports whether s is a configuration link understood by
+// ParseURI.
+func IsConfigURI(s string) bool {
+	for _, scheme := range []string{wireguardScheme, wgScheme, amneziaScheme} {
+		if len(s) >= len(scheme) && strings.EqualFold(s[:len(scheme)], scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseURI parses a configuration link as handed out by VPN providers:
+//
+//   - wireguard:// (or wg://) links of the form
+//     wireguard://<private key>@<host>:<port>?publickey=...&address=...#name,
+//     with the optional parameters presharedkey, allowedips, dns, mtu and
+//     keepalive.
+//   - AmneziaVPN vpn:// links, which carry a compressed JSON document holding
+//     a wg-quick configuration.
+//
+// The returned error matches ErrInvalidConfig.
+func ParseURI(uri string) (*Configuration, error) {
+	var (
+		conf *Configuration
+		err  error
+	)
+	switch {
+	case strings.HasPrefix(strings.ToLower(uri), amneziaScheme):
+		conf, err = parseAmneziaURI(uri[len(amneziaScheme):])
+	case IsConfigURI(uri):
+		conf, err = parseWireguardURI(uri)
+	default:
+		return nil, invalidConfigf("unsupported configuration link")
+	}
+	if err != nil {
+		if errors.Is(err, ErrInvalidConfig) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func parseWireguardURI(uri string) (*Configuration, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		// The error would repeat the link, private key included.
+		return nil, errors.New("malformed wireguard:// link")
+	}
+	query := u.Query()
+
+	// param returns the first of names set in the query.
+	param := func(names ...string) string {
+		for _, name := range names {
+			if v := query.Get(name); v != "" {
+				return strings.TrimSpace(v)
+			}
+		}
+		return ""
+	}
+	key := func(name, value string) (string, error) {
+		// An unescaped '+' of base64 is decoded from the query as a space.
+		k, err := EncodeBase64ToHex(strings.ReplaceAll(value, " ", "+"))
+		if err != nil {
+			return "", fmt.Errorf("invalid %s", name)
+		}
+		return k, nil
+	}
+
+	privateKey := u.User.Username()
+	if privateKey == "" {
+		privateKey = param("privatekey", "private_key", "secretkey")
+	}
+	if privateKey == "" {
+		return nil, errors.New("PrivateKey should not be empty")
+	}
+
+	iface := &InterfaceConfig{}
+	if iface.PrivateKey, err = key("PrivateKey", privateKey); err != nil {
+		return nil, err
+	}
+
+	addresses := param("address", "ip")
+	if addresses == "" {
+		return nil, errors.New("Address should not be empty")
+	}
+	for _, str := range splitList(addresses) {
+		prefix, err := parsePrefix(str)
+		if err != nil {
+			return nil, fmt.Errorf("Address %q is not a valid IP address or CIDR prefix", str)
+		}
+		iface.Addresses = append(iface.Addresses, prefix)
+	}
+	for _, str := range splitList(param("dns")) {
+		addr, err := netip.ParseAddr(str)
+		if err != nil {
+			return nil, fmt.Errorf("DNS %q is not a valid IP address", str)
+		}
+		iface.DNS = append(iface.DNS, addr)
+	}
+	if mtu := param("mtu"); mtu != "" {
+		if iface.MTU, err = strconv.Atoi(mtu); err != nil {
+			return nil, fmt.Errorf("invalid MTU %q", mtu)
+		}
+	}
+
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, errors.New("the link has no endpoint host:port")
+	}
+	peer := PeerConfig{
+		Endpoint:     net.JoinHostPort(u.Hostname(), u.Port()),
+		PreSharedKey: zeroKey,
+	}
+	publicKey := param("publickey", "public_key", "peer_public_key", "publicKey")
+	if publicKey == "" {
+		return nil, errors.New("PublicKey should not be empty")
+	}
+	if peer.PublicKey, err = key("PublicKey", publicKey); err != nil {
+		return nil, err
+	}
+	if psk := param("presharedkey", "preshared_key", "psk"); psk != "" {
+		if peer.PreSharedKey, err = key("PresharedKey", psk); err != nil {
+			return nil, err
+		}
+	}
+	allowedIPs := param("allowedips", "allowed_ips")
+	if allowedIPs == "" {
+		allowedIPs = "0.0.0.0/0, ::/0"
+	}
+	for _, str := range splitList(allowedIPs) {
+		prefix, err := netip.ParsePrefix(str)
+		if err != nil {
+			return nil, fmt.Errorf("AllowedIPs %q is not a valid CIDR prefix", str)
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, prefix)
+	}
+	if keepalive := param("keepalive", "persistentkeepalive"); keepalive != "" {
+		if peer.KeepAlive, err = strconv.Atoi(keepalive); err != nil {
+			return nil, fmt.Errorf("invalid PersistentKeepalive %q", keepalive)
+		}
+	}
+
+	return &Configuration{Interface: iface, Peers: []PeerConfig{peer}}, nil
+}
+
+// amneziaConfig is the document carried by AmneziaVPN vpn:// links.
+type amneziaConfig struct {
+	Containers       []map[string]json.RawMessage `json:"containers"`
+	DefaultContainer string                       `json:"defaultContainer"`
+	DNS1             string                       `json:"dns1"`
+	DNS2             string                       `json:"dns2"`
+}
+
+// parseAmneziaURI parses the payload of a vpn:// link: URL-safe base64 of
+// either a Qt qCompress blob, a 4-byte big-endian length followed by a zlib
+// stream, or the uncompressed document. The document is JSON, or the
+// wg-quick configuration itself.
+func parseAmneziaURI(payload string) (*Configuration, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(payload), "="))
+	if err != nil {
+		return nil, errors.New("vpn:// link is not valid base64")
+	}
+
+	if len(data) > 4 && data[4] == 0x78 {
+		size := binary.BigEndian.Uint32(data[:4])
+		r, err := zlib.NewReader(bytes.NewReader(data[4:]))
+		if err != nil {
+			return nil, fmt.Errorf("vpn:// link: %w", err)
+		}
+		// The declared size bounds the output, guarding against zip bombs.
+		data, err = io.ReadAll(io.LimitReader(r, int64(min(size, 1<<20))))
+		if err != nil {
+			return nil, fmt.Errorf("vpn:// link: %w", err)
+		}
+	}
+
+	if text := bytes.TrimSpace(data); len(text) > 0 && text[0] == '[' {
+		return parseINI(text)
+	}
+
+	var doc amneziaConfig
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("vpn:// link does not hold a configuration: %w", err)
+	}
+
+	last, err := doc.wireguardConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dns1 := doc.DNS1
+	if dns1 == "" {
+		dns1 = "1.1.1.1"
+	}
+	var replacer *strings.Replacer
+	if doc.DNS2 == "" {
+		replacer = strings.NewReplacer(", $SECONDARY_DNS", "", "$PRIMARY_DNS", dns1)
+	} else {
+		replacer = strings.NewReplacer("$PRIMARY_DNS", dns1, "$SECONDARY_DNS", doc.DNS2)
+	}
+	conf, err := parseINI([]byte(replacer.Replace(last.Config)))
+	if err != nil {
+		return nil, err
+	}
+	if err := last.applyAmnezia(conf.Interface); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// amneziaLastConfig is the last_config document of a container. Besides the
+// wg-quick configuration, AmneziaWG containers carry the obfuscation settings
+// as fields named like the keys of the configuration, as strings.
+type amneziaLastConfig struct {
+	Config string
+	Fields map[string]json.RawMessage
+}
+
+// applyAmnezia sets the obfuscation settings of iface that the configuration
+// text leaves out from the fields of last.
+func (last *amneziaLastConfig) applyAmnezia(iface *InterfaceConfig) error {
+	field := func(name string) (string, bool) {
+		raw, ok := last.Fields[name]
+		if !ok {
+			return "", false
+		}
+		value := strings.Trim(string(raw), `"`)
+		return value, value != ""
+	}
+	for name, value := range iface.amneziaInts() {
+		if str, ok := field(name); ok && *value == 0 {
+			n, err := strconv.Atoi(str)
+			if err != nil || n < 0 {
+				return fmt.Errorf("vpn:// link: invalid %s: %q", name, str)
+			}
+			*value = n
+		}
+	}
+	for name, value := range iface.amneziaHeaders() {
+		if str, ok := field(name); ok && *value == 0 {
+			h, err := strconv.ParseUint(str, 10, 32)
+			if err != nil {
+				return fmt.Errorf("vpn:// link: invalid %s: %w", name, err)
+			}
+			*value = uint32(h)
+		}
+	}
+	return nil
+}
+
+// wireguardConfig returns the last configuration of the default container,
+// or of the first AmneziaWG or WireGuard container.
+func (doc *amneziaConfig) wireguardConfig() (*amneziaLastConfig, error) {
+	var fallback *amneziaLastConfig
+	for _, container := range doc.Containers {
+		var name string
+		_ = json.Unmarshal(container["container"], &name)
+
+		for _, proto := range []string{"awg", "wireguard"} {
+			raw, ok := container[proto]
+			if !ok {
+				continue
+			}
+			var settings struct {
+				LastConfig string `json:"last_config"`
+			}
+			if err := json.Unmarshal(raw, &settings); err != nil || settings.LastConfig == "" {
+				continue
+			}
+			last := &amneziaLastConfig{}
+			if err := json.Unmarshal([]byte(settings.LastConfig), &last.Fields); err != nil {
+				continue
+			}
+			if err := json.Unmarshal(last.Fields["config"], &last.Config); err != nil || last.Config == "" {
+				continue
+			}
+			if name == doc.DefaultContainer {
+				return last, nil
+			}
+			if fallback == nil {
+				fallback = last
+			}
+		}
+	}
+	if fallback == nil {
+		return nil, errors.New("vpn:// link holds no AmneziaWG or WireGuard configuration")
+	}
+	return fallback, nil
+}
@@ -0,0 +1,97 @@
+package wiresocks
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseWireguardURI(t *testing.T) {
+	const uri = "wireguard://dGhpcyBpcyBhIHRlc3QgcHJpdmF0ZSBleS4uLi4uLi4%3D@vpn.example.com:51820" +
+		"?publickey=dGhpcyBpcyBhIHRlc3QgcHVibGljIGtleS4uLi4uLi4=&address=10.10.0.2/32,fd00::2/128&dns=1.1.1.1&mtu=1280#home"
+
+	conf, err := ParseURI(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Interface.Addresses) != 2 || conf.Interface.MTU != 1280 || len(conf.Interface.DNS) != 1 {
+		t.Fatalf("unexpected interface: %+v", conf.Interface)
+	}
+	peer := conf.Peers[0]
+	if peer.Endpoint != "vpn.example.com:51820" || len(peer.AllowedIPs) != 2 {
+		t.Fatalf("unexpected peer: %+v", peer)
+	}
+
+	if _, err := ParseURI("wireguard://vpn.example.com:51820?address=10.10.0.2/32"); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("expected ErrInvalidConfig, got %v", err)
+	}
+}
+
+func TestParseAmneziaURI(t *testing.T) {
+	const config = `[Interface]
+PrivateKey = dGhpcyBpcyBhIHRlc3QgcHJpdmF0ZSBleS4uLi4uLi4=
+Address = 10.8.1.2/32
+DNS = $PRIMARY_DNS, $SECONDARY_DNS
+Jc = 4
+H1 = 1234567
+H2 = 2345678
+H3 = 3456789
+H4 = 4567890
+
+[Peer]
+PublicKey = dGhpcyBpcyBhIHRlc3QgcHVibGljIGtleS4uLi4uLi4=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = 203.0.113.1:32542
+`
+	// The obfuscation settings also come as fields, which the text overrides.
+	last, _ := json.Marshal(map[string]string{"config": config, "Jc": "7", "S1": "15", "H1": "1"})
+	doc, _ := json.Marshal(map[string]any{
+		"containers": []any{map[string]any{
+			"container": "amnezia-awg",
+			"awg":       map[string]string{"last_config": string(last)},
+		}},
+		"defaultContainer": "amnezia-awg",
+		"dns1":             "1.1.1.1",
+		"dns2":             "1.0.0.1",
+	})
+
+	// Qt qCompress: the uncompressed size, then a zlib stream.
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.BigEndian, uint32(len(doc)))
+	w := zlib.NewWriter(&b)
+	_, _ = w.Write(doc)
+	_ = w.Close()
+
+	conf, err := ParseURI("vpn://" + base64.RawURLEncoding.EncodeToString(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Interface.DNS) != 2 || conf.Interface.DNS[1].String() != "1.0.0.1" {
+		t.Fatalf("unexpected DNS: %v", conf.Interface.DNS)
+	}
+	if conf.Peers[0].Endpoint != "203.0.113.1:32542" {
+		t.Fatalf("unexpected peer: %+v", conf.Peers[0])
+	}
+	iface := conf.Interface
+	if iface.Jc != 4 || iface.S1 != 15 || iface.H1 != 1234567 || iface.H2 != 2345678 || iface.H3 != 3456789 || iface.H4 != 4567890 {
+		t.Fatalf("unexpected obfuscation settings: %+v", iface)
+	}
+
+	// They survive an export.
+	text, err := conf.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := parseINI([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exported.Interface, iface) {
+		t.Fatalf("exported as\n%s", text)
+	}
+}
@@ -2,16 +2,24 @@ package wiresocks
 
 import (
 	"context"
+	crand "crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"math/rand"
 	"net"
 	"net/netip"
 	"strconv"
+	"strings"
 	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/shahradelahi/wiresocks/log"
 )
 
 // RandomIPFromPrefix returns a random IP from the provided CIDR prefix.
@@ -61,63 +69,200 @@ func RandomIPFromPrefix(cidr netip.Prefix) (netip.Addr, error) {
 }
 
 func ParseResolveAddressPort(hostname string, includev6 bool, dnsServer string) (netip.AddrPort, error) {
+	addr, _, err := resolveAddressPort(context.Background(), hostname, includev6, dnsServer)
+	return addr, err
+}
+
+// resolveAddressPort resolves hostname (host:port) against dnsServer and
+// additionally reports how long the answer may be cached. A zero TTL is
+// returned when host is an IP literal and never needs to be resolved again.
+func resolveAddressPort(ctx context.Context, hostname string, includev6 bool, dnsServer string) (netip.AddrPort, time.Duration, error) {
 	// Attempt to split the hostname into a host and port
 	host, port, err := net.SplitHostPort(hostname)
 	if err != nil {
-		return netip.AddrPort{}, fmt.Errorf("can't parse provided hostname into host and port: %w", err)
+		return netip.AddrPort{}, 0, fmt.Errorf("can't parse provided hostname into host and port: %w", err)
 	}
 
 	// Convert the string port to a uint16
 	portInt, err := strconv.Atoi(port)
 	if err != nil {
-		return netip.AddrPort{}, fmt.Errorf("error parsing port: %w", err)
+		return netip.AddrPort{}, 0, fmt.Errorf("error parsing port: %w", err)
 	}
 
 	if portInt < 1 || portInt > 65535 {
-		return netip.AddrPort{}, fmt.Errorf("port number %d is out of range", portInt)
+		return netip.AddrPort{}, 0, fmt.Errorf("port number %d is out of range", portInt)
 	}
 
 	// Attempt to parse the host into an IP. Return on success.
 	addr, err := netip.ParseAddr(host)
 	if err == nil {
-		return netip.AddrPortFrom(addr.Unmap(), uint16(portInt)), nil
+		return netip.AddrPortFrom(addr.Unmap(), uint16(portInt)), 0, nil
+	}
+
+	// If the host wasn't an IP, perform a lookup. A records are preferred,
+	// AAAA records are only consulted when IPv6 is allowed.
+	types := []dnsmessage.Type{dnsmessage.TypeA}
+	if includev6 {
+		types = append(types, dnsmessage.TypeAAAA)
+	}
+
+	var lastErr error
+	for _, qtype := range types {
+		addrs, ttl, err := lookupWithTTL(ctx, host, qtype, dnsServer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(addrs) > 0 {
+			return netip.AddrPortFrom(addrs[0], uint16(portInt)), ttl, nil
+		}
 	}
+	if lastErr != nil {
+		return netip.AddrPort{}, 0, fmt.Errorf("hostname lookup failed: %w", lastErr)
+	}
+
+	return netip.AddrPort{}, 0, errors.New("no valid IP addresses found")
+}
 
-	// Use Go's built-in DNS resolver
-	resolver := &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			return net.Dial("udp", net.JoinHostPort(dnsServer, "53"))
-		},
+// lookupWithTTL sends a single question for host to dnsServer over UDP, or
+// over TCP when the answer is truncated, and returns the addresses found
+// along with the smallest TTL in the answer. net.Resolver is not used because
+// it does not expose record TTLs.
+func lookupWithTTL(ctx context.Context, host string, qtype dnsmessage.Type, dnsServer string) ([]netip.Addr, time.Duration, error) {
+	fqdn := host
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid hostname %q: %w", host, err)
 	}
 
-	// If the host wasn't an IP, perform a lookup
-	ips, err := resolver.LookupIP(context.Background(), "ip", host)
+	// The ID is unpredictable so that off-path answers are not accepted.
+	var idBytes [2]byte
+	_, _ = crand.Read(idBytes[:])
+	id := binary.BigEndian.Uint16(idBytes[:])
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := exchangeDNS(ctx, "udp", dnsServer, packed, id)
+	if err == nil && resp.Truncated {
+		log.Debugf("DNS answer for %s was truncated, asking again over TCP.", host)
+		resp, err = exchangeDNS(ctx, "tcp", dnsServer, packed, id)
+	}
 	if err != nil {
-		return netip.AddrPort{}, fmt.Errorf("hostname lookup failed: %w", err)
+		return nil, 0, err
+	}
+	if resp.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("lookup %s: %s", host, resp.RCode)
 	}
 
-	for _, ip := range ips {
-		// Take the first IP and then return it
-		addr, ok := netip.AddrFromSlice(ip)
-		if !ok {
+	var (
+		addrs  []netip.Addr
+		minTTL uint32
+	)
+	for _, answer := range resp.Answers {
+		var addr netip.Addr
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addr = netip.AddrFrom4(body.A)
+		case *dnsmessage.AAAAResource:
+			addr = netip.AddrFrom16(body.AAAA).Unmap()
+		case *dnsmessage.CNAMEResource:
+			// The CNAME TTL bounds the lifetime of the whole chain.
+		default:
 			continue
 		}
+		if minTTL == 0 || answer.Header.TTL < minTTL {
+			minTTL = answer.Header.TTL
+		}
+		if addr.IsValid() {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, time.Duration(minTTL) * time.Second, nil
+}
 
-		if addr.Unmap().Is4() {
-			return netip.AddrPortFrom(addr.Unmap(), uint16(portInt)), nil
-		} else if includev6 {
-			return netip.AddrPortFrom(addr.Unmap(), uint16(portInt)), nil
+// exchangeDNS sends query, a packed message with ID id, to dnsServer over
+// network, "udp" or "tcp", and returns the answer. dnsServer is an IP
+// address, on port 53 unless given as host:port.
+func exchangeDNS(ctx context.Context, network, dnsServer string, query []byte, id uint16) (*dnsmessage.Message, error) {
+	server := dnsServer
+	if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+		server = net.JoinHostPort(dnsServer, "53")
+	}
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = c.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		// Messages over TCP are prefixed with their length.
+		if _, err := c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+			return nil, err
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return nil, err
 		}
+		buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return nil, err
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(buf); err != nil {
+			return nil, err
+		}
+		if resp.ID != id || !resp.Response {
+			return nil, errors.New("DNS server answered another question")
+		}
+		return &resp, nil
 	}
 
-	return netip.AddrPort{}, errors.New("no valid IP addresses found")
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1232)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		var resp dnsmessage.Message
+		if err := resp.Unpack(buf[:n]); err != nil || resp.ID != id || !resp.Response {
+			// Not an answer to our question, keep waiting for the real one.
+			continue
+		}
+		return &resp, nil
+	}
 }
 
 func EncodeHexToBase64(key string) (string, error) {
 	decoded, err := hex.DecodeString(key)
 	if err != nil {
-		return "", fmt.Errorf("invalid hex string: %s", key)
+		return "", errors.New("invalid hex string")
 	}
 	if len(decoded) != 32 {
 		return "", fmt.Errorf("key should be 32 bytes, but it is %d bytes", len(decoded))
@@ -128,10 +273,10 @@ func EncodeHexToBase64(key string) (string, error) {
 func EncodeBase64ToHex(key string) (string, error) {
 	decoded, err := base64.StdEncoding.DecodeString(key)
 	if err != nil {
-		return "", fmt.Errorf("invalid base64 string: %s", key)
+		return "", errors.New("invalid base64 string")
 	}
 	if len(decoded) != 32 {
-		return "", fmt.Errorf("key should be 32 bytes: %s", key)
+		return "", fmt.Errorf("key should be 32 bytes, but it is %d bytes", len(decoded))
 	}
 	return hex.EncodeToString(decoded), nil
 }
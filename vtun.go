@@ -3,15 +3,15 @@ package wiresocks
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/sagernet/sing/common/buf"
-
-	"github.com/amnezia-vpn/amneziawg-go/device"
-	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
+	"go.uber.org/atomic"
 
 	"github.com/shahradelahi/wiresocks/log"
 	"github.com/shahradelahi/wiresocks/proxy/statute"
@@ -19,94 +19,251 @@ import (
 
 // virtualTun stores a reference to netstack network and DNS configuration
 type virtualTun struct {
-	Tnet *netstack.Net
-	Dev  *device.Device
+	// Ctx is cancelled to force-close every connection still being proxied.
 	Ctx  context.Context
 	pool buf.Allocator
 	//pool bufferpool.BufPool
+
+	// group picks the tunnel each new connection is dialed through, for the
+	// connections routes sends through the tunnel.
+	group  tunnelGroup
+	routes *router
+
+	// fallback, when set, picks the connections dialed directly while group
+	// is unhealthy.
+	fallback *fallback
+	// directDial dials the connections that bypass the tunnel, routed direct
+	// or falling back.
+	directDial statute.ProxyDialFunc
+
+	// timeouts bound the dials and the relay of the connections.
+	timeouts TimeoutOptions
+
+	// active counts the connections being proxied and idle is signalled when
+	// it drops to zero, so that shutdown can wait for them. finished counts
+	// the connections that ended on their own, and killed those that were
+	// closed because Ctx was done.
+	active   atomic.Int64
+	idle     chan struct{}
+	finished atomic.Int64
+	killed   atomic.Int64
+}
+
+func newVirtualTun(ctx context.Context, group tunnelGroup) *virtualTun {
+	return &virtualTun{
+		Ctx:        ctx,
+		pool:       buf.DefaultAllocator,
+		group:      group,
+		routes:     newRouter(nil, RouteTunnel, nil),
+		directDial: statute.DefaultProxyDial(),
+		timeouts:   TimeoutOptions{}.effective(),
+		idle:       make(chan struct{}, 1),
+	}
+}
+
+// wait blocks until no connection is being proxied or ctx is done, and
+// reports whether all connections finished.
+func (vt *virtualTun) wait(ctx context.Context) bool {
+	for vt.active.Load() > 0 {
+		select {
+		case <-vt.idle:
+		case <-ctx.Done():
+			return vt.active.Load() == 0
+		}
+	}
+	return true
 }
 
 var BuffSize = 65536
 
+// udpIdleTimeout closes UDP associations idle for this long; they have no
+// end of their own.
+const udpIdleTimeout = 15 * time.Second
+
+// errIdle ends the relay of a connection idle for too long.
+var errIdle = errors.New("connection idle for too long")
+
 func (vt *virtualTun) handler(req *statute.ProxyRequest) error {
 	log.Debugf("Handling virtual tunnel connection for protocol: %s, destination: %s", req.Network, req.Destination)
 
-	conn, err := vt.Tnet.Dial(req.Network, req.Destination)
+	// forced is set when the connection is force-closed on shutdown.
+	var forced atomic.Bool
+	vt.active.Inc()
+	defer func() {
+		if !forced.Load() {
+			vt.finished.Inc()
+		}
+		if vt.active.Dec() == 0 {
+			select {
+			case vt.idle <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	conn, release, err := vt.dial(req)
+	if req.Reply != nil {
+		// Tell the client the outcome of the dial before relaying anything.
+		var bound net.Addr
+		if err == nil {
+			bound = conn.LocalAddr()
+		}
+		if rerr := req.Reply(err, bound); rerr != nil && err == nil {
+			release()
+			_ = conn.Close()
+			return rerr
+		}
+	}
 	if err != nil {
-		log.Errorf("Failed to dial virtual tunnel for %s://%s: %v", req.Network, req.Destination, err)
 		return err
 	}
-	log.Debugf("Successfully dialed virtual tunnel for %s://%s", req.Network, req.Destination)
+	defer release()
 
-	timeout := 0 * time.Second
+	idle := vt.timeouts.Idle
 	switch req.Network {
 	case "udp", "udp4", "udp6":
-		timeout = 15 * time.Second
-		log.Debugf("Setting UDP timeout to %v for %s://%s", timeout, req.Network, req.Destination)
+		idle = udpIdleTimeout
+		log.Debugf("Setting UDP timeout to %v for %s://%s", idle, req.Network, req.Destination)
 	}
 
-	// Close the connections when this function exits
-	defer func() {
-		log.Debugf("Closing virtual tunnel connection to %s://%s", req.Network, req.Destination)
+	// closed is set once the connections are closed, after which the errors
+	// of the copies are only a consequence.
+	var closed atomic.Bool
+	closeBoth := func() {
+		closed.Store(true)
 		_ = conn.Close()
-		log.Debugf("Closing client connection for %s://%s", req.Network, req.Destination)
 		_ = req.Conn.Close()
+	}
+
+	// Close the connections when this function exits
+	defer func() {
+		log.Debugf("Closing connections of %s://%s", req.Network, req.Destination)
+		closeBoth()
 	}()
 
-	// Channel to notify when copy operation is done
-	done := make(chan error, 1)
-
-	// Copy data from req.Conn to conn
-	go func() {
-		buf1 := vt.pool.Get(BuffSize)
-		defer func(pool buf.Allocator, buf []byte) {
-			_ = pool.Put(buf)
-		}(vt.pool, buf1)
-		log.Debugf("Starting copy from client to virtual tunnel for %s://%s", req.Network, req.Destination)
-		_, err := copyConnTimeout(conn, req.Conn, buf1, timeout)
-		if errors.Is(err, syscall.ECONNRESET) {
-			log.Debugf("Connection reset by peer during copy from client to virtual tunnel for %s://%s", req.Network, req.Destination)
+	// Unblock both copies when the connection is force-closed on shutdown.
+	stop := context.AfterFunc(vt.Ctx, func() {
+		forced.Store(true)
+		vt.killed.Inc()
+		log.Debugf("Force-closing proxy connection to %s://%s", req.Network, req.Destination)
+		closeBoth()
+	})
+	defer stop()
+
+	if lifetime := vt.timeouts.Lifetime; lifetime > 0 {
+		timer := time.AfterFunc(lifetime, func() {
+			log.Debugf("Closing %s://%s, it reached the maximum lifetime of %v", req.Network, req.Destination, lifetime)
+			closeBoth()
+		})
+		defer timer.Stop()
+	}
+
+	// Each direction ends on its own: the end of one is passed on with a
+	// half-close, and the relay lasts until both are done. Errors and
+	// connections that cannot be half-closed end both at once.
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+	done := make(chan error, 2)
+	relay := func(dst, src net.Conn, direction string) {
+		buf := vt.pool.Get(BuffSize)
+		defer func() {
+			_ = vt.pool.Put(buf)
+		}()
+		log.Debugf("Starting copy from %s for %s://%s", direction, req.Network, req.Destination)
+		_, err := copyConnTimeout(dst, src, buf, idle, &lastActive)
+		if closed.Load() {
 			done <- nil
 			return
 		}
+		if err == nil {
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+				done <- nil
+				return
+			}
+		}
+		closeBoth()
 		done <- err
-	}()
-
-	// Copy data from conn to req.Conn
-	go func() {
-		buf2 := vt.pool.Get(BuffSize)
-		defer func(pool buf.Allocator, buf []byte) {
-			_ = pool.Put(buf)
-		}(vt.pool, buf2)
-		log.Debugf("Starting copy from virtual tunnel to client for %s://%s", req.Network, req.Destination)
-		_, err := copyConnTimeout(req.Conn, conn, buf2, timeout)
-		done <- err
-	}()
-
-	// Wait for one of the copy operations to finish
-	err = <-done
-	if err != nil {
-		log.Warnf("An error occurred during proxy connection handling for %s://%s: %v", req.Network, req.Destination, err)
 	}
+	go relay(conn, req.Conn, "client to virtual tunnel")
+	go relay(req.Conn, conn, "virtual tunnel to client")
 
-	// Close connections and wait for the other copy operation to finish
-	<-done
+	for range 2 {
+		switch err := <-done; {
+		case err == nil, errors.Is(err, syscall.ECONNRESET):
+		case errors.Is(err, errIdle):
+			log.Debugf("Closing %s://%s: %v", req.Network, req.Destination, err)
+		default:
+			log.Warnf("An error occurred during proxy connection handling for %s://%s: %v", req.Network, req.Destination, err)
+		}
+	}
 	log.Debugf("Finished proxy connection handling for %s://%s", req.Network, req.Destination)
 	return nil
 }
 
-func (vt *virtualTun) Stop() {
-	if vt.Dev != nil {
-		log.Infof("Shutting down virtual tunnel device.")
-		if err := vt.Dev.Down(); err != nil {
-			log.Warnf("Failed to gracefully shut down the virtual tunnel device: %v", err)
+// dialContext returns the context of a dial, bounded by the dial timeout.
+func (vt *virtualTun) dialContext() (context.Context, context.CancelFunc) {
+	if vt.timeouts.Dial > 0 {
+		return context.WithTimeout(vt.Ctx, vt.timeouts.Dial)
+	}
+	return context.WithCancel(vt.Ctx)
+}
+
+// dial connects to the destination of req along its route. release must be
+// called once the connection is no longer used.
+func (vt *virtualTun) dial(req *statute.ProxyRequest) (conn net.Conn, release func(), err error) {
+	action, chain := vt.routes.route(req.Destination)
+	switch action {
+	case RouteBlock:
+		log.Infof("Blocked %s://%s by routing rule.", req.Network, req.Destination)
+		return nil, nil, fmt.Errorf("%s is %w", req.Destination, statute.ErrRuleBlocked)
+	case RouteDirect:
+		return vt.dialDirect(req)
+	case RouteChain:
+		if !strings.HasPrefix(req.Network, "tcp") {
+			return nil, nil, fmt.Errorf("chain %s only carries TCP connections", chain.Name)
 		}
+	case RouteTunnel:
+		if vt.fallback != nil && vt.fallback.allowed(req.Destination) && !vt.group.healthy() {
+			log.Warnf("Tunnel is down, falling back to a direct connection to %s://%s.", req.Network, req.Destination)
+			return vt.dialDirect(req)
+		}
+	}
+
+	t := vt.group.pick(req)
+	ctx, cancel := vt.dialContext()
+	defer cancel()
+	if chain != nil {
+		conn, err = chain.dial(ctx, t.tnet.DialContext, req.Destination)
 	} else {
-		log.Debugf("Virtual tunnel device not initialized, nothing to stop.")
+		conn, err = t.tnet.DialContext(ctx, req.Network, req.Destination)
+	}
+	if err != nil {
+		t.release()
+		log.Errorf("Failed to dial virtual tunnel for %s://%s: %v", req.Network, req.Destination, err)
+		return nil, nil, err
 	}
+	log.Debugf("Successfully dialed virtual tunnel for %s://%s", req.Network, req.Destination)
+	return conn, t.release, nil
 }
 
-func copyConnTimeout(dst net.Conn, src net.Conn, buf []byte, timeout time.Duration) (written int64, err error) {
+// dialDirect connects to the destination of req from the host, outside of
+// the tunnel.
+func (vt *virtualTun) dialDirect(req *statute.ProxyRequest) (net.Conn, func(), error) {
+	ctx, cancel := vt.dialContext()
+	defer cancel()
+	conn, err := vt.directDial(ctx, req.Network, req.Destination)
+	if err != nil {
+		log.Errorf("Failed to dial %s://%s directly: %v", req.Network, req.Destination, err)
+		return nil, nil, err
+	}
+	log.Debugf("Successfully dialed %s://%s directly", req.Network, req.Destination)
+	return conn, func() {}, nil
+}
+
+// copyConnTimeout copies src to dst until src ends. With a timeout, it fails
+// with errIdle once neither src nor the other direction, which shares
+// lastActive, has carried data for that long.
+func copyConnTimeout(dst net.Conn, src net.Conn, buf []byte, timeout time.Duration, lastActive *atomic.Int64) (written int64, err error) {
 	if buf != nil && len(buf) == 0 {
 		log.Errorf("Empty buffer provided to copyConnTimeout.")
 		panic("empty buffer in CopyBuffer")
@@ -114,8 +271,8 @@ func copyConnTimeout(dst net.Conn, src net.Conn, buf []byte, timeout time.Durati
 
 	for {
 		deadline := time.Time{}
-		if timeout != 0 {
-			deadline = time.Now().Add(timeout)
+		if timeout > 0 {
+			deadline = time.Unix(0, lastActive.Load()).Add(timeout)
 		}
 		if err := src.SetReadDeadline(deadline); err != nil {
 			log.Errorf("Failed to set read deadline on source connection: %v", err)
@@ -124,6 +281,7 @@ func copyConnTimeout(dst net.Conn, src net.Conn, buf []byte, timeout time.Durati
 
 		nr, er := src.Read(buf)
 		if nr > 0 {
+			lastActive.Store(time.Now().UnixNano())
 			nw, ew := dst.Write(buf[0:nr])
 			if nw < 0 || nr < nw {
 				nw = 0
@@ -133,7 +291,7 @@ func copyConnTimeout(dst net.Conn, src net.Conn, buf []byte, timeout time.Durati
 			}
 			written += int64(nw)
 			if ew != nil {
-				log.Errorf("Error writing to destination connection: %v", ew)
+				log.Debugf("Error writing to destination connection: %v", ew)
 				err = ew
 				break
 			}
@@ -144,8 +302,15 @@ func copyConnTimeout(dst net.Conn, src net.Conn, buf []byte, timeout time.Durati
 			}
 		}
 		if er != nil {
-			if er != io.EOF {
-				log.Errorf("Error reading from source connection: %v", er)
+			var netErr net.Error
+			if errors.As(er, &netErr) && netErr.Timeout() && timeout > 0 {
+				if time.Since(time.Unix(0, lastActive.Load())) < timeout {
+					// The other direction is still active.
+					continue
+				}
+				err = errIdle
+			} else if er != io.EOF {
+				log.Debugf("Error reading from source connection: %v", er)
 				err = er
 			}
 			break
@@ -0,0 +1,161 @@
+package wiresocks
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shahradelahi/wiresocks/proxy/http"
+	"github.com/shahradelahi/wiresocks/proxy/socks/socks5"
+)
+
+// TestHandlerReplies checks that the proxies answer with the outcome of the
+// dial instead of a blanket success.
+func TestHandlerReplies(t *testing.T) {
+	vt := newVirtualTun(context.Background(), downGroup{})
+	vt.routes = newRouter([]RouteRule{
+		{Action: RouteBlock, Domains: []string{"blocked.example"}},
+		{Action: RouteDirect, Networks: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}},
+	}, RouteTunnel, nil)
+
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socksServer := socks5.NewServer(socks5.WithConnectHandle(vt.handler))
+	socksServer.Listener = socksLn
+	go func() { _ = socksServer.ListenAndServe() }()
+	defer socksLn.Close()
+
+	httpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := http.NewServer(http.WithConnectHandle(vt.handler))
+	httpServer.Listener = httpLn
+	go func() { _ = httpServer.ListenAndServe() }()
+	defer httpLn.Close()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+
+	connect := func(proxy string, dst string) error {
+		conn, err := net.Dial("tcp", proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if proxy == socksLn.Addr().String() {
+			return socks5.Connect(conn, dst, "", "")
+		}
+		_, err = http.Connect(conn, dst, "", "")
+		return err
+	}
+
+	refused := freeAddr(t)
+	for _, tc := range []struct {
+		proxy, dst, want string
+	}{
+		{socksLn.Addr().String(), target.Addr().String(), ""},
+		{socksLn.Addr().String(), refused, "connection refused"},
+		{socksLn.Addr().String(), "blocked.example:443", "not allowed by ruleset"},
+		{httpLn.Addr().String(), target.Addr().String(), ""},
+		{httpLn.Addr().String(), refused, "502"},
+		{httpLn.Addr().String(), "blocked.example:443", "403"},
+	} {
+		err := connect(tc.proxy, tc.dst)
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("connect to %s: %v", tc.dst, err)
+		case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("connect to %s: got %v, want %q", tc.dst, err, tc.want)
+		}
+	}
+}
+
+// TestHandlerTimeouts checks that a half-close is passed on instead of ending
+// the relay, and that idle connections are closed.
+func TestHandlerTimeouts(t *testing.T) {
+	vt := newVirtualTun(context.Background(), downGroup{})
+	vt.routes = newRouter(nil, RouteDirect, nil)
+	vt.timeouts = TimeoutOptions{Idle: 200 * time.Millisecond}.effective()
+
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socksServer := socks5.NewServer(socks5.WithConnectHandle(vt.handler))
+	socksServer.Listener = socksLn
+	go func() { _ = socksServer.ListenAndServe() }()
+	defer socksLn.Close()
+
+	// The target answers once the client is done writing, or never when it
+	// is sent "idle".
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b, _ := io.ReadAll(c)
+				if string(b) != "idle" {
+					_, _ = c.Write([]byte("reply"))
+				}
+			}()
+		}
+	}()
+
+	exchange := func(msg string) (string, time.Duration) {
+		conn, err := net.Dial("tcp", socksLn.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := socks5.Connect(conn, target.Addr().String(), "", ""); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if msg != "idle" {
+			_ = conn.(*net.TCPConn).CloseWrite()
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("read %s: %v", msg, err)
+		}
+		return string(b), time.Since(start)
+	}
+
+	if got, _ := exchange("request"); got != "reply" {
+		t.Errorf("half-closed exchange: got %q, want %q", got, "reply")
+	}
+	if got, elapsed := exchange("idle"); got != "" || elapsed > 3*time.Second {
+		t.Errorf("idle exchange: got %q after %v, want it closed", got, elapsed)
+	}
+}
@@ -3,10 +3,12 @@ package wiresocks
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"fmt"
 	"net/http"
 	"net/netip"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,7 +30,7 @@ func connectivityTest(ctx context.Context, tnet *netstack.Net, url string) error
 		select {
 		case <-ctx.Done():
 			log.Warnf("WireGuard connectivity test timed out or cancelled: %v", ctx.Err())
-			return ctx.Err()
+			return fmt.Errorf("%w: %w", ErrConnectivityTest, ctx.Err())
 		default:
 		}
 
@@ -40,7 +42,7 @@ func connectivityTest(ctx context.Context, tnet *netstack.Net, url string) error
 		if err != nil {
 			log.Errorf("Failed to create WireGuard tunnel test request: %v", err)
 			// This is likely a programming error, so we'll just fail fast.
-			return err
+			return fmt.Errorf("%w: %w", ErrConnectivityTest, err)
 		}
 
 		resp, err := client.Do(req)
@@ -71,7 +73,7 @@ func waitHandshake(ctx context.Context, dev *device.Device) error {
 		select {
 		case <-ctx.Done():
 			log.Warnf("WireGuard handshake wait timed out or cancelled: %v", ctx.Err())
-			return ctx.Err()
+			return fmt.Errorf("%w: %w", ErrHandshakeTimeout, ctx.Err())
 		default:
 		}
 
@@ -104,42 +106,58 @@ func waitHandshake(ctx context.Context, dev *device.Device) error {
 		}
 
 		log.Debugf("Still waiting for WireGuard handshake to complete...")
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
 	}
 
 	return nil
 }
 
-func establishWireguard(conf *Configuration, tunDev tun.Device, fwmark uint32) (*device.Device, error) {
-	log.Debugf("Establishing WireGuard device with private key (first 8 chars): %s", conf.Interface.PrivateKey[:8])
+// defaultHandshakeTimeout is how long establishWireguard waits for the first
+// handshake when starting a tunnel.
+const defaultHandshakeTimeout = 15 * time.Second
+
+// establishWireguard brings up a WireGuard device for conf on tunDev and waits
+// up to handshakeTimeout for a handshake, or until ctx is done.
+func establishWireguard(ctx context.Context, conf *Configuration, tunDev tun.Device, bind conn.Bind, fwmark uint32, handshakeTimeout time.Duration) (*device.Device, error) {
+	log.Debugf("Establishing WireGuard device with %d peer(s).", len(conf.Peers))
 	// create the IPC message to establish the wireguard conn
 	var request bytes.Buffer
 
 	request.WriteString(fmt.Sprintf("private_key=%s\n", conf.Interface.PrivateKey))
 
 	request.WriteString(fmt.Sprintf("private_key=%s\n", conf.Interface.PrivateKey))
+	if conf.Interface.ListenPort != 0 {
+		request.WriteString(fmt.Sprintf("listen_port=%d\n", conf.Interface.ListenPort))
+		log.Debugf("Setting ListenPort: %d", conf.Interface.ListenPort)
+	}
 	if fwmark != 0 {
 		request.WriteString(fmt.Sprintf("fwmark=%d\n", fwmark))
 		log.Debugf("Setting FwMark: %d", fwmark)
 	}
 
-	// AmneziaWG parameters for obfuscation
-	request.WriteString("jc=10\n")
-	request.WriteString("jmin=50\n")
-	request.WriteString("jmax=1000\n")
-	request.WriteString("s1=0\n")
-	request.WriteString("s2=0\n")
-	request.WriteString("h1=1\n")
-	request.WriteString("h2=2\n")
-	request.WriteString("h3=3\n")
-	request.WriteString("h4=4\n")
+	// AmneziaWG parameters for obfuscation, unset ones take the defaults
+	iface := conf.Interface
+	request.WriteString(fmt.Sprintf("jc=%d\n", cmp.Or(iface.Jc, 10)))
+	request.WriteString(fmt.Sprintf("jmin=%d\n", cmp.Or(iface.Jmin, 50)))
+	request.WriteString(fmt.Sprintf("jmax=%d\n", cmp.Or(iface.Jmax, 1000)))
+	request.WriteString(fmt.Sprintf("s1=%d\n", iface.S1))
+	request.WriteString(fmt.Sprintf("s2=%d\n", iface.S2))
+	request.WriteString(fmt.Sprintf("h1=%d\n", cmp.Or(iface.H1, 1)))
+	request.WriteString(fmt.Sprintf("h2=%d\n", cmp.Or(iface.H2, 2)))
+	request.WriteString(fmt.Sprintf("h3=%d\n", cmp.Or(iface.H3, 3)))
+	request.WriteString(fmt.Sprintf("h4=%d\n", cmp.Or(iface.H4, 4)))
 
 	for _, peer := range conf.Peers {
 		log.Debugf("Adding peer with public key (first 8 chars): %s, endpoint: %s", peer.PublicKey[:8], peer.Endpoint)
 		request.WriteString(fmt.Sprintf("public_key=%s\n", peer.PublicKey))
 		request.WriteString(fmt.Sprintf("persistent_keepalive_interval=%d\n", peer.KeepAlive))
 		request.WriteString(fmt.Sprintf("preshared_key=%s\n", peer.PreSharedKey))
-		request.WriteString(fmt.Sprintf("endpoint=%s\n", peer.Endpoint))
+		if peer.Endpoint != "" {
+			request.WriteString(fmt.Sprintf("endpoint=%s\n", peer.Endpoint))
+		}
 
 		for _, cidr := range peer.AllowedIPs {
 			request.WriteString(fmt.Sprintf("allowed_ip=%s\n", cidr))
@@ -148,7 +166,7 @@ func establishWireguard(conf *Configuration, tunDev tun.Device, fwmark uint32) (
 
 	dev := device.NewDevice(
 		tunDev,
-		conn.NewDefaultBind(),
+		bind,
 		device.NewLogger(0, ""), // WireGuard-Go's internal logger
 	)
 
@@ -164,7 +182,7 @@ func establishWireguard(conf *Configuration, tunDev tun.Device, fwmark uint32) (
 		return nil, err
 	}
 
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
 	defer cancel()
 
 	if err := waitHandshake(ctx, dev); err != nil {
@@ -180,7 +198,7 @@ func establishWireguard(conf *Configuration, tunDev tun.Device, fwmark uint32) (
 	return dev, nil
 }
 
-func createWireguardDevice(ctx context.Context, conf *Configuration, testURL string) (*device.Device, *netstack.Net, error) {
+func createWireguardDevice(ctx context.Context, conf *Configuration, bind conn.Bind, testURL string) (*device.Device, *netstack.Net, error) {
 	log.Debugf("Creating netstack TUN device with addresses: %v, DNS: %v, MTU: %d", conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
 
 	var interfaceAddrs []netip.Addr
@@ -195,7 +213,7 @@ func createWireguardDevice(ctx context.Context, conf *Configuration, testURL str
 	}
 
 	log.Infof("Establishing WireGuard connection")
-	dev, err := establishWireguard(conf, tunDev, conf.Interface.FwMark)
+	dev, err := establishWireguard(ctx, conf, tunDev, bind, conf.Interface.FwMark, defaultHandshakeTimeout)
 	if err != nil {
 		log.Errorf("Failed to establish WireGuard connection: %v", err)
 		return nil, nil, err
@@ -213,3 +231,40 @@ func createWireguardDevice(ctx context.Context, conf *Configuration, testURL str
 	log.Debugf("WireGuard device and netstack created successfully.")
 	return dev, tnet, nil
 }
+
+// peerHandshakes returns the last handshake time of every peer on dev, keyed
+// by the peer's hex-encoded public key. Peers that never completed a
+// handshake are reported with the zero time.
+func peerHandshakes(dev *device.Device) (map[string]time.Time, error) {
+	get, err := dev.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	handshakes := make(map[string]time.Time)
+	var current string
+	scanner := bufio.NewScanner(strings.NewReader(get))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "public_key":
+			current = value
+			handshakes[current] = time.Time{}
+		case "last_handshake_time_sec":
+			if current == "" {
+				continue
+			}
+			secs, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || secs == 0 {
+				continue
+			}
+			handshakes[current] = time.Unix(secs, 0)
+		}
+	}
+
+	return handshakes, scanner.Err()
+}
@@ -2,20 +2,43 @@ package wiresocks
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"go.uber.org/atomic"
+
+	"github.com/shahradelahi/wiresocks/internal/systemd"
 	"github.com/shahradelahi/wiresocks/log"
 )
 
+// DefaultShutdownGrace is how long Close lets in-flight proxy connections
+// finish before closing them.
+const DefaultShutdownGrace = 10 * time.Second
+
 type WireSocks struct {
-	conf             *Configuration
-	socksBindAddress *netip.AddrPort
-	httpBindAddress  *netip.AddrPort
-	testURL          string
+	conf          *Configuration
+	failoverConfs []*Configuration
+	tunnels       []*tunnelSpec
+	balance       BalanceStrategy
+	proxy         ProxyOptions // listeners of the default tunnel
+	testURL       string
+	shutdownGrace time.Duration
+	readyFile     string
+	readyFuncs    []func()
+	ready         chan struct{}
 
 	ctx    context.Context
 	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	instances []*instance
 }
 
 func NewWireSocks(options ...option) (*WireSocks, error) {
@@ -50,6 +73,9 @@ func NewWireSocks(options ...option) (*WireSocks, error) {
 		ctx:     ctx,
 		testURL: "https://1.1.1.1/cdn-cgi/trace/",
 		cancel:  cancel,
+
+		shutdownGrace: DefaultShutdownGrace,
+		ready:         make(chan struct{}),
 	}
 
 	for _, option := range options {
@@ -60,65 +86,235 @@ func NewWireSocks(options ...option) (*WireSocks, error) {
 	return s, nil
 }
 
+// Run starts WireSocks and blocks until Stop is called.
 func (s *WireSocks) Run() error {
 	log.Infof("Starting WireSocks main run loop.")
-	s.conf.Interface.MTU = 1330
-	log.Debugf("Setting interface MTU to: %d", s.conf.Interface.MTU)
+
+	hasListeners := false
+	for _, spec := range s.tunnelSpecs() {
+		hasListeners = hasListeners || spec.opts.hasListeners()
+	}
+	if !hasListeners {
+		return errors.New("no proxy listeners configured")
+	}
+
+	if err := s.Start(s.ctx); err != nil {
+		return err
+	}
+
+	log.Infof("WireSocks is running. Waiting for shutdown signal.")
+	<-s.ctx.Done()
+
+	log.Infof("Shutdown signal received. Stopping proxy servers.")
+	if err := s.Close(); err != nil {
+		// Connections cut short by the grace period are expected on shutdown.
+		log.Warnf("Shutdown did not complete cleanly: %v", err)
+	}
+
+	log.Infof("WireSocks main run loop finished.")
+	return nil
+}
+
+// Start brings up every tunnel along with its proxy listeners, and returns
+// once all of them are ready to carry traffic. Cancelling ctx aborts the
+// startup; once Start has returned the tunnels run until Close is called.
+func (s *WireSocks) Start(ctx context.Context) error {
+	if err := s.start(ctx); err != nil {
+		return err
+	}
+	// The callbacks run without s.mu, as they may call back into s.
+	for _, fn := range s.readyFuncs {
+		fn()
+	}
+	return nil
+}
+
+// start is Start up to the ready callbacks.
+func (s *WireSocks) start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.instances != nil {
+		return errors.New("wiresocks is already started or closed")
+	}
 
 	resolver := "1.1.1.1" // Default resolver
-	s.conf.Interface.DNS = []netip.Addr{netip.MustParseAddr("1.1.1.1")}
 	log.Debugf("Setting DNS resolver to: %s", resolver)
 
-	// Enable keepalive on all peers in conf
-	for i, peer := range s.conf.Peers {
-		peer.KeepAlive = 5
-		log.Debugf("Setting KeepAlive for peer %d to %d seconds.", i, peer.KeepAlive)
-
-		addr, err := ParseResolveAddressPort(peer.Endpoint, true, resolver)
-		if err == nil {
-			log.Debugf("Resolved peer endpoint %s to %s", peer.Endpoint, addr.String())
-			peer.Endpoint = addr.String()
-		} else {
-			log.Warnf("Failed to resolve peer endpoint: %s, using original. Error: %v", peer.Endpoint, err)
+	specs := s.tunnelSpecs()
+	if len(specs) == 0 {
+		return errors.New("no tunnels configured")
+	}
+	for _, spec := range specs {
+		for _, conf := range spec.confs {
+			if err := conf.validate(); err != nil {
+				return fmt.Errorf("tunnel %q: %w", spec.name, err)
+			}
+			applyRunDefaults(conf)
 		}
-
-		s.conf.Peers[i] = peer
 	}
 
+	// The tunnels live as long as s.ctx. ctx only bounds the startup.
+	runCtx, cancel := context.WithCancel(s.ctx)
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
 	// Establish wireguard on userspace stack
-	log.Debugf("Attempting to create WireGuard device.")
-	dev, tnet, err := createWireguardDevice(s.ctx, s.conf, s.testURL)
-	if err != nil {
-		log.Fatalf("Failed to create WireGuard device: %v", err)
-		return err
+	var instances []*instance
+	for _, spec := range specs {
+		dnsServer := resolver
+		if spec.opts != nil && spec.opts.Resolver != "" {
+			dnsServer = spec.opts.Resolver
+		}
+		inst, err := startInstance(runCtx, spec, dnsServer, s.testURL)
+		if err != nil {
+			stopped, abort := context.WithCancel(context.Background())
+			abort()
+			for i := len(instances) - 1; i >= 0; i-- {
+				instances[i].stop(stopped)
+			}
+			cancel()
+			if ctx.Err() != nil {
+				return errors.Join(ctx.Err(), err)
+			}
+			return err
+		}
+		instances = append(instances, inst)
 	}
-	if dev != nil {
-		defer func() {
-			log.Infof("Closing WireGuard device.")
-			dev.Close()
+
+	s.instances = instances
+	s.signalReady()
+	return nil
+}
+
+// signalReady announces that every tunnel and proxy listener is up.
+func (s *WireSocks) signalReady() {
+	if s.readyFile != "" {
+		pid := strconv.Itoa(os.Getpid()) + "\n"
+		if err := os.WriteFile(s.readyFile, []byte(pid), 0o644); err != nil {
+			log.Warnf("Failed to write ready file %s: %v", s.readyFile, err)
+		} else {
+			log.Debugf("Wrote ready file: %s", s.readyFile)
+		}
+	}
+
+	close(s.ready)
+	log.Infof("WireSocks is ready.")
+}
+
+// Ready returns a channel that is closed once Start has brought up every
+// tunnel and proxy listener.
+func (s *WireSocks) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Healthy reports whether every tunnel has a peer that completed a handshake
+// recently and passes its health checks. It reports false before Start.
+func (s *WireSocks) Healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.instances) == 0 {
+		return false
+	}
+	for _, inst := range s.instances {
+		if !inst.group.healthy() {
+			return false
+		}
+	}
+	return true
+}
+
+// Close stops the proxy listeners and closes every tunnel once in-flight
+// proxy connections have finished, or the shutdown grace period has passed,
+// in which case the error reports the connections that were force-closed.
+// Connections dialed with DialContext or ListenPacket are closed along with
+// their tunnel.
+func (s *WireSocks) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownGrace)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
+
+// Shutdown stops accepting proxy connections and waits for the in-flight ones
+// to finish until ctx is done. Connections still open then are force-closed,
+// and the tunnels are closed last. The error wraps ctx.Err() when any
+// connection had to be force-closed.
+func (s *WireSocks) Shutdown(ctx context.Context) error {
+	s.cancel()
+
+	s.mu.Lock()
+	instances := s.instances
+	s.instances = []*instance{}
+	s.mu.Unlock()
+
+	var (
+		wg              sync.WaitGroup
+		drained, killed atomic.Int64
+	)
+	for _, inst := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, k := inst.stop(ctx)
+			drained.Add(int64(d))
+			killed.Add(int64(k))
 		}()
 	}
+	wg.Wait()
 
-	opts := &ProxyOptions{
-		SocksBindAddress: s.socksBindAddress,
-		HttpBindAddress:  s.httpBindAddress,
+	if s.readyFile != "" && len(instances) > 0 {
+		if err := os.Remove(s.readyFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Warnf("Failed to remove ready file %s: %v", s.readyFile, err)
+		}
 	}
 
-	proxy := NewProxyServer(tnet, opts)
-	log.Infof("Starting proxy server.")
-	if err := proxy.Start(); err != nil {
-		log.Fatalf("Failed to start proxy server: %v", err)
-		return err
+	if len(instances) > 0 {
+		log.Infof("Shutdown complete: %d connection(s) drained, %d force-closed.", drained.Load(), killed.Load())
+	}
+	if k := killed.Load(); k > 0 {
+		return fmt.Errorf("%d proxy connection(s) force-closed: %w", k, ctx.Err())
 	}
+	return nil
+}
 
-	log.Infof("WireSocks is running. Waiting for shutdown signal.")
-	<-s.ctx.Done()
+// tunnelSpecs returns the tunnels to run. The configuration set with
+// WithConfig forms the "default" tunnel unless only named tunnels were added.
+func (s *WireSocks) tunnelSpecs() []*tunnelSpec {
+	var specs []*tunnelSpec
+	if s.hasDefaultTunnel() {
+		proxy := s.proxy
+		specs = append(specs, &tunnelSpec{
+			name:    "default",
+			confs:   append([]*Configuration{s.conf}, s.failoverConfs...),
+			balance: s.balance,
+			opts:    &proxy,
+		})
+	}
+	return append(specs, s.tunnels...)
+}
 
-	log.Infof("Shutdown signal received. Stopping proxy server.")
-	proxy.Stop()
+// hasDefaultTunnel reports whether the configuration set with WithConfig runs
+// as the "default" tunnel.
+func (s *WireSocks) hasDefaultTunnel() bool {
+	return len(s.tunnels) == 0 || len(s.conf.Peers) > 0
+}
 
-	log.Infof("WireSocks main run loop finished.")
-	return nil
+// applyRunDefaults forces the interface and peer settings wiresocks runs with.
+func applyRunDefaults(conf *Configuration) {
+	conf.Interface.MTU = 1330
+	if entry := conf.Interface.Entry; entry != nil {
+		applyRunDefaults(entry)
+		// Leave room for the headers the entry tunnel adds.
+		conf.Interface.MTU = entry.Interface.MTU - wireguardOverhead
+	}
+	log.Debugf("Setting interface MTU to: %d", conf.Interface.MTU)
+
+	conf.Interface.DNS = []netip.Addr{netip.MustParseAddr("1.1.1.1")}
+
+	// Enable keepalive on all peers in conf
+	for i := range conf.Peers {
+		conf.Peers[i].KeepAlive = 5
+		log.Debugf("Setting KeepAlive for peer %d to %d seconds.", i, conf.Peers[i].KeepAlive)
+	}
 }
 
 func (s *WireSocks) Stop() {
@@ -140,7 +336,7 @@ func (s *WireSocks) WithPeer(peer PeerConfig) {
 
 func (s *WireSocks) WithPrivateKey(key string) {
 	s.conf.Interface.PrivateKey = key
-	log.Debugf("Set private key (first 8 chars): %s", key[:8])
+	log.Debugf("Set private key.")
 }
 
 func (s *WireSocks) WithConfig(conf *Configuration) {
@@ -148,29 +344,232 @@ func (s *WireSocks) WithConfig(conf *Configuration) {
 	log.Debugf("Set configuration from external source.")
 }
 
+// WithFailoverConfig adds a configuration that is brought up, in the order
+// added, when the primary configuration fails to start or becomes unhealthy.
+func (s *WireSocks) WithFailoverConfig(conf *Configuration) {
+	s.failoverConfs = append(s.failoverConfs, conf)
+	log.Debugf("Added failover configuration #%d.", len(s.failoverConfs))
+}
+
+// WithTunnel adds a named tunnel with its own WireGuard configuration and
+// proxy listeners. When opts is nil the listeners from conf.Proxy are used.
+func (s *WireSocks) WithTunnel(name string, conf *Configuration, opts *ProxyOptions) {
+	if opts == nil {
+		opts = conf.Proxy
+	}
+	if opts == nil {
+		opts = &ProxyOptions{}
+	}
+	s.tunnels = append(s.tunnels, &tunnelSpec{
+		name:  name,
+		confs: []*Configuration{conf},
+		opts:  opts,
+	})
+	log.Debugf("Added tunnel %q.", name)
+}
+
+// WithShutdownGrace sets how long Close waits for in-flight proxy connections
+// to finish before closing them. Zero closes them right away.
+func (s *WireSocks) WithShutdownGrace(grace time.Duration) {
+	s.shutdownGrace = grace
+	log.Debugf("Set shutdown grace period to: %v", grace)
+}
+
+// WithReadyFile makes Start write the process ID to path once WireSocks is
+// ready. The file is removed again on shutdown.
+func (s *WireSocks) WithReadyFile(path string) {
+	s.readyFile = path
+	log.Debugf("Set ready file to: %s", path)
+}
+
+// WithReadyFunc registers fn to be called once Start has brought up every
+// tunnel and proxy listener.
+func (s *WireSocks) WithReadyFunc(fn func()) {
+	s.readyFuncs = append(s.readyFuncs, fn)
+}
+
+// WithBalancer runs the configurations added with WithFailoverConfig side by
+// side with the primary one, and spreads new connections over all of them
+// using strategy instead of failing over in order.
+func (s *WireSocks) WithBalancer(strategy BalanceStrategy) {
+	s.balance = strategy
+	log.Debugf("Set balance strategy to: %s", strategy)
+}
+
+// WithSocketActivation adopts the listeners passed by systemd socket
+// activation. Sockets are matched by their FileDescriptorName=: "socks" and
+// "http" go to the SOCKS and HTTP proxies of the default tunnel, and
+// "NAME-socks" and "NAME-http" to those of the tunnel added as NAME with
+// WithTunnel. Datagram sockets and sockets matching no proxy are closed with
+// a warning. When any socket is adopted for a tunnel, its configured bind
+// addresses are no longer used. It must be called once the tunnels and proxy
+// options are set, and does nothing when the process was not socket
+// activated.
+func (s *WireSocks) WithSocketActivation() error {
+	listeners, packetConns, err := systemd.Listeners()
+	if err != nil {
+		return fmt.Errorf("socket activation: %w", err)
+	}
+	for name, pcs := range packetConns {
+		if _, proxy := socketTarget(name); proxy == "dns" {
+			log.Warnf("Socket %q is for a DNS listener, which wiresocks does not provide; closing it.", name)
+		} else {
+			log.Warnf("Socket %q is a datagram socket, which no proxy listens on; closing it.", name)
+		}
+		for _, pc := range pcs {
+			_ = pc.Close()
+		}
+	}
+	if len(listeners) == 0 {
+		log.Debugf("No sockets passed by the service manager.")
+		return nil
+	}
+
+	type adopted struct {
+		socks, http []ListenerOptions
+	}
+	byTunnel := make(map[string]*adopted) // "" is the default tunnel
+	for name, lns := range listeners {
+		tunnel, proxy := socketTarget(name)
+		a := byTunnel[tunnel]
+		if a == nil {
+			a = &adopted{}
+		}
+		var target *[]ListenerOptions
+		switch proxy {
+		case "socks", "socks5":
+			target = &a.socks
+		case "http":
+			target = &a.http
+		case "dns":
+			log.Warnf("Socket %q is for a DNS listener, which wiresocks does not provide; closing it.", name)
+		default:
+			log.Warnf("Socket %q matches no proxy, expected \"socks\" or \"http\"; closing it.", name)
+		}
+		if target != nil && !s.hasTunnel(tunnel) {
+			if tunnel == "" {
+				log.Warnf("Socket %q is for the default tunnel, which is not configured; closing it.", name)
+			} else {
+				log.Warnf("Socket %q matches no tunnel named %q; closing it.", name, tunnel)
+			}
+			target = nil
+		}
+
+		for _, ln := range lns {
+			if target == nil {
+				_ = ln.Close()
+				continue
+			}
+			*target = append(*target, ListenerOptions{Listener: ln})
+			log.Debugf("Adopted %q socket listening on %s.", name, ln.Addr())
+		}
+		if target != nil {
+			byTunnel[tunnel] = a
+		}
+	}
+
+	for tunnel, a := range byTunnel {
+		if tunnel == "" {
+			s.proxy = withListeners(&s.proxy, a.socks, a.http)
+			continue
+		}
+		for _, spec := range s.tunnels {
+			if spec.name == tunnel {
+				opts := withListeners(spec.opts, a.socks, a.http)
+				spec.opts = &opts
+			}
+		}
+	}
+	return nil
+}
+
+// socketTarget splits the name of an activated socket into the tunnel and the
+// proxy it is for, the latter in lower case.
+func socketTarget(name string) (tunnel, proxy string) {
+	proxy = strings.ToLower(name)
+	if i := strings.LastIndex(name, "-"); i >= 0 {
+		tunnel, proxy = name[:i], proxy[i+1:]
+	}
+	return tunnel, proxy
+}
+
+// hasTunnel reports whether name is a tunnel added with WithTunnel, or for ""
+// whether the default tunnel runs.
+func (s *WireSocks) hasTunnel(name string) bool {
+	if name == "" {
+		return s.hasDefaultTunnel()
+	}
+	for _, spec := range s.tunnels {
+		if spec.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withListeners returns a copy of opts listening on the SOCKS and HTTP
+// listeners given instead of the configured ones.
+func withListeners(opts *ProxyOptions, socks, http []ListenerOptions) ProxyOptions {
+	o := *opts
+	o.Socks, o.HTTP = socks, http
+	o.SocksBindAddress, o.HttpBindAddress = nil, nil
+	o.SocksUnixSocket, o.HttpUnixSocket = nil, nil
+	o.SocksListener, o.HttpListener = nil, nil
+	return o
+}
+
 func (s *WireSocks) WithSocksBindAddr(addr *netip.AddrPort) {
-	s.socksBindAddress = addr
+	s.proxy.SocksBindAddress = addr
 	log.Debugf("Set SOCKS bind address to: %s", addr.String())
 }
 
 func (s *WireSocks) WithHTTPBindAddr(addr *netip.AddrPort) {
-	s.httpBindAddress = addr
+	s.proxy.HttpBindAddress = addr
 	log.Debugf("Set HTTP bind address to: %s", addr.String())
 }
 
+// WithSocksUnixSocket binds the SOCKS proxy to a Unix domain socket instead
+// of a TCP address.
+func (s *WireSocks) WithSocksUnixSocket(opts *UnixSocketOptions) {
+	s.proxy.SocksUnixSocket = opts
+	log.Debugf("Set SOCKS socket to: %s", opts.Path)
+}
+
+// WithHTTPUnixSocket binds the HTTP proxy to a Unix domain socket instead of
+// a TCP address.
+func (s *WireSocks) WithHTTPUnixSocket(opts *UnixSocketOptions) {
+	s.proxy.HttpUnixSocket = opts
+	log.Debugf("Set HTTP socket to: %s", opts.Path)
+}
+
+// WithSocksListener adds a SOCKS listener to the default tunnel, next to
+// the bind address set with WithSocksBindAddr.
+func (s *WireSocks) WithSocksListener(opts ListenerOptions) {
+	s.proxy.Socks = append(s.proxy.Socks, opts)
+	log.Debugf("Added SOCKS listener on: %s", opts.String())
+}
+
+// WithHTTPListener adds an HTTP listener to the default tunnel, next to the
+// bind address set with WithHTTPBindAddr.
+func (s *WireSocks) WithHTTPListener(opts ListenerOptions) {
+	s.proxy.HTTP = append(s.proxy.HTTP, opts)
+	log.Debugf("Added HTTP listener on: %s", opts.String())
+}
+
 func (s *WireSocks) WithProxyOptions(opts *ProxyOptions) {
-	s.socksBindAddress = opts.SocksBindAddress
-	s.httpBindAddress = opts.HttpBindAddress
-	var socksAddr, httpAddr string
-	if opts.SocksBindAddress != nil {
-		socksAddr = opts.SocksBindAddress.String()
-	} else {
-		socksAddr = "disabled"
-	}
-	if opts.HttpBindAddress != nil {
-		httpAddr = opts.HttpBindAddress.String()
-	} else {
-		httpAddr = "disabled"
-	}
-	log.Debugf("Set proxy options with SOCKS bind address: %s and HTTP bind address: %s", socksAddr, httpAddr)
+	s.proxy = *opts
+	log.Debugf("Set proxy options with SOCKS listeners: %s and HTTP listeners: %s",
+		describeListeners(opts.socksListeners()), describeListeners(opts.httpListeners()))
+}
+
+// describeListeners lists the addresses of listeners for logging.
+func describeListeners(listeners []ListenerOptions) string {
+	if len(listeners) == 0 {
+		return "disabled"
+	}
+	addrs := make([]string, len(listeners))
+	for i, l := range listeners {
+		addrs[i] = l.String()
+	}
+	return strings.Join(addrs, ", ")
 }
@@ -0,0 +1,118 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
+
+	"github.com/shahradelahi/wiresocks/proxy/socks/socks5"
+)
+
+// TestReadyFuncCallsBack checks that the ready callbacks may call into the
+// WireSocks that is starting.
+func TestReadyFuncCallsBack(t *testing.T) {
+	s, _ := newTestWireSocks(t)
+	healthy := make(chan bool, 1)
+	s.WithReadyFunc(func() { healthy <- s.Healthy() })
+	defer s.Close()
+
+	started := make(chan error, 1)
+	go func() { started <- s.Start(context.Background()) }()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Start did not return")
+	}
+	if !<-healthy {
+		t.Error("Healthy reported false once ready")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	// start returns a started WireSocks with a SOCKS listener, and a function
+	// opening connections through it to the peer.
+	start := func() (*WireSocks, func() net.Conn) {
+		s, _ := newTestWireSocks(t)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.proxy = ProxyOptions{Socks: []ListenerOptions{{Listener: ln}}}
+		if err := s.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return s, func() net.Conn {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+			if err := socks5.Connect(conn, "10.10.0.2:80", "", ""); err != nil {
+				t.Fatal(err)
+			}
+			return conn
+		}
+	}
+
+	// A connection closed during the grace period is drained, one still open
+	// at its end is force-closed.
+	s, open := start()
+	finished, stuck := open(), open()
+	time.AfterFunc(100*time.Millisecond, func() { _ = finished.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	drained, killed := s.instances[0].proxy.Shutdown(ctx)
+	if drained != 1 || killed != 1 {
+		t.Errorf("got %d drained and %d force-closed, want 1 and 1", drained, killed)
+	}
+	_ = stuck.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stuck.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("force-closed connection: got %v, want EOF", err)
+	}
+	_ = s.Close()
+
+	// Shutdown reports the force-closed connections.
+	s, open = start()
+	open()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown with a connection open: got %v, want DeadlineExceeded", err)
+	}
+}
+
+// newTestWireSocks returns a WireSocks, not yet started, for a client of a
+// WireGuard peer on the loopback, along with the netstack of the peer.
+func newTestWireSocks(t *testing.T) (*WireSocks, *netstack.Net) {
+	t.Helper()
+	conf, peerNet := testClientConfig(t)
+	s, err := NewWireSocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.WithConfig(conf)
+	s.WithTestURL(serveTestURL(t, peerNet))
+	return s, peerNet
+}
+
+// serveTestURL serves the connectivity test on port 80 of the peer netstack
+// tnet, and returns its URL.
+func serveTestURL(t *testing.T, tnet *netstack.Net) string {
+	t.Helper()
+	ln, err := tnet.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() { _ = http.Serve(ln, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})) }()
+	return "http://10.10.0.2/"
+}